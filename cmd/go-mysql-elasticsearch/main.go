@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
@@ -22,11 +23,19 @@ var server_id = flag.Int("server_id", 0, "MySQL server id, as a pseudo slave")
 var flavor = flag.String("flavor", "", "flavor: mysql or mariadb")
 var execution = flag.String("exec", "", "mysqldump execution path")
 var logLevel = flag.String("log_level", "info", "log level")
+var logFormat = flag.String("log_format", river.LogFormatText, "log format: text or json")
+var check = flag.Bool("check", false, "validate the config with MySQL and Elasticsearch without syncing, then exit, the exit code is 1 if invalid")
+var checkES = flag.Bool("check_es", true, "check Elasticsearch in the check mode")
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	flag.Parse()
 
+	// the JSON format replaces the logger, so set it before the level
+	if err := river.SetLogFormat(*logFormat, os.Stdout); err != nil {
+		println(errors.ErrorStack(err))
+		return
+	}
 	log.SetLevelByName(*logLevel)
 
 	sc := make(chan os.Signal, 1)
@@ -41,6 +50,9 @@ func main() {
 	cfg, err := river.NewConfigWithFile(*configFile)
 	if err != nil {
 		println(errors.ErrorStack(err))
+		if *check {
+			os.Exit(1)
+		}
 		return
 	}
 
@@ -76,6 +88,11 @@ func main() {
 		cfg.DumpExec = *execution
 	}
 
+	if *check {
+		runCheck(cfg)
+		return
+	}
+
 	r, err := river.NewRiver(cfg)
 	if err != nil {
 		println(errors.ErrorStack(err))
@@ -98,3 +115,24 @@ func main() {
 	r.Close()
 	<-done
 }
+
+// runCheck validates the config and prints the summary, it exits with 1 if invalid.
+func runCheck(cfg *river.Config) {
+	summary, err := river.Check(cfg, *checkES)
+	if err != nil {
+		fmt.Printf("config %s is invalid: %v\n", *configFile, err)
+		println(errors.ErrorStack(err))
+		os.Exit(1)
+	}
+
+	fmt.Printf("config %s is valid\n", *configFile)
+	fmt.Printf("MySQL %s: %d rules for %d tables, binlog row image is FULL\n", cfg.MyAddr, summary.Rules, len(summary.Tables))
+	for _, table := range summary.Tables {
+		fmt.Printf("  %s\n", table)
+	}
+	if summary.ESChecked {
+		fmt.Printf("Elasticsearch %s: reachable, the index aliases can be written\n", cfg.ESAddr)
+	} else {
+		fmt.Println("Elasticsearch: not checked")
+	}
+}
@@ -2,12 +2,20 @@ package elastic
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/juju/errors"
 )
@@ -17,43 +25,152 @@ import (
 // Because we only need some very simple usages.
 type Client struct {
 	Protocol string
+	// Addr is the first ES host.
 	Addr     string
 	User     string
 	Password string
 
+	// PathPrefix is prepended to the path of every request, like "/es" for ES behind a
+	// proxy, it starts with "/" and has no trailing "/", or is empty.
+	PathPrefix string
+
+	// Version is the ES major version, the mapping types are not used since ES 7.
+	Version int
+
+	// Gzip compresses the bulk request body.
+	Gzip bool
+
+	// Headers are added to every request, like the tracing headers for a proxy.
+	Headers map[string]string
+	// RequestIDHeader is the header set to a unique random ID for every request if not empty,
+	// like X-Request-ID.
+	RequestIDHeader string
+
+	// all the ES hosts, addrIndex is the current one and updated atomically
+	addrs     []string
+	addrIndex uint32
+
 	c *http.Client
 }
 
 // ClientConfig is the configuration for the client.
 type ClientConfig struct {
-	HTTPS    bool
+	HTTPS bool
+	// Addr is the ES host, or the hosts separated by comma to fail over
+	// to the next one for the bulk connection errors.
 	Addr     string
 	User     string
 	Password string
+
+	// PathPrefix is prepended to the path of every request, like "/es" if ES is
+	// exposed under a subpath of a proxy, empty means the root.
+	PathPrefix string
+
+	// TLSConfig is used for HTTPS, if nil, the default TLS configuration is used.
+	TLSConfig *tls.Config
+
+	// Version is the ES major version, 0 means an old version using the mapping types.
+	Version int
+
+	// Gzip compresses the bulk request body, ES must enable http.compression.
+	Gzip bool
+
+	// Timeout is the timeout for every request, 0 means no timeout.
+	Timeout time.Duration
+
+	// Headers are added to every request.
+	Headers map[string]string
+	// RequestIDHeader is set to a unique random ID for every request if not empty.
+	RequestIDHeader string
 }
 
 // NewClient creates the Cient with configuration.
 func NewClient(conf *ClientConfig) *Client {
 	c := new(Client)
 
-	c.Addr = conf.Addr
+	for _, addr := range strings.Split(conf.Addr, ",") {
+		if addr = strings.TrimSpace(addr); len(addr) > 0 {
+			c.addrs = append(c.addrs, addr)
+		}
+	}
+	if len(c.addrs) > 0 {
+		c.Addr = c.addrs[0]
+	}
 	c.User = conf.User
 	c.Password = conf.Password
+	c.PathPrefix = normalizePathPrefix(conf.PathPrefix)
+	c.Version = conf.Version
+	c.Gzip = conf.Gzip
+	c.Headers = conf.Headers
+	c.RequestIDHeader = conf.RequestIDHeader
 
 	if conf.HTTPS {
 		c.Protocol = "https"
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		c.c = &http.Client{Transport: tr}
+		c.c = &http.Client{Transport: newTransport(conf.TLSConfig), Timeout: conf.Timeout}
 	} else {
 		c.Protocol = "http"
-		c.c = &http.Client{}
+		c.c = &http.Client{Timeout: conf.Timeout}
 	}
 
 	return c
 }
 
+// currentAddr returns the ES host to send the requests.
+func (c *Client) currentAddr() string {
+	if len(c.addrs) == 0 {
+		return c.Addr
+	}
+
+	return c.addrs[atomic.LoadUint32(&c.addrIndex)%uint32(len(c.addrs))]
+}
+
+// addrURL returns the URL with the path prefix for the ES host, the request path is appended.
+func (c *Client) addrURL(addr string) string {
+	return fmt.Sprintf("%s://%s%s", c.Protocol, addr, c.PathPrefix)
+}
+
+// baseURL returns the URL with the path prefix for the current ES host.
+func (c *Client) baseURL() string {
+	return c.addrURL(c.currentAddr())
+}
+
+// normalizePathPrefix makes the prefix start with "/" and have no trailing "/",
+// so "es", "/es" and "/es/" are the same, and "/" is empty.
+func normalizePathPrefix(prefix string) string {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	if len(prefix) == 0 {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// failover switches to the next host if the failed host is still the current one.
+func (c *Client) failover(failed string) {
+	index := atomic.LoadUint32(&c.addrIndex)
+	if c.addrs[index%uint32(len(c.addrs))] == failed {
+		atomic.CompareAndSwapUint32(&c.addrIndex, index, index+1)
+	}
+}
+
+// newTransport creates a transport like http.DefaultTransport, which keeps the
+// connections alive, but with our own TLS configuration. We always talk to the
+// same host, so keep more idle connections for it than the default.
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+}
+
 // ResponseItem is the ES item in the response.
 type ResponseItem struct {
 	ID      string                 `json:"_id"`
@@ -62,6 +179,10 @@ type ResponseItem struct {
 	Version int                    `json:"_version"`
 	Found   bool                   `json:"found"`
 	Source  map[string]interface{} `json:"_source"`
+
+	// SeqNo and PrimaryTerm are returned since ES 6.7 for the optimistic concurrency control.
+	SeqNo       int64 `json:"_seq_no"`
+	PrimaryTerm int64 `json:"_primary_term"`
 }
 
 // Response is the ES response
@@ -76,6 +197,10 @@ const (
 	ActionUpdate = "update"
 	ActionDelete = "delete"
 	ActionIndex  = "index"
+
+	// ActionDeleteByQuery deletes all the docs matching the Query of the request by
+	// DeleteByQuery, it's not a bulk action and can't be sent in a bulk.
+	ActionDeleteByQuery = "delete_by_query"
 )
 
 // BulkRequest is used to send multi request in batch.
@@ -85,18 +210,62 @@ type BulkRequest struct {
 	Type     string
 	ID       string
 	Parent   string
+	Routing  string
 	Pipeline string
 
+	// Upsert is only for the update action, the doc is inserted if not exists.
+	Upsert bool
+
+	// Version is the external version if > 0, ES rejects the request with
+	// an older version, or the same version except for the delete action.
+	// The update action doesn't support it.
+	Version int64
+
+	// IfSeqNo and IfPrimaryTerm make ES reject the request with a conflict if the doc
+	// was changed after the sequence number, only set if IfPrimaryTerm > 0.
+	IfSeqNo       int64
+	IfPrimaryTerm int64
+
+	// Expected is not sent, it's the fields the doc is expected to have before the
+	// request, e.g, to verify the doc before a conditional delete.
+	Expected map[string]interface{}
+
+	// Query is the query of the delete_by_query action.
+	Query map[string]interface{}
+
 	Data map[string]interface{}
+
+	// the size cached by EncodedSize for the ES version, 0 if not encoded yet
+	encodedSize    int
+	encodedVersion int
 }
 
-func (r *BulkRequest) bulk(buf *bytes.Buffer) error {
-	meta := make(map[string]map[string]string)
-	metaData := make(map[string]string)
+// typelessVersion is the first ES version deprecating the mapping types.
+const typelessVersion = 7
+
+// VersionType returns the version type of Version, empty if there is no version.
+func (r *BulkRequest) VersionType() string {
+	if r.Version <= 0 {
+		return ""
+	}
+	// the deleted row has the same version as its doc, which external rejects
+	if r.Action == ActionDelete {
+		return "external_gte"
+	}
+	return "external"
+}
+
+func (r *BulkRequest) bulk(buf *bytes.Buffer, version int) error {
+	if r.Action == ActionDeleteByQuery {
+		return errors.Errorf("%s index: %s, id: %s can't be sent in a bulk", r.Action, r.Index, r.ID)
+	}
+
+	meta := make(map[string]map[string]interface{})
+	metaData := make(map[string]interface{})
 	if len(r.Index) > 0 {
 		metaData["_index"] = r.Index
 	}
-	if len(r.Type) > 0 {
+	if len(r.Type) > 0 && version < typelessVersion {
 		metaData["_type"] = r.Type
 	}
 
@@ -106,9 +275,34 @@ func (r *BulkRequest) bulk(buf *bytes.Buffer) error {
 	if len(r.Parent) > 0 {
 		metaData["_parent"] = r.Parent
 	}
-	if len(r.Pipeline) > 0 {
+	if len(r.Routing) > 0 {
+		// the _routing is removed since ES 7
+		if version < typelessVersion {
+			metaData["_routing"] = r.Routing
+		} else {
+			metaData["routing"] = r.Routing
+		}
+	}
+	// the pipeline is only for the index and create actions
+	if len(r.Pipeline) > 0 && (r.Action == ActionIndex || r.Action == ActionCreate) {
 		metaData["pipeline"] = r.Pipeline
 	}
+	if r.Version > 0 {
+		versionType := r.VersionType()
+		// the _version and _version_type are removed since ES 7
+		if version < typelessVersion {
+			metaData["_version"] = r.Version
+			metaData["_version_type"] = versionType
+		} else {
+			metaData["version"] = r.Version
+			metaData["version_type"] = versionType
+		}
+	}
+
+	if r.IfPrimaryTerm > 0 {
+		metaData["if_seq_no"] = r.IfSeqNo
+		metaData["if_primary_term"] = r.IfPrimaryTerm
+	}
 
 	meta[r.Action] = metaData
 
@@ -127,6 +321,9 @@ func (r *BulkRequest) bulk(buf *bytes.Buffer) error {
 		doc := map[string]interface{}{
 			"doc": r.Data,
 		}
+		if r.Upsert {
+			doc["doc_as_upsert"] = true
+		}
 		data, err = json.Marshal(doc)
 		if err != nil {
 			return errors.Trace(err)
@@ -148,6 +345,22 @@ func (r *BulkRequest) bulk(buf *bytes.Buffer) error {
 	return nil
 }
 
+// EncodedSize returns the bytes of the request in the bulk body for the ES version,
+// before compressing the body. The size is cached, so the request must not be changed
+// after it is called, and it is not safe to call concurrently for the same request.
+func (r *BulkRequest) EncodedSize(version int) (int, error) {
+	if r.encodedSize > 0 && r.encodedVersion == version {
+		return r.encodedSize, nil
+	}
+
+	var buf bytes.Buffer
+	if err := r.bulk(&buf, version); err != nil {
+		return 0, errors.Trace(err)
+	}
+	r.encodedSize, r.encodedVersion = buf.Len(), version
+	return buf.Len(), nil
+}
+
 // BulkResponse is the response for the bulk request.
 type BulkResponse struct {
 	Code   int
@@ -186,12 +399,27 @@ type Mapping map[string]struct {
 
 // DoRequest sends a request with body to ES.
 func (c *Client) DoRequest(method string, url string, body *bytes.Buffer) (*http.Response, error) {
+	return c.doRequest(context.Background(), method, url, body, false)
+}
+
+func (c *Client) doRequest(ctx context.Context, method string, url string, body *bytes.Buffer, gzipped bool) (*http.Response, error) {
 	req, err := http.NewRequest(method, url, body)
-	req.Header.Add("Content-Type", "application/json")
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	if len(c.User) > 0 && len(c.Password) > 0 {
+	req = req.WithContext(ctx)
+	req.Header.Add("Content-Type", "application/json")
+	if gzipped {
+		req.Header.Add("Content-Encoding", "gzip")
+	}
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	if len(c.RequestIDHeader) > 0 {
+		req.Header.Set(c.RequestIDHeader, newRequestID())
+	}
+	// Credentials are optional, the password may be empty for some users.
+	if len(c.User) > 0 {
 		req.SetBasicAuth(c.User, c.Password)
 	}
 	resp, err := c.c.Do(req)
@@ -199,6 +427,16 @@ func (c *Client) DoRequest(method string, url string, body *bytes.Buffer) (*http
 	return resp, err
 }
 
+// newRequestID returns a random hex ID for RequestIDHeader.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// never happens for the system random source, but the ID is still unique enough
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
 // Do sends the request with body to ES.
 func (c *Client) Do(method string, url string, body map[string]interface{}) (*Response, error) {
 	bodyData, err := json.Marshal(body)
@@ -235,19 +473,69 @@ func (c *Client) Do(method string, url string, body map[string]interface{}) (*Re
 
 // DoBulk sends the bulk request to the ES.
 func (c *Client) DoBulk(url string, items []*BulkRequest) (*BulkResponse, error) {
+	body, err := c.encodeBulk(items)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp, err := c.doRequest(context.Background(), "POST", url, bytes.NewBuffer(body), c.Gzip)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return readBulkResponse(resp)
+}
+
+// doBulk sends the bulk request to the path, and fails over to the next host
+// on the connection errors, but not if the context is done.
+func (c *Client) doBulk(ctx context.Context, path string, items []*BulkRequest) (*BulkResponse, error) {
+	body, err := c.encodeBulk(items)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for i := 0; ; i++ {
+		addr := c.currentAddr()
+		reqURL := c.addrURL(addr) + path
+
+		resp, err := c.doRequest(ctx, "POST", reqURL, bytes.NewBuffer(body), c.Gzip)
+		if err == nil {
+			return readBulkResponse(resp)
+		}
+
+		if i+1 >= len(c.addrs) || ctx.Err() != nil {
+			return nil, errors.Trace(err)
+		}
+		c.failover(addr)
+	}
+}
+
+func (c *Client) encodeBulk(items []*BulkRequest) ([]byte, error) {
 	var buf bytes.Buffer
 
 	for _, item := range items {
-		if err := item.bulk(&buf); err != nil {
+		if err := item.bulk(&buf, c.Version); err != nil {
 			return nil, errors.Trace(err)
 		}
 	}
 
-	resp, err := c.DoRequest("POST", url, &buf)
-	if err != nil {
+	if !c.Gzip {
+		return buf.Bytes(), nil
+	}
+
+	var body bytes.Buffer
+	w := gzip.NewWriter(&body)
+	if _, err := w.Write(buf.Bytes()); err != nil {
 		return nil, errors.Trace(err)
 	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return body.Bytes(), nil
+}
 
+func readBulkResponse(resp *http.Response) (*BulkResponse, error) {
 	defer resp.Body.Close()
 
 	ret := new(BulkResponse)
@@ -262,12 +550,47 @@ func (c *Client) DoBulk(url string, items []*BulkRequest) (*BulkResponse, error)
 		err = json.Unmarshal(data, &ret)
 	}
 
+	// the error body, e.g, from a proxy, may not be in JSON, return the code
+	// for the caller to check
+	if err != nil && ret.Code/100 != 2 {
+		return ret, nil
+	}
+
 	return ret, errors.Trace(err)
 }
 
+// typeless returns whether the mapping type is not used for the URL.
+func (c *Client) typeless(docType string) bool {
+	return len(docType) == 0 || c.Version >= typelessVersion
+}
+
+// docURL returns the document URL, the _doc endpoint is used for the typeless index.
+func (c *Client) docURL(index string, docType string, id string) string {
+	if c.typeless(docType) {
+		docType = "_doc"
+	}
+
+	return fmt.Sprintf("%s/%s/%s/%s", c.baseURL(),
+		url.QueryEscape(index),
+		url.QueryEscape(docType),
+		url.QueryEscape(id))
+}
+
+// mappingURL returns the mapping URL, the type is omitted for the typeless index.
+func (c *Client) mappingURL(index string, docType string) string {
+	if c.typeless(docType) {
+		return fmt.Sprintf("%s/%s/_mapping", c.baseURL(),
+			url.QueryEscape(index))
+	}
+
+	return fmt.Sprintf("%s/%s/%s/_mapping", c.baseURL(),
+		url.QueryEscape(index),
+		url.QueryEscape(docType))
+}
+
 // CreateMapping creates a ES mapping.
 func (c *Client) CreateMapping(index string, docType string, mapping map[string]interface{}) error {
-	reqURL := fmt.Sprintf("%s://%s/%s", c.Protocol, c.Addr,
+	reqURL := fmt.Sprintf("%s/%s", c.baseURL(),
 		url.QueryEscape(index))
 
 	r, err := c.Do("HEAD", reqURL, nil)
@@ -286,9 +609,7 @@ func (c *Client) CreateMapping(index string, docType string, mapping map[string]
 		return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
 	}
 
-	reqURL = fmt.Sprintf("%s://%s/%s/%s/_mapping", c.Protocol, c.Addr,
-		url.QueryEscape(index),
-		url.QueryEscape(docType))
+	reqURL = c.mappingURL(index, docType)
 
 	_, err = c.Do("POST", reqURL, mapping)
 	return errors.Trace(err)
@@ -296,9 +617,7 @@ func (c *Client) CreateMapping(index string, docType string, mapping map[string]
 
 // GetMapping gets the mapping.
 func (c *Client) GetMapping(index string, docType string) (*MappingResponse, error) {
-	reqURL := fmt.Sprintf("%s://%s/%s/%s/_mapping", c.Protocol, c.Addr,
-		url.QueryEscape(index),
-		url.QueryEscape(docType))
+	reqURL := c.mappingURL(index, docType)
 	buf := bytes.NewBuffer(nil)
 	resp, err := c.DoRequest("GET", reqURL, buf)
 
@@ -325,7 +644,7 @@ func (c *Client) GetMapping(index string, docType string) (*MappingResponse, err
 
 // DeleteIndex deletes the index.
 func (c *Client) DeleteIndex(index string) error {
-	reqURL := fmt.Sprintf("%s://%s/%s", c.Protocol, c.Addr,
+	reqURL := fmt.Sprintf("%s/%s", c.baseURL(),
 		url.QueryEscape(index))
 
 	r, err := c.Do("DELETE", reqURL, nil)
@@ -340,22 +659,243 @@ func (c *Client) DeleteIndex(index string) error {
 	return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
 }
 
+// Refresh refreshes the index, so the docs indexed before are searchable. It's no error
+// if the index doesn't exist.
+func (c *Client) Refresh(ctx context.Context, index string) error {
+	reqURL := fmt.Sprintf("%s/%s/_refresh", c.baseURL(),
+		url.QueryEscape(index))
+
+	resp, err := c.doRequest(ctx, "POST", reqURL, bytes.NewBuffer(nil), false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return errors.Errorf("ES refresh index %s error: %s, code: %d", index, http.StatusText(resp.StatusCode), resp.StatusCode)
+}
+
+// DeleteByQueryResponse is the response of DeleteByQuery.
+type DeleteByQueryResponse struct {
+	Code int
+
+	Deleted          int64             `json:"deleted"`
+	VersionConflicts int64             `json:"version_conflicts"`
+	Failures         []json.RawMessage `json:"failures"`
+}
+
+// DeleteByQuery deletes the docs of the index matching the query, the routing limits it to
+// the shard if not empty. The version conflicts, like the docs changed while deleting, are
+// counted but don't abort it. It only sees the refreshed docs, so Refresh the index before
+// if needed. It waits until all the matching docs are deleted and the index is refreshed.
+func (c *Client) DeleteByQuery(ctx context.Context, index string, routing string, query map[string]interface{}) (*DeleteByQueryResponse, error) {
+	reqURL := fmt.Sprintf("%s/%s/_delete_by_query?conflicts=proceed&refresh=true", c.baseURL(),
+		url.QueryEscape(index))
+	if len(routing) > 0 {
+		reqURL += "&routing=" + url.QueryEscape(routing)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"query": query})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp, err := c.doRequest(ctx, "POST", reqURL, bytes.NewBuffer(body), false)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ret := new(DeleteByQueryResponse)
+	ret.Code = resp.StatusCode
+	if resp.StatusCode != http.StatusOK {
+		return ret, nil
+	}
+	if err = json.Unmarshal(data, ret); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return ret, nil
+}
+
+// ErrUnauthorized is the error if ES rejects the credentials.
+var ErrUnauthorized = errors.New("ES unauthorized")
+
+// Ping checks ES is reachable with the credentials by getting the cluster information.
+func (c *Client) Ping() error {
+	reqURL := c.baseURL() + "/"
+
+	r, err := c.Do("GET", reqURL, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	switch r.Code {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return errors.Annotatef(ErrUnauthorized, "user %q, code: %d", c.User, r.Code)
+	}
+
+	return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
+// IndexExists checks whether the index exists or not.
+func (c *Client) IndexExists(index string) (bool, error) {
+	reqURL := fmt.Sprintf("%s/%s", c.baseURL(),
+		url.QueryEscape(index))
+
+	r, err := c.Do("HEAD", reqURL, nil)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	switch r.Code {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+
+	return false, errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
+// GetAliasIndices returns the indices of the alias, the value is whether the index is
+// the write index of the alias. It's empty if the alias doesn't exist.
+func (c *Client) GetAliasIndices(alias string) (map[string]bool, error) {
+	reqURL := fmt.Sprintf("%s/_alias/%s", c.baseURL(),
+		url.QueryEscape(alias))
+
+	resp, err := c.DoRequest("GET", reqURL, bytes.NewBuffer(nil))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return map[string]bool{}, nil
+	default:
+		return nil, errors.Errorf("Error: %s, code: %d", http.StatusText(resp.StatusCode), resp.StatusCode)
+	}
+
+	var ret map[string]struct {
+		Aliases map[string]struct {
+			IsWriteIndex bool `json:"is_write_index"`
+		} `json:"aliases"`
+	}
+	if err = json.Unmarshal(data, &ret); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	indices := make(map[string]bool, len(ret))
+	for index, v := range ret {
+		indices[index] = v.Aliases[alias].IsWriteIndex
+	}
+	return indices, nil
+}
+
+// CreateIndex creates the index with the body, like the settings and mappings.
+func (c *Client) CreateIndex(index string, body map[string]interface{}) error {
+	reqURL := fmt.Sprintf("%s/%s", c.baseURL(),
+		url.QueryEscape(index))
+
+	r, err := c.Do("PUT", reqURL, body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if r.Code == http.StatusOK || r.Code == http.StatusCreated {
+		return nil
+	}
+
+	return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
+// MultiGetRequest is the doc to get by MultiGet.
+type MultiGetRequest struct {
+	Index   string
+	Type    string
+	ID      string
+	Routing string
+
+	// Source are the fields of the _source returned, all the fields if empty.
+	Source []string
+}
+
+// MultiGet gets the docs in one request, the items are in the order of the requests.
+// The request is canceled with ctx.
+func (c *Client) MultiGet(ctx context.Context, items []*MultiGetRequest) ([]ResponseItem, error) {
+	docs := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		doc := map[string]interface{}{"_index": item.Index, "_id": item.ID}
+		if !c.typeless(item.Type) {
+			doc["_type"] = item.Type
+		}
+		if len(item.Routing) > 0 {
+			doc["routing"] = item.Routing
+		}
+		if len(item.Source) > 0 {
+			doc["_source"] = item.Source
+		}
+		docs = append(docs, doc)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"docs": docs})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	reqURL := c.baseURL() + "/_mget"
+	resp, err := c.doRequest(ctx, "POST", reqURL, bytes.NewBuffer(body), false)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Error: %s, code: %d", http.StatusText(resp.StatusCode), resp.StatusCode)
+	}
+
+	var ret struct {
+		Docs []ResponseItem `json:"docs"`
+	}
+	if err = json.Unmarshal(data, &ret); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(ret.Docs) != len(items) {
+		return nil, errors.Errorf("mget returns %d docs for %d requests", len(ret.Docs), len(items))
+	}
+	return ret.Docs, nil
+}
+
 // Get gets the item by id.
 func (c *Client) Get(index string, docType string, id string) (*Response, error) {
-	reqURL := fmt.Sprintf("%s://%s/%s/%s/%s", c.Protocol, c.Addr,
-		url.QueryEscape(index),
-		url.QueryEscape(docType),
-		url.QueryEscape(id))
+	reqURL := c.docURL(index, docType, id)
 
 	return c.Do("GET", reqURL, nil)
 }
 
 // Update creates or updates the data
 func (c *Client) Update(index string, docType string, id string, data map[string]interface{}) error {
-	reqURL := fmt.Sprintf("%s://%s/%s/%s/%s", c.Protocol, c.Addr,
-		url.QueryEscape(index),
-		url.QueryEscape(docType),
-		url.QueryEscape(id))
+	reqURL := c.docURL(index, docType, id)
 
 	r, err := c.Do("PUT", reqURL, data)
 	if err != nil {
@@ -371,10 +911,7 @@ func (c *Client) Update(index string, docType string, id string, data map[string
 
 // Exists checks whether id exists or not.
 func (c *Client) Exists(index string, docType string, id string) (bool, error) {
-	reqURL := fmt.Sprintf("%s://%s/%s/%s/%s", c.Protocol, c.Addr,
-		url.QueryEscape(index),
-		url.QueryEscape(docType),
-		url.QueryEscape(id))
+	reqURL := c.docURL(index, docType, id)
 
 	r, err := c.Do("HEAD", reqURL, nil)
 	if err != nil {
@@ -386,10 +923,7 @@ func (c *Client) Exists(index string, docType string, id string) (bool, error) {
 
 // Delete deletes the item by id.
 func (c *Client) Delete(index string, docType string, id string) error {
-	reqURL := fmt.Sprintf("%s://%s/%s/%s/%s", c.Protocol, c.Addr,
-		url.QueryEscape(index),
-		url.QueryEscape(docType),
-		url.QueryEscape(id))
+	reqURL := c.docURL(index, docType, id)
 
 	r, err := c.Do("DELETE", reqURL, nil)
 	if err != nil {
@@ -406,24 +940,24 @@ func (c *Client) Delete(index string, docType string, id string) error {
 // Bulk sends the bulk request.
 // only support parent in 'Bulk' related apis
 func (c *Client) Bulk(items []*BulkRequest) (*BulkResponse, error) {
-	reqURL := fmt.Sprintf("%s://%s/_bulk", c.Protocol, c.Addr)
+	return c.BulkContext(context.Background(), items)
+}
 
-	return c.DoBulk(reqURL, items)
+// BulkContext sends the bulk request, which is cancelled if the context is done.
+func (c *Client) BulkContext(ctx context.Context, items []*BulkRequest) (*BulkResponse, error) {
+	return c.doBulk(ctx, "/_bulk", items)
 }
 
 // IndexBulk sends the bulk request for index.
 func (c *Client) IndexBulk(index string, items []*BulkRequest) (*BulkResponse, error) {
-	reqURL := fmt.Sprintf("%s://%s/%s/_bulk", c.Protocol, c.Addr,
-		url.QueryEscape(index))
-
-	return c.DoBulk(reqURL, items)
+	return c.doBulk(context.Background(), fmt.Sprintf("/%s/_bulk", url.QueryEscape(index)), items)
 }
 
 // IndexTypeBulk sends the bulk request for index and doc type.
 func (c *Client) IndexTypeBulk(index string, docType string, items []*BulkRequest) (*BulkResponse, error) {
-	reqURL := fmt.Sprintf("%s://%s/%s/%s/_bulk", c.Protocol, c.Addr,
-		url.QueryEscape(index),
-		url.QueryEscape(docType))
+	if c.typeless(docType) {
+		return c.IndexBulk(index, items)
+	}
 
-	return c.DoBulk(reqURL, items)
+	return c.doBulk(context.Background(), fmt.Sprintf("/%s/%s/_bulk", url.QueryEscape(index), url.QueryEscape(docType)), items)
 }
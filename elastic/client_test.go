@@ -1,10 +1,23 @@
 package elastic
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/juju/errors"
 	. "github.com/pingcap/check"
 )
 
@@ -143,3 +156,612 @@ func (s *elasticTestSuite) TestParent(c *C) {
 	c.Assert(resp.Code, Equals, 200)
 	c.Assert(resp.Errors, Equals, false)
 }
+
+func TestBulkBasicAuth(t *testing.T) {
+	tests := []struct {
+		User     string
+		Password string
+		Auth     bool
+	}{
+		{"", "", false},
+		{"elastic", "changeme", true},
+		{"elastic", "", true},
+	}
+
+	for _, test := range tests {
+		var user, password string
+		var auth bool
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, password, auth = r.BasicAuth()
+			w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+		}))
+
+		c := NewClient(&ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://"), User: test.User, Password: test.Password})
+		_, err := c.Bulk([]*BulkRequest{{Action: ActionDelete, Index: "river", Type: "river", ID: "1"}})
+		ts.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != test.Auth || user != test.User || password != test.Password {
+			t.Errorf("User: %s, Expected: auth is %t, but: was %t with %s:%s", test.User, test.Auth, auth, user, password)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	tests := []struct {
+		Code  int
+		Cause error
+		Ok    bool
+	}{
+		{http.StatusOK, nil, true},
+		{http.StatusUnauthorized, ErrUnauthorized, false},
+		{http.StatusServiceUnavailable, nil, false},
+	}
+
+	for _, test := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.Code)
+			w.Write([]byte(`{"cluster_name":"elasticsearch","version":{"number":"6.8.0"}}`))
+		}))
+
+		c := NewClient(&ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://")})
+		err := c.Ping()
+		ts.Close()
+
+		if (err == nil) != test.Ok {
+			t.Errorf("Code: %d, Expected: ok is %t, but: was %v", test.Code, test.Ok, err)
+		}
+		if test.Cause != nil && errors.Cause(err) != test.Cause {
+			t.Errorf("Code: %d, Expected: is %v, but: was %v", test.Code, test.Cause, err)
+		}
+	}
+}
+
+func TestBulkHeaders(t *testing.T) {
+	var headers []http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header)
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	}))
+	defer ts.Close()
+
+	c := NewClient(&ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://"),
+		Headers: map[string]string{"X-Env": "staging"}, RequestIDHeader: "X-Request-ID"})
+	for i := 0; i < 2; i++ {
+		if _, err := c.Bulk([]*BulkRequest{{Action: ActionDelete, Index: "river", Type: "river", ID: "1"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, h := range headers {
+		if h.Get("X-Env") != "staging" {
+			t.Errorf("Expected: is staging, but: was %q", h.Get("X-Env"))
+		}
+		if len(h.Get("X-Request-ID")) != 32 {
+			t.Errorf("Expected: is a request id, but: was %q", h.Get("X-Request-ID"))
+		}
+	}
+	if headers[0].Get("X-Request-ID") == headers[1].Get("X-Request-ID") {
+		t.Errorf("Expected: is unique request ids, but: was %q", headers[0].Get("X-Request-ID"))
+	}
+
+	// no header if not configured
+	headers = nil
+	c = NewClient(&ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://")})
+	if _, err := c.Bulk([]*BulkRequest{{Action: ActionDelete, Index: "river", Type: "river", ID: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(headers[0].Get("X-Request-ID")) > 0 {
+		t.Errorf("Expected: is no request id, but: was %q", headers[0].Get("X-Request-ID"))
+	}
+}
+
+func TestGetAliasIndices(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_alias/river":
+			w.Write([]byte(`{"river_v1":{"aliases":{"river":{}}},"river_v2":{"aliases":{"river":{"is_write_index":true}}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"alias [river_v1] missing","status":404}`))
+		}
+	}))
+	defer ts.Close()
+
+	c := NewClient(&ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://")})
+	indices, err := c.GetAliasIndices("river")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]bool{"river_v1": false, "river_v2": true}
+	if !reflect.DeepEqual(indices, expect) {
+		t.Errorf("Expected: is %v, but: was %v", expect, indices)
+	}
+
+	if indices, err = c.GetAliasIndices("river_v1"); err != nil || len(indices) != 0 {
+		t.Errorf("Expected: is no index, but: was %v, %v", indices, err)
+	}
+}
+
+func TestBulkHTTPS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	}))
+	defer ts.Close()
+
+	addr := strings.TrimPrefix(ts.URL, "https://")
+	items := []*BulkRequest{{Action: ActionDelete, Index: "river", Type: "river", ID: "1"}}
+
+	// the test server uses a self-signed certificate
+	c := NewClient(&ClientConfig{HTTPS: true, Addr: addr})
+	if _, err := c.Bulk(items); err == nil {
+		t.Error("Expected: an error for the unknown certificate, but: was nil")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	c = NewClient(&ClientConfig{HTTPS: true, Addr: addr, TLSConfig: &tls.Config{RootCAs: pool}})
+	for i := 0; i < 2; i++ {
+		resp, err := c.Bulk(items)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != http.StatusOK {
+			t.Errorf("Code Expected: is %d, but: was %d", http.StatusOK, resp.Code)
+		}
+	}
+}
+
+func TestBulkRequestMeta(t *testing.T) {
+	req := &BulkRequest{Action: ActionDelete, Index: "river", Type: "river", ID: "1", Routing: "10"}
+
+	var buf bytes.Buffer
+	if err := req.bulk(&buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `{"delete":{"_id":"1","_index":"river","_routing":"10","_type":"river"}}` + "\n"
+	if buf.String() != expect {
+		t.Errorf("Expected: is %q, but: was %q", expect, buf.String())
+	}
+}
+
+func TestBulkRequestEncodedSize(t *testing.T) {
+	req := &BulkRequest{Action: ActionIndex, Index: "river", Type: "river", ID: "1", Data: map[string]interface{}{"title": "a"}}
+
+	var buf bytes.Buffer
+	if err := req.bulk(&buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := req.EncodedSize(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != buf.Len() {
+		t.Errorf("Expected: is %d, but: was %d", buf.Len(), size)
+	}
+
+	// the cached size is returned without encoding again
+	req.Data = map[string]interface{}{"title": "abc"}
+	if size, err = req.EncodedSize(0); err != nil || size != buf.Len() {
+		t.Errorf("Expected: is the cached %d, but: was %d, %v", buf.Len(), size, err)
+	}
+
+	// but not for another version
+	buf.Reset()
+	if err = req.bulk(&buf, 7); err != nil {
+		t.Fatal(err)
+	}
+	if size, err = req.EncodedSize(7); err != nil || size != buf.Len() {
+		t.Errorf("Expected: is %d for version 7, but: was %d, %v", buf.Len(), size, err)
+	}
+}
+
+func TestBulkRequestUpdate(t *testing.T) {
+	tests := []struct {
+		Upsert bool
+		Expect string
+	}{
+		{false, `{"update":{"_id":"1","_index":"river","_type":"river"}}` + "\n" + `{"doc":{"title":"a"}}` + "\n"},
+		{true, `{"update":{"_id":"1","_index":"river","_type":"river"}}` + "\n" + `{"doc":{"title":"a"},"doc_as_upsert":true}` + "\n"},
+	}
+
+	for _, test := range tests {
+		req := &BulkRequest{Action: ActionUpdate, Index: "river", Type: "river", ID: "1", Upsert: test.Upsert,
+			Data: map[string]interface{}{"title": "a"}}
+
+		var buf bytes.Buffer
+		if err := req.bulk(&buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.Expect {
+			t.Errorf("Upsert: %t, Expected: is %q, but: was %q", test.Upsert, test.Expect, buf.String())
+		}
+	}
+}
+
+func TestBulkRequestTypeless(t *testing.T) {
+	req := &BulkRequest{Action: ActionIndex, Index: "river", Type: "river", ID: "1", Routing: "10",
+		Data: map[string]interface{}{"title": "a"}}
+
+	tests := []struct {
+		Version int
+		Expect  string
+	}{
+		{6, `{"index":{"_id":"1","_index":"river","_routing":"10","_type":"river"}}` + "\n" + `{"title":"a"}` + "\n"},
+		{7, `{"index":{"_id":"1","_index":"river","routing":"10"}}` + "\n" + `{"title":"a"}` + "\n"},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := req.bulk(&buf, test.Version); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.Expect {
+			t.Errorf("Version: %d, Expected: is %q, but: was %q", test.Version, test.Expect, buf.String())
+		}
+	}
+}
+
+func TestTypelessURL(t *testing.T) {
+	c := NewClient(&ClientConfig{Addr: "127.0.0.1:9200"})
+	if u := c.docURL("river", "river", "1"); u != "http://127.0.0.1:9200/river/river/1" {
+		t.Errorf("Typed Expected: is the type URL, but: was %s", u)
+	}
+	if u := c.docURL("river", "", "1"); u != "http://127.0.0.1:9200/river/_doc/1" {
+		t.Errorf("Empty type Expected: is the _doc URL, but: was %s", u)
+	}
+
+	c = NewClient(&ClientConfig{Addr: "127.0.0.1:9200", Version: 7})
+	if u := c.docURL("river", "river", "1"); u != "http://127.0.0.1:9200/river/_doc/1" {
+		t.Errorf("Version 7 Expected: is the _doc URL, but: was %s", u)
+	}
+	if u := c.mappingURL("river", "river"); u != "http://127.0.0.1:9200/river/_mapping" {
+		t.Errorf("Version 7 Expected: is the typeless mapping URL, but: was %s", u)
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	tests := []struct {
+		Prefix string
+		URL    string
+	}{
+		{"", "http://127.0.0.1:9200/river/_doc/1"},
+		{"/", "http://127.0.0.1:9200/river/_doc/1"},
+		{"/es", "http://127.0.0.1:9200/es/river/_doc/1"},
+		{"es/", "http://127.0.0.1:9200/es/river/_doc/1"},
+		{"/proxy/es/", "http://127.0.0.1:9200/proxy/es/river/_doc/1"},
+	}
+	for _, test := range tests {
+		c := NewClient(&ClientConfig{Addr: "127.0.0.1:9200", Version: 7, PathPrefix: test.Prefix})
+		if u := c.docURL("river", "", "1"); u != test.URL {
+			t.Errorf("Prefix %q Expected: is %s, but: was %s", test.Prefix, test.URL, u)
+		}
+	}
+
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Write([]byte(`{"errors":false,"items":[]}`))
+	}))
+	defer ts.Close()
+
+	items := []*BulkRequest{{Action: ActionIndex, Index: "river", ID: "1", Data: map[string]interface{}{"a": 1}}}
+	for _, prefix := range []string{"", "/es"} {
+		c := NewClient(&ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://"), Version: 7, PathPrefix: prefix})
+		if _, err := c.Bulk(items); err != nil {
+			t.Fatalf("Bulk Expected: is no error, but: was %v", err)
+		}
+		if _, err := c.IndexBulk("river", items); err != nil {
+			t.Fatalf("IndexBulk Expected: is no error, but: was %v", err)
+		}
+	}
+
+	expected := []string{"/_bulk", "/river/_bulk", "/es/_bulk", "/es/river/_bulk"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Paths Expected: is %v, but: was %v", expected, paths)
+	}
+}
+
+func TestBulkRequestVersion(t *testing.T) {
+	req := &BulkRequest{Action: ActionDelete, Index: "river", ID: "1", Version: 10}
+
+	tests := []struct {
+		Version int
+		Expect  string
+	}{
+		{6, `{"delete":{"_id":"1","_index":"river","_version":10,"_version_type":"external_gte"}}` + "\n"},
+		{7, `{"delete":{"_id":"1","_index":"river","version":10,"version_type":"external_gte"}}` + "\n"},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := req.bulk(&buf, test.Version); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.Expect {
+			t.Errorf("Version: %d, Expected: is %q, but: was %q", test.Version, test.Expect, buf.String())
+		}
+	}
+}
+
+func TestBulkRequestIfSeqNo(t *testing.T) {
+	req := &BulkRequest{Action: ActionDelete, Index: "river", ID: "1", IfSeqNo: 0, IfPrimaryTerm: 1,
+		Expected: map[string]interface{}{"title": "a"}}
+
+	var buf bytes.Buffer
+	if err := req.bulk(&buf, 7); err != nil {
+		t.Fatal(err)
+	}
+	expect := `{"delete":{"_id":"1","_index":"river","if_primary_term":1,"if_seq_no":0}}` + "\n"
+	if buf.String() != expect {
+		t.Errorf("Expected: is %q, but: was %q", expect, buf.String())
+	}
+}
+
+func TestDeleteByQuery(t *testing.T) {
+	var reqURI, body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		reqURI, body = r.URL.RequestURI(), string(data)
+		w.Write([]byte(`{"took":1,"deleted":2,"version_conflicts":1,"failures":[]}`))
+	}))
+	defer ts.Close()
+
+	c := NewClient(&ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://"), Version: 7})
+	query := map[string]interface{}{"term": map[string]interface{}{"parent_id": "1"}}
+	resp, err := c.DeleteByQuery(context.Background(), "river", "1", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != http.StatusOK || resp.Deleted != 2 || resp.VersionConflicts != 1 {
+		t.Errorf("Expected: is 2 deleted and 1 conflict, but: was %+v", resp)
+	}
+	if expected := "/river/_delete_by_query?conflicts=proceed&refresh=true&routing=1"; reqURI != expected {
+		t.Errorf("URL Expected: is %s, but: was %s", expected, reqURI)
+	}
+	if expected := `{"query":{"term":{"parent_id":"1"}}}`; body != expected {
+		t.Errorf("Body Expected: is %s, but: was %s", expected, body)
+	}
+
+	// it's not a bulk action
+	req := &BulkRequest{Action: ActionDeleteByQuery, Index: "river", ID: "1", Query: query}
+	if _, err = req.EncodedSize(7); err == nil {
+		t.Error("Bulk Expected: an error, but: was nil")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	var reqURI string
+	code := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqURI = r.Method + " " + r.URL.RequestURI()
+		w.WriteHeader(code)
+	}))
+	defer ts.Close()
+
+	c := NewClient(&ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://"), Version: 7})
+	if err := c.Refresh(context.Background(), "river"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "POST /river/_refresh"; reqURI != expected {
+		t.Errorf("Request Expected: is %s, but: was %s", expected, reqURI)
+	}
+
+	// the index is not created yet
+	code = http.StatusNotFound
+	if err := c.Refresh(context.Background(), "river"); err != nil {
+		t.Errorf("Expected: no error for the missing index, but: was %v", err)
+	}
+
+	code = http.StatusForbidden
+	if err := c.Refresh(context.Background(), "river"); err == nil {
+		t.Error("Expected: an error for forbidden, but: was nil")
+	}
+}
+
+func TestMultiGet(t *testing.T) {
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_mget" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"docs":[{"_index":"river","_id":"1","_seq_no":5,"_primary_term":2,"found":true,"_source":{"title":"a"}},` +
+			`{"_index":"river","_id":"2","found":false}]}`))
+	}))
+	defer ts.Close()
+
+	c := NewClient(&ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://"), Version: 7})
+	docs, err := c.MultiGet(context.Background(), []*MultiGetRequest{
+		{Index: "river", Type: "river", ID: "1", Routing: "r1", Source: []string{"title"}},
+		{Index: "river", ID: "2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `{"docs":[{"_id":"1","_index":"river","_source":["title"],"routing":"r1"},{"_id":"2","_index":"river"}]}`
+	if string(body) != expect {
+		t.Errorf("Body Expected: is %s, but: was %s", expect, body)
+	}
+	if len(docs) != 2 {
+		t.Fatalf("Expected: is 2 docs, but: was %d", len(docs))
+	}
+	if !docs[0].Found || docs[0].SeqNo != 5 || docs[0].PrimaryTerm != 2 || docs[0].Source["title"] != "a" {
+		t.Errorf("Expected: is the found doc with seq_no 5, but: was %+v", docs[0])
+	}
+	if docs[1].Found {
+		t.Errorf("Expected: is the missing doc, but: was %+v", docs[1])
+	}
+}
+
+func TestBulkGzip(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		var encoding string
+		var body []byte
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding = r.Header.Get("Content-Encoding")
+			if encoding == "gzip" {
+				gr, err := gzip.NewReader(r.Body)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				body, _ = ioutil.ReadAll(gr)
+			} else {
+				body, _ = ioutil.ReadAll(r.Body)
+			}
+			w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+		}))
+
+		c := NewClient(&ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://"), Gzip: compress})
+		resp, err := c.Bulk([]*BulkRequest{{Action: ActionDelete, Index: "river", Type: "river", ID: "1"}})
+		ts.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != http.StatusOK || (encoding == "gzip") != compress {
+			t.Errorf("Gzip: %t, Expected: is compressed %t, but: was code %d, encoding %q", compress, compress, resp.Code, encoding)
+		}
+
+		expect := `{"delete":{"_id":"1","_index":"river","_type":"river"}}` + "\n"
+		if string(body) != expect {
+			t.Errorf("Gzip: %t, Expected: is %q, but: was %q", compress, expect, body)
+		}
+	}
+}
+
+func TestBulkRequestPipeline(t *testing.T) {
+	tests := []struct {
+		Action string
+		Expect string
+	}{
+		{ActionIndex, `{"index":{"_id":"1","_index":"river","pipeline":"geoip"}}` + "\n" + `{"ip":"8.8.8.8"}` + "\n"},
+		{ActionDelete, `{"delete":{"_id":"1","_index":"river"}}` + "\n"},
+	}
+
+	for _, test := range tests {
+		req := &BulkRequest{Action: test.Action, Index: "river", ID: "1", Pipeline: "geoip",
+			Data: map[string]interface{}{"ip": "8.8.8.8"}}
+
+		var buf bytes.Buffer
+		if err := req.bulk(&buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.Expect {
+			t.Errorf("Action: %s, Expected: is %q, but: was %q", test.Action, test.Expect, buf.String())
+		}
+	}
+}
+
+func TestCreateIndex(t *testing.T) {
+	var created map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "HEAD" && r.URL.Path == "/exists":
+		case r.Method == "HEAD":
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == "PUT":
+			data, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(data, &created)
+			w.Write([]byte(`{"acknowledged":true}`))
+		}
+	}))
+	defer ts.Close()
+
+	c := NewClient(&ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://")})
+	for index, expect := range map[string]bool{"exists": true, "river": false} {
+		exists, err := c.IndexExists(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != expect {
+			t.Errorf("Index: %s, Expected: is %t, but: was %t", index, expect, exists)
+		}
+	}
+
+	body := map[string]interface{}{"mappings": map[string]interface{}{"properties": map[string]interface{}{}}}
+	if err := c.CreateIndex("river", body); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := created["mappings"]; !ok {
+		t.Errorf("Expected: is the mappings body, but: was %v", created)
+	}
+}
+
+func TestBulkFailover(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	downAddr := strings.TrimPrefix(down.URL, "http://")
+	down.Close()
+
+	var bulkNum int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bulkNum++
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	}))
+	defer ts.Close()
+	upAddr := strings.TrimPrefix(ts.URL, "http://")
+
+	c := NewClient(&ClientConfig{Addr: downAddr + ", " + upAddr})
+	if c.Addr != downAddr {
+		t.Errorf("Expected: is the first host %s, but: was %s", downAddr, c.Addr)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err := c.Bulk([]*BulkRequest{{Action: ActionDelete, Index: "river", Type: "river", ID: "1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != http.StatusOK {
+			t.Errorf("Code Expected: is %d, but: was %d", http.StatusOK, resp.Code)
+		}
+	}
+
+	// keep the failed over host
+	if bulkNum != 2 || c.currentAddr() != upAddr {
+		t.Errorf("Expected: is 2 bulks to %s, but: was %d to %s", upAddr, bulkNum, c.currentAddr())
+	}
+
+	// all hosts are down
+	c = NewClient(&ClientConfig{Addr: downAddr})
+	if _, err := c.Bulk([]*BulkRequest{{Action: ActionDelete, Index: "river", Type: "river", ID: "1"}}); err == nil {
+		t.Error("Expected: an error for the down host, but: was nil")
+	}
+}
+
+func TestBulkTimeoutAndCancel(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	items := []*BulkRequest{{Action: ActionDelete, Index: "river", Type: "river", ID: "1"}}
+
+	c := NewClient(&ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://"), Timeout: 50 * time.Millisecond})
+	if _, err := c.Bulk(items); err == nil {
+		t.Error("Expected: an error for the timeout, but: was nil")
+	}
+
+	c = NewClient(&ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://")})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	if _, err := c.BulkContext(ctx, items); err == nil {
+		t.Error("Expected: an error for the cancelled bulk, but: was nil")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Expected: is cancelled soon, but: was %s", d)
+	}
+}
@@ -9,5 +9,8 @@ require (
 	github.com/prometheus/client_golang v0.9.3
 	github.com/siddontang/go v0.0.0-20180604090527-bdc77568d726
 	github.com/siddontang/go-log v0.0.0-20190221022429-1e957dd83bed
-	github.com/siddontang/go-mysql v0.0.0-20190524062908-de6c3a84bcbe
+	github.com/siddontang/go-mysql v1.1.0
 )
+
+// go-mysql is released by go-mysql-org, v1.1.0 still has the siddontang module path
+replace github.com/siddontang/go-mysql => github.com/go-mysql-org/go-mysql v1.1.0
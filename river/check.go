@@ -0,0 +1,78 @@
+package river
+
+import (
+	"sort"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+)
+
+// CheckSummary is what Check validated.
+type CheckSummary struct {
+	// Tables are the db.table synced by the rules, sorted.
+	Tables []string
+	// Rules is the number of the rules, a table may have many rules.
+	Rules int
+	// ESChecked is whether ES is checked.
+	ESChecked bool
+}
+
+// Check validates the config like NewRiver without syncing anything: it gets the table
+// information from MySQL for every rule to check the columns and field mappings, checks
+// the binlog row image is FULL, and if checkES is set, checks ES is reachable with the
+// credentials and every rule index alias can be written. It doesn't load or save the
+// position, create the indices or serve the status, so it can run along a running river.
+func Check(c *Config, checkES bool) (*CheckSummary, error) {
+	if err := c.prepare(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// the binlog syncer can't be created without a server id, but it never connects
+	if c.ServerID == 0 {
+		c.ServerID = randomServerID()
+	}
+
+	r := new(River)
+	r.c = c
+	r.rules = make(map[string][]*Rule)
+
+	if err := r.newCanal(); err != nil {
+		return nil, errors.Annotatef(err, "connect to MySQL %s", c.MyAddr)
+	}
+	defer closeCanal(r.canal)
+
+	if err := r.prepareRule(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err := r.canal.CheckBinlogRowImage("FULL"); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	summary := new(CheckSummary)
+	for _, rules := range r.rules {
+		summary.Tables = append(summary.Tables, rules[0].Schema+"."+rules[0].Table)
+		summary.Rules += len(rules)
+	}
+	sort.Strings(summary.Tables)
+	log.Infof("checked %d rules for %d tables in MySQL %s", summary.Rules, len(summary.Tables), c.MyAddr)
+
+	if !checkES {
+		return summary, nil
+	}
+
+	var err error
+	if r.es, err = r.newESClient(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = r.pingES(0, 0); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = r.checkAliases(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	summary.ESChecked = true
+	log.Infof("checked ES %s", c.ESAddr)
+
+	return summary, nil
+}
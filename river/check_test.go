@@ -0,0 +1,12 @@
+package river
+
+import (
+	"testing"
+)
+
+func TestCheckInvalidConfig(t *testing.T) {
+	// the config is checked before connecting to MySQL
+	if _, err := Check(&Config{ESVersion: -1}, false); err == nil {
+		t.Error("Expected: an error for the invalid config, but: was nil")
+	}
+}
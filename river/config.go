@@ -1,11 +1,15 @@
 package river
 
 import (
+	"crypto/tls"
 	"io/ioutil"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
 )
 
 // SourceConfig is the configs for source
@@ -19,46 +23,248 @@ type Config struct {
 	MyAddr     string `toml:"my_addr"`
 	MyUser     string `toml:"my_user"`
 	MyPassword string `toml:"my_pass"`
-	MyCharset  string `toml:"my_charset"`
+
+	// MyCharset is the charset of the dump and binlog connections, utf8mb4 if not set,
+	// so the 4-byte characters like emoji are not mangled by the dump.
+	MyCharset string `toml:"my_charset"`
+
+	// MyTimeZone is the time zone of the MySQL server, like "Asia/Shanghai", the DATETIME
+	// values are in it. If set, the DATETIME values are converted to UTC, and the TIMESTAMP
+	// values, stored in UTC by MySQL, are kept in UTC by the binlog and the dump. Otherwise
+	// they are synced in the local time zone of the river.
+	MyTimeZone string `toml:"my_time_zone"`
+	timeLoc    *time.Location
+
+	// MyReconnectBackoff is the wait time before reconnecting to MySQL after the binlog
+	// sync fails, it doubles after every failure up to MyMaxReconnectBackoff.
+	MyReconnectBackoff    TomlDuration `toml:"my_reconnect_backoff"`
+	MyMaxReconnectBackoff TomlDuration `toml:"my_max_reconnect_backoff"`
+
+	// MyReadTimeout makes the binlog sync fail if no event is received for the time,
+	// so a dead connection is reconnected, 0 means no timeout. The heartbeat is
+	// requested at half of it to keep an idle connection alive.
+	MyReadTimeout TomlDuration `toml:"my_read_timeout"`
+
+	// MySSLCA, MySSLCert and MySSLKey are the PEM files to connect to MySQL with TLS,
+	// which is used by the binlog, the queries and mysqldump if any of them or
+	// MySSLSkipVerify is set. The client certificate and key are optional.
+	MySSLCA         string `toml:"my_ssl_ca"`
+	MySSLCert       string `toml:"my_ssl_cert"`
+	MySSLKey        string `toml:"my_ssl_key"`
+	MySSLSkipVerify bool   `toml:"my_ssl_skip_verify"`
+	myTLS           *tls.Config
 
 	ESHttps    bool   `toml:"es_https"`
-	ESAddr     string `toml:"es_addr"`
+	ESAddr     string `toml:"es_addr"` // the hosts separated by comma for failover
 	ESUser     string `toml:"es_user"`
 	ESPassword string `toml:"es_pass"`
 
+	// ESPathPrefix is prepended to the path of every ES request, like "/es" if ES is
+	// behind a proxy under a subpath.
+	ESPathPrefix string `toml:"es_path_prefix"`
+
+	// ESVersion is the ES major version, since ES 7 the bulk metadata omits
+	// the mapping type, and the parent is not supported.
+	ESVersion int `toml:"es_version"`
+
+	// ESTimeout is the timeout for every ES request, 0 uses the default 30s.
+	ESTimeout TomlDuration `toml:"es_timeout"`
+
+	// ESGzip compresses the bulk request body, ES must enable http.compression.
+	ESGzip bool `toml:"es_gzip"`
+
+	// ESHeaders are added to every ES request, and ESRequestIDHeader is set to
+	// a unique ID for every ES request, like X-Request-ID, for tracing by a proxy.
+	ESHeaders         map[string]string `toml:"es_headers"`
+	ESRequestIDHeader string            `toml:"es_request_id_header"`
+
+	// ESCACert is the PEM CA certificate file to verify the ES server for HTTPS,
+	// if empty, the system CA certificates are used.
+	ESCACert             string `toml:"es_ca_cert"`
+	ESInsecureSkipVerify bool   `toml:"es_insecure_skip_verify"`
+
+	// StatAddr serves the Prometheus metrics on StatPath, and the river
+	// status in JSON on /stat.
 	StatAddr string `toml:"stat_addr"`
 	StatPath string `toml:"stat_path"`
+	// StatAdmin also serves the admin endpoints on StatAddr, /resync and /refresh_table,
+	// which only accept POST and have no authentication.
+	StatAdmin bool `toml:"stat_admin"`
 
+	// ServerID is the replication server id of the river as a pseudo replica, it must be
+	// unique among the replicas and rivers of the MySQL source. A random one is used if 0.
 	ServerID uint32 `toml:"server_id"`
 	Flavor   string `toml:"flavor"`
 	DataDir  string `toml:"data_dir"`
 
+	// PositionStore is where to save the binlog position, "file" for the
+	// master.info file in DataDir, or "es" for a document in PositionIndex,
+	// which needs no local storage.
+	PositionStore string `toml:"position_store"`
+	PositionIndex string `toml:"position_index"`
+
+	// StartBinName and StartBinPos, or StartGTID, is where to sync the binlog from
+	// without the dump, only if no position is saved yet.
+	StartBinName string `toml:"start_bin_name"`
+	StartBinPos  uint32 `toml:"start_bin_pos"`
+	StartGTID    string `toml:"start_gtid"`
+
+	// GTIDMode saves the executed GTID set with the position, and syncs the binlog
+	// from the saved GTID set, so the river can follow a failover of MySQL.
+	GTIDMode bool `toml:"gtid_mode"`
+
+	// SavePositionInterval is the min interval to save the position, the events
+	// after the saved position are synced again after a crash.
+	SavePositionInterval TomlDuration `toml:"save_position_interval"`
+	// SavePositionDocs saves the position immediately once so many requests are
+	// sent to ES since the last save, 0 means only saving by the interval.
+	SavePositionDocs int `toml:"save_position_docs"`
+
+	// MaxSavePositionRetry is the max times to retry a failed position save, 0 means
+	// no retry. The retry waits SavePositionBackoff at first and doubles the wait time
+	// after every failure up to MaxSavePositionBackoff.
+	MaxSavePositionRetry   int          `toml:"max_save_position_retry"`
+	SavePositionBackoff    TomlDuration `toml:"save_position_backoff"`
+	MaxSavePositionBackoff TomlDuration `toml:"max_save_position_backoff"`
+	// ContinueOnSavePositionError keeps syncing if the position still can't be saved
+	// after the retries, and saves it again at the next save, otherwise the sync is closed.
+	ContinueOnSavePositionError bool `toml:"continue_on_save_position_error"`
+
 	DumpExec       string `toml:"mysqldump"`
 	SkipMasterData bool   `toml:"skip_master_data"`
+	// ResumableDump saves the tables done in the dump to DataDir, and only
+	// dumps the tables not done after a restart.
+	ResumableDump bool `toml:"resumable_dump"`
+	// DumpWorkers is the number of tables dumped at the same time, every table
+	// is dumped by a mysqldump process if more than 1.
+	DumpWorkers int `toml:"dump_workers"`
 
 	Sources []SourceConfig `toml:"source"`
 
 	Rules []*Rule `toml:"rule"`
 
+	// Include are the glob patterns of the files with more sources and rules, like
+	// "rules/*.toml", see include.
+	Include []string `toml:"include"`
+
+	// IndexPrefix and IndexSuffix are added to the index of all the rules, so one
+	// config can be used for several environments sharing an ES cluster.
+	IndexPrefix string `toml:"index_prefix"`
+	IndexSuffix string `toml:"index_suffix"`
+
+	// DenyTables are the db.table entries never synced even if matched by the rules.
+	DenyTables []string `toml:"deny_tables"`
+
+	// ExcludeColumnPatterns are the regular expressions of the column names never synced
+	// for all the rules, like the audit columns, a pattern must match the whole name.
+	// The columns of the doc id are still synced.
+	ExcludeColumnPatterns []string `toml:"exclude_column_patterns"`
+	excludeColumnRegexps  []*regexp.Regexp
+
 	BulkSize int `toml:"bulk_size"`
 
+	// BulkMaxBytes is the max bytes of a bulk request body before the compression,
+	// the bulk is sent once either BulkSize or BulkMaxBytes is reached, 0 means no limit.
+	// A request bigger than it is sent alone.
+	BulkMaxBytes int `toml:"bulk_max_bytes"`
+
+	// BulkWorkers is the number of goroutines sending the bulk requests concurrently,
+	// the requests of one document are always sent by the same worker in order.
+	BulkWorkers int `toml:"bulk_workers"`
+
+	// BulkDocsPerSecond limits the documents sent to ES per second to protect it,
+	// the sync waits if the limit is hit, 0 means no limit.
+	BulkDocsPerSecond int `toml:"bulk_docs_per_second"`
+
+	// SyncChanSize is the buffer size of the channel from the binlog reader to the sync loop,
+	// the reader blocks if it's full, 0 uses the default 4096.
+	SyncChanSize int `toml:"sync_chan_size"`
+
+	// FlushBulkTime is the interval to flush the pending requests even if there
+	// are less than BulkSize items. A shorter interval makes documents searchable
+	// sooner, a longer one builds bigger and more efficient bulk requests.
 	FlushBulkTime TomlDuration `toml:"flush_bulk_time"`
 
 	SkipNoPkTable bool `toml:"skip_no_pk_table"`
+
+	// ColumnMismatch is what to do with the rows whose column count still doesn't
+	// match the table after refreshing the table information, see columnMismatchError.
+	ColumnMismatch string `toml:"column_mismatch"`
+
+	// MaxBulkRetry is the max times to retry a failed bulk request before
+	// closing the sync, 0 means no retry. The retry waits BulkRetryBackoff
+	// at first and doubles the wait time after every failure.
+	MaxBulkRetry     int          `toml:"max_bulk_retry"`
+	BulkRetryBackoff TomlDuration `toml:"bulk_retry_backoff"`
+
+	// MaxBulkBackoff is the ceiling of the retry wait time. The bulk rejected by ES
+	// with 429 Too Many Requests is retried until it succeeds without counting
+	// in MaxBulkRetry, so the data is not lost when ES is overloaded.
+	MaxBulkBackoff TomlDuration `toml:"max_bulk_backoff"`
+
+	// StopOnBulkItemError closes the sync if any item in the bulk response failed,
+	// like a version conflict or a mapping error, otherwise the items are only logged.
+	StopOnBulkItemError bool `toml:"stop_on_bulk_item_error"`
+
+	// DeadLetterFile is the file to append the failed bulk items as JSON lines
+	// for replaying later, disabled if empty.
+	DeadLetterFile string `toml:"dead_letter_file"`
+
+	// DryRun logs the bulk requests instead of sending them to ES, but still saves
+	// the position, so use another data_dir for it.
+	DryRun bool `toml:"dry_run"`
 }
 
-// NewConfigWithFile creates a Config from file.
+// The behaviors for the rows not matching the table columns.
+const (
+	// columnMismatchError closes the sync, it's the default.
+	columnMismatchError = "error"
+	// columnMismatchSkip logs and skips the rows.
+	columnMismatchSkip = "skip"
+	// columnMismatchAdjust pads the missing columns with NULL and truncates the extra columns.
+	columnMismatchAdjust = "adjust"
+)
+
+const (
+	defaultBulkSize      = 128
+	defaultFlushBulkTime = 200 * time.Millisecond
+	defaultSyncChanSize  = 4096
+
+	defaultMyCharset             = "utf8mb4"
+	defaultMyReconnectBackoff    = time.Second
+	defaultMyMaxReconnectBackoff = time.Minute
+
+	defaultESTimeout        = 30 * time.Second
+	defaultBulkRetryBackoff = time.Second
+	defaultMaxBulkBackoff   = time.Minute
+
+	defaultStatPath = "/metrics"
+
+	defaultPositionIndex        = "mysql2es_position"
+	defaultSavePositionInterval = time.Second
+	defaultSavePositionBackoff  = time.Second
+
+	defaultMaxSavePositionBackoff = time.Minute
+)
+
+// NewConfigWithFile creates a Config from file, the relative include patterns are
+// relative to the directory of the file.
 func NewConfigWithFile(name string) (*Config, error) {
 	data, err := ioutil.ReadFile(name)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	return NewConfig(string(data))
+	return newConfig(string(data), name)
 }
 
-// NewConfig creates a Config from data.
+// NewConfig creates a Config from data, the relative include patterns are relative
+// to the working directory.
 func NewConfig(data string) (*Config, error) {
+	return newConfig(data, "")
+}
+
+func newConfig(data string, name string) (*Config, error) {
 	var c Config
 
 	_, err := toml.Decode(data, &c)
@@ -66,9 +272,206 @@ func NewConfig(data string) (*Config, error) {
 		return nil, errors.Trace(err)
 	}
 
+	if err = c.include(name); err != nil {
+		return nil, errors.Trace(err)
+	}
+
 	return &c, nil
 }
 
+// prepare fills the default values and checks the config.
+func (c *Config) prepare() error {
+	if c.BulkSize <= 0 {
+		c.BulkSize = defaultBulkSize
+	}
+
+	if c.BulkWorkers <= 0 {
+		c.BulkWorkers = 1
+	}
+
+	if c.SyncChanSize <= 0 {
+		c.SyncChanSize = defaultSyncChanSize
+	}
+
+	if c.DumpWorkers <= 0 {
+		c.DumpWorkers = 1
+	}
+
+	if c.FlushBulkTime.Duration == 0 {
+		c.FlushBulkTime.Duration = defaultFlushBulkTime
+	} else if c.FlushBulkTime.Duration < 0 {
+		return errors.Errorf("flush_bulk_time must be positive, but %s", c.FlushBulkTime.Duration)
+	}
+
+	if len(c.StatPath) == 0 {
+		c.StatPath = defaultStatPath
+	} else if c.StatPath == statPath {
+		return errors.Errorf("stat_path %s is reserved for the river status", statPath)
+	}
+
+	if len(c.MyCharset) == 0 {
+		c.MyCharset = defaultMyCharset
+	}
+
+	c.timeLoc = nil
+	if len(c.MyTimeZone) > 0 {
+		loc, err := time.LoadLocation(c.MyTimeZone)
+		if err != nil {
+			return errors.Annotatef(err, "invalid my_time_zone %s", c.MyTimeZone)
+		}
+		c.timeLoc = loc
+	}
+
+	if err := c.prepareMyTLS(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if c.MyReconnectBackoff.Duration == 0 {
+		c.MyReconnectBackoff.Duration = defaultMyReconnectBackoff
+	} else if c.MyReconnectBackoff.Duration < 0 {
+		return errors.Errorf("my_reconnect_backoff must be positive, but %s", c.MyReconnectBackoff.Duration)
+	}
+
+	if c.MyMaxReconnectBackoff.Duration == 0 {
+		c.MyMaxReconnectBackoff.Duration = defaultMyMaxReconnectBackoff
+	}
+	if c.MyMaxReconnectBackoff.Duration < c.MyReconnectBackoff.Duration {
+		return errors.Errorf("my_max_reconnect_backoff %s must not be less than my_reconnect_backoff %s",
+			c.MyMaxReconnectBackoff.Duration, c.MyReconnectBackoff.Duration)
+	}
+
+	if c.MyReadTimeout.Duration < 0 {
+		return errors.Errorf("my_read_timeout must not be negative, but %s", c.MyReadTimeout.Duration)
+	}
+
+	if c.ESTimeout.Duration == 0 {
+		c.ESTimeout.Duration = defaultESTimeout
+	} else if c.ESTimeout.Duration < 0 {
+		return errors.Errorf("es_timeout must be positive, but %s", c.ESTimeout.Duration)
+	}
+
+	switch c.PositionStore {
+	case "":
+		c.PositionStore = positionStoreFile
+	case positionStoreFile, positionStoreES:
+	default:
+		return errors.Errorf("position_store must be %s or %s, but %s", positionStoreFile, positionStoreES, c.PositionStore)
+	}
+	if c.PositionStore == positionStoreES {
+		if len(c.PositionIndex) == 0 {
+			c.PositionIndex = defaultPositionIndex
+		}
+		if c.DryRun {
+			return errors.Errorf("position_store %s writes ES, which is not allowed for dry_run", positionStoreES)
+		}
+		// the position doc id is the server id, a random one would lose the position
+		if c.ServerID == 0 {
+			return errors.Errorf("position_store %s needs server_id for the position doc id", positionStoreES)
+		}
+	}
+
+	for _, table := range c.DenyTables {
+		if seps := strings.Split(table, "."); len(seps) != 2 || len(seps[0]) == 0 || len(seps[1]) == 0 {
+			return errors.Errorf("deny_tables entry must be db.table, but %q", table)
+		}
+	}
+
+	c.excludeColumnRegexps = nil
+	for _, pattern := range c.ExcludeColumnPatterns {
+		reg, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return errors.Annotatef(err, "invalid exclude_column_patterns entry %q", pattern)
+		}
+		c.excludeColumnRegexps = append(c.excludeColumnRegexps, reg)
+	}
+
+	switch c.ColumnMismatch {
+	case "":
+		c.ColumnMismatch = columnMismatchError
+	case columnMismatchError, columnMismatchSkip, columnMismatchAdjust:
+	default:
+		return errors.Errorf("column_mismatch must be %s, %s or %s, but %s",
+			columnMismatchError, columnMismatchSkip, columnMismatchAdjust, c.ColumnMismatch)
+	}
+
+	if c.SavePositionInterval.Duration == 0 {
+		c.SavePositionInterval.Duration = defaultSavePositionInterval
+	} else if c.SavePositionInterval.Duration < 0 {
+		return errors.Errorf("save_position_interval must be positive, but %s", c.SavePositionInterval.Duration)
+	}
+
+	if (len(c.StartBinName) == 0) != (c.StartBinPos == 0) {
+		return errors.New("start_bin_name and start_bin_pos must be set together")
+	}
+	if len(c.StartBinName) > 0 && len(c.StartGTID) > 0 {
+		return errors.New("start_bin_name and start_gtid can't be set together")
+	}
+	if len(c.StartGTID) > 0 {
+		if _, err := mysql.ParseGTIDSet(c.gtidFlavor(), c.StartGTID); err != nil {
+			return errors.Annotatef(err, "invalid start_gtid %s", c.StartGTID)
+		}
+	}
+	if (len(c.StartBinName) > 0 || len(c.StartGTID) > 0) && (c.ResumableDump || c.DumpWorkers > 1) {
+		return errors.New("the start position skips the dump, so resumable_dump and dump_workers can't be set")
+	}
+
+	if c.ResumableDump && len(c.DataDir) == 0 {
+		return errors.New("resumable_dump needs data_dir to save the dumped tables")
+	}
+
+	if c.SavePositionDocs < 0 {
+		return errors.Errorf("save_position_docs must not be negative, but %d", c.SavePositionDocs)
+	}
+
+	if c.MaxSavePositionRetry < 0 {
+		return errors.Errorf("max_save_position_retry must not be negative, but %d", c.MaxSavePositionRetry)
+	}
+	if c.SavePositionBackoff.Duration == 0 {
+		c.SavePositionBackoff.Duration = defaultSavePositionBackoff
+	} else if c.SavePositionBackoff.Duration < 0 {
+		return errors.Errorf("save_position_backoff must be positive, but %s", c.SavePositionBackoff.Duration)
+	}
+	if c.MaxSavePositionBackoff.Duration == 0 {
+		c.MaxSavePositionBackoff.Duration = defaultMaxSavePositionBackoff
+	}
+	if c.MaxSavePositionBackoff.Duration < c.SavePositionBackoff.Duration {
+		return errors.Errorf("max_save_position_backoff %s must not be less than save_position_backoff %s",
+			c.MaxSavePositionBackoff.Duration, c.SavePositionBackoff.Duration)
+	}
+
+	if c.BulkMaxBytes < 0 {
+		return errors.Errorf("bulk_max_bytes must not be negative, but %d", c.BulkMaxBytes)
+	}
+
+	if c.BulkDocsPerSecond < 0 {
+		return errors.Errorf("bulk_docs_per_second must not be negative, but %d", c.BulkDocsPerSecond)
+	}
+
+	if c.ESVersion < 0 {
+		return errors.Errorf("es_version must not be negative, but %d", c.ESVersion)
+	}
+
+	if c.MaxBulkRetry < 0 {
+		return errors.Errorf("max_bulk_retry must not be negative, but %d", c.MaxBulkRetry)
+	}
+
+	if c.BulkRetryBackoff.Duration == 0 {
+		c.BulkRetryBackoff.Duration = defaultBulkRetryBackoff
+	} else if c.BulkRetryBackoff.Duration < 0 {
+		return errors.Errorf("bulk_retry_backoff must be positive, but %s", c.BulkRetryBackoff.Duration)
+	}
+
+	if c.MaxBulkBackoff.Duration == 0 {
+		c.MaxBulkBackoff.Duration = defaultMaxBulkBackoff
+	}
+	if c.MaxBulkBackoff.Duration < c.BulkRetryBackoff.Duration {
+		return errors.Errorf("max_bulk_backoff %s must not be less than bulk_retry_backoff %s",
+			c.MaxBulkBackoff.Duration, c.BulkRetryBackoff.Duration)
+	}
+
+	return nil
+}
+
 // TomlDuration supports time codec for TOML format.
 type TomlDuration struct {
 	time.Duration
@@ -80,3 +483,20 @@ func (d *TomlDuration) UnmarshalText(text []byte) error {
 	d.Duration, err = time.ParseDuration(string(text))
 	return err
 }
+
+// gtidFlavor returns the flavor to parse the GTID set, mysql if not set.
+func (c *Config) gtidFlavor() string {
+	if len(c.Flavor) == 0 {
+		return mysql.MySQLFlavor
+	}
+	return c.Flavor
+}
+
+// timeLocation returns the time zone of the DATETIME and TIMESTAMP values, local if
+// my_time_zone is not set, or the config is not loaded.
+func (c *Config) timeLocation() *time.Location {
+	if c == nil || c.timeLoc == nil {
+		return time.Local
+	}
+	return c.timeLoc
+}
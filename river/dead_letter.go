@@ -0,0 +1,109 @@
+package river
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+)
+
+// deadLetterEntry is a failed bulk request in the dead letter file, one JSON per line.
+// It has all the fields controlling the bulk action, so the request can be replayed.
+type deadLetterEntry struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	Index       string    `json:"index"`
+	Type        string    `json:"type,omitempty"`
+	ID          string    `json:"id"`
+	Parent      string    `json:"parent,omitempty"`
+	Routing     string    `json:"routing,omitempty"`
+	Pipeline    string    `json:"pipeline,omitempty"`
+	Upsert      bool      `json:"upsert,omitempty"`
+	Version     int64     `json:"version,omitempty"`
+	VersionType string    `json:"version_type,omitempty"`
+	// IfSeqNo may be 0, it's only set with IfPrimaryTerm
+	IfSeqNo       *int64                 `json:"if_seq_no,omitempty"`
+	IfPrimaryTerm int64                  `json:"if_primary_term,omitempty"`
+	Query         map[string]interface{} `json:"query,omitempty"`
+	Data          map[string]interface{} `json:"data,omitempty"`
+	Error         json.RawMessage        `json:"error,omitempty"`
+}
+
+// deadLetter appends the permanently failed bulk requests to a file for replaying later.
+type deadLetter struct {
+	sync.Mutex
+
+	filePath string
+}
+
+func newDeadLetter(filePath string) (*deadLetter, error) {
+	if len(filePath) == 0 {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &deadLetter{filePath: filePath}, nil
+}
+
+// write appends the requests with the ES item errors. The file is opened for every write,
+// so it can be rotated by moving it away.
+func (d *deadLetter) write(reqs []*elastic.BulkRequest, itemErrors []json.RawMessage) error {
+	if d == nil || len(reqs) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	n := time.Now()
+	for i, req := range reqs {
+		entry := deadLetterEntry{
+			Time:          n,
+			Action:        req.Action,
+			Index:         req.Index,
+			Type:          req.Type,
+			ID:            req.ID,
+			Parent:        req.Parent,
+			Routing:       req.Routing,
+			Pipeline:      req.Pipeline,
+			Upsert:        req.Upsert,
+			Version:       req.Version,
+			VersionType:   req.VersionType(),
+			IfPrimaryTerm: req.IfPrimaryTerm,
+			Query:         req.Query,
+			Data:          req.Data,
+			Error:         itemErrors[i],
+		}
+		if req.IfPrimaryTerm > 0 {
+			seqNo := req.IfSeqNo
+			entry.IfSeqNo = &seqNo
+		}
+		if err := e.Encode(entry); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	f, err := os.OpenFile(d.filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Errorf("open dead letter file %s err %v", d.filePath, err)
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		log.Errorf("write dead letter file %s err %v", d.filePath, err)
+	}
+
+	return errors.Trace(err)
+}
@@ -0,0 +1,129 @@
+package river
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+)
+
+func TestBulkDeadLetter(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"took":1,"errors":true,"items":[{"index":{"_index":"river","_type":"river","_id":"1","status":400,` +
+			`"error":{"type":"mapper_parsing_exception"}}}]}`))
+	})
+	defer closeFn()
+
+	dir, err := ioutil.TempDir("", "dead_letter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := path.Join(dir, "failed", "dead_letter.log")
+	if r.deadLetter, err = newDeadLetter(filePath); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = r.doBulk(r.ctx, testBulkRequests()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected: is 2 appended lines, but: was %q", data)
+	}
+
+	var entry deadLetterEntry
+	if err = json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Action != elastic.ActionIndex || entry.Index != "river" || entry.ID != "1" ||
+		entry.Data["title"] != "first" || string(entry.Error) != `{"type":"mapper_parsing_exception"}` {
+		t.Errorf("Expected: is the failed request, but: was %+v", entry)
+	}
+}
+
+func TestDeadLetterFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dead_letter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := path.Join(dir, "dead_letter.log")
+	d, err := newDeadLetter(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := []*elastic.BulkRequest{
+		{Action: elastic.ActionUpdate, Index: "river", ID: "1", Routing: "2", Upsert: true, Data: map[string]interface{}{"title": "a"}},
+		{Action: elastic.ActionDelete, Index: "river", ID: "2", Version: 3},
+		{Action: elastic.ActionDelete, Index: "river", ID: "3", IfSeqNo: 0, IfPrimaryTerm: 1},
+	}
+	errs := []json.RawMessage{json.RawMessage(`{}`), json.RawMessage(`{}`), json.RawMessage(`{}`)}
+	if err = d.write(reqs, errs); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`"action":"update","index":"river","id":"1","routing":"2","upsert":true,"data":{"title":"a"}`,
+		`"action":"delete","index":"river","id":"2","version":3,"version_type":"external_gte"`,
+		`"action":"delete","index":"river","id":"3","if_seq_no":0,"if_primary_term":1`,
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected: is %d lines, but: was %q", len(expected), data)
+	}
+	for i, line := range lines {
+		if !strings.Contains(line, expected[i]) {
+			t.Errorf("Line %d Expected: has %s, but: was %s", i, expected[i], line)
+		}
+	}
+}
+
+func TestBulkDeadLetterError(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"took":1,"errors":true,"items":[{"index":{"_index":"river","_type":"river","_id":"1","status":400,` +
+			`"error":{"type":"mapper_parsing_exception"}}}]}`))
+	})
+	defer closeFn()
+
+	dir, err := ioutil.TempDir("", "dead_letter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the file path is a directory, so it can't be written
+	if r.deadLetter, err = newDeadLetter(path.Join(dir, "dead_letter.log")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(path.Join(dir, "dead_letter.log"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.doBulk(r.ctx, testBulkRequests())
+	if errors.Cause(err) != errBulkItemFailed {
+		t.Errorf("Expected: is %v without stop_on_bulk_item_error, but: was %v", errBulkItemFailed, err)
+	}
+}
@@ -0,0 +1,97 @@
+package river
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+)
+
+// newDeleteByQueryRequest makes the delete by query of the docs with delete_by_query_field
+// set to the id of the deleted doc, which is sent after the delete by id of the doc. The
+// routing limits it to the shard, like the children routed by the parent id, otherwise all
+// the shards of the index are searched.
+func newDeleteByQueryRequest(req *elastic.BulkRequest, rule *Rule) *elastic.BulkRequest {
+	return &elastic.BulkRequest{
+		Action:  elastic.ActionDeleteByQuery,
+		Index:   req.Index,
+		Type:    req.Type,
+		ID:      req.ID,
+		Routing: req.Routing,
+		Query:   map[string]interface{}{"term": map[string]interface{}{rule.DeleteByQueryField: req.ID}},
+	}
+}
+
+// deleteByQueryWithRetry sends the delete by query, and retries it like the bulk if it
+// fails, at most max_bulk_retry times. Retrying is safe, the docs already deleted don't
+// match the query any more.
+func (r *River) deleteByQueryWithRetry(ctx context.Context, req *elastic.BulkRequest) error {
+	if r.c.DryRun {
+		query, _ := json.Marshal(req.Query)
+		log.Infof("[dry run] %s index: %s, id: %s, routing: %s, query: %s",
+			req.Action, req.Index, req.ID, req.Routing, query)
+		return nil
+	}
+
+	backoff := r.c.BulkRetryBackoff.Duration
+	for retry := 0; ; retry++ {
+		if err := r.limiter.wait(ctx, 1); err != nil {
+			return errors.Trace(err)
+		}
+
+		err := r.deleteByQuery(ctx, req)
+		if err == nil {
+			return nil
+		}
+		bulkErrorNum.Inc()
+		if retry >= r.c.MaxBulkRetry {
+			return errors.Trace(err)
+		}
+
+		log.Error(logMsg(logFields{"error": err, "index": req.Index, "id": req.ID, "retry": retry + 1, "backoff": backoff.String()},
+			"delete by query err %v, retry %d/%d after %s", err, retry+1, r.c.MaxBulkRetry, backoff))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return errors.Trace(err)
+		}
+		backoff *= 2
+		if backoff > r.c.MaxBulkBackoff.Duration {
+			backoff = r.c.MaxBulkBackoff.Duration
+		}
+	}
+}
+
+// deleteByQuery refreshes the index before the delete by query, which only sees the refreshed
+// docs, so the docs indexed by the bulks before it, maybe in the same flush, are deleted too.
+func (r *River) deleteByQuery(ctx context.Context, req *elastic.BulkRequest) error {
+	if err := r.es.Refresh(ctx, req.Index); err != nil {
+		return errors.Trace(err)
+	}
+
+	resp, err := r.es.DeleteByQuery(ctx, req.Index, req.Routing, req.Query)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// the index is not created yet, so there is nothing to delete
+	if resp.Code == http.StatusNotFound {
+		return nil
+	}
+	if resp.Code != http.StatusOK {
+		return errors.Errorf("ES delete by query error: %s, code: %d", http.StatusText(resp.Code), resp.Code)
+	}
+	if len(resp.Failures) > 0 {
+		return errors.Errorf("ES delete by query index: %s, id: %s failed, deleted %d docs, first failure: %s",
+			req.Index, req.ID, resp.Deleted, resp.Failures[0])
+	}
+
+	esDeleteByQueryNum.WithLabelValues(req.Index).Add(float64(resp.Deleted))
+	log.Debugf("delete by query index: %s, id: %s deleted %d docs, %d version conflicts",
+		req.Index, req.ID, resp.Deleted, resp.VersionConflicts)
+	return nil
+}
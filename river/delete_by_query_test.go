@@ -0,0 +1,74 @@
+package river
+
+import (
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+	"github.com/siddontang/go-mysql/canal"
+)
+
+func TestDeleteByQuery(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(256)")
+
+	var requests []string
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		requests = append(requests, req.URL.RequestURI()+" "+string(data))
+		if strings.HasSuffix(req.URL.Path, "/_delete_by_query") {
+			w.Write([]byte(`{"took":1,"deleted":3,"version_conflicts":0,"failures":[]}`))
+			return
+		}
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	})
+	defer closeFn()
+	r.c.BulkSize = 10
+
+	rule := newTestRule(ta)
+	rule.DeleteByQueryField = "parent_id"
+	rule.VersionColumn = "id"
+	if err := rule.prepare(); err == nil {
+		t.Error("Expected: an error for delete_by_query_field with version_column, but: was nil")
+	}
+	rule.VersionColumn = ""
+
+	reqs, err := r.makeRowsRequest(rule, canal.InsertAction, [][]interface{}{{2, "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletes, err := r.makeRowsRequest(rule, canal.DeleteAction, [][]interface{}{{1, "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the doc is deleted by id too
+	if len(deletes) != 2 || deletes[0].Action != elastic.ActionDelete || deletes[1].Action != elastic.ActionDeleteByQuery {
+		t.Fatalf("Expected: is %s and %s, but: was %+v", elastic.ActionDelete, elastic.ActionDeleteByQuery, deletes)
+	}
+
+	// the index is refreshed after the bulk, so the doc indexed in the same flush is deleted
+	if err = r.doBulk(r.ctx, coalesceRequests(append(reqs, deletes...))); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`/_bulk {"index":{"_id":"2","_index":"test_sync","_type":"test_sync"}}` + "\n" + `{"id":2,"title":"b"}` + "\n" +
+			`{"delete":{"_id":"1","_index":"test_sync","_type":"test_sync"}}` + "\n",
+		`/test_sync/_refresh `,
+		`/test_sync/_delete_by_query?conflicts=proceed&refresh=true {"query":{"term":{"parent_id":"1"}}}`,
+	}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("Expected: is %q, but: was %q", expected, requests)
+	}
+
+	// the delete by query is kept before the re-inserted doc
+	inserts, err := r.makeRowsRequest(rule, canal.InsertAction, [][]interface{}{{1, "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs = coalesceRequests(append(deletes, inserts...))
+	if len(reqs) != 2 || reqs[0].Action != elastic.ActionDeleteByQuery || reqs[1] != inserts[0] {
+		t.Errorf("Expected: is %s and the insert, but: was %+v", elastic.ActionDeleteByQuery, reqs)
+	}
+}
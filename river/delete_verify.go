@@ -0,0 +1,170 @@
+package river
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+)
+
+// setDeleteExpected sets the fields of delete_verify_fields the doc of the deleted row has,
+// they are made in the same way as indexing the row.
+func (r *River) setDeleteExpected(req *elastic.BulkRequest, rule *Rule, values []interface{}) {
+	if len(rule.DeleteVerifyFields) == 0 {
+		return
+	}
+
+	doc := new(elastic.BulkRequest)
+	r.makeInsertReqData(doc, rule, values)
+
+	req.Expected = make(map[string]interface{}, len(rule.DeleteVerifyFields))
+	for _, field := range rule.DeleteVerifyFields {
+		// the fields are in the doc nested under nest_under
+		key := field
+		if len(rule.NestUnder) > 0 {
+			key = rule.NestUnder + "." + field
+		}
+		req.Expected[key], _ = getDocField(doc.Data, field)
+	}
+}
+
+// isVerifiedDelete returns whether the request is a conditional delete of delete_verify_fields.
+func isVerifiedDelete(req *elastic.BulkRequest) bool {
+	return req.Action == elastic.ActionDelete && req.Expected != nil
+}
+
+// verifyDeletes gets the docs of the conditional deletes with only the expected fields.
+// The delete is sent with if_seq_no and if_primary_term if the doc still has the expected
+// fields, otherwise it's dropped, because the doc is not found or is newer than the
+// deleted row. doBulk sends the earlier requests of the same doc before, so the docs
+// got are not changed by the pending requests. The requests may be shared with the
+// subscribers, so the verified deletes are copies, the requests are never changed.
+func (r *River) verifyDeletes(ctx context.Context, reqs []*elastic.BulkRequest) ([]*elastic.BulkRequest, error) {
+	if r.c.DryRun {
+		return reqs, nil
+	}
+
+	var items []*elastic.MultiGetRequest
+	var verified []int
+	for i, req := range reqs {
+		if !isVerifiedDelete(req) || req.IfPrimaryTerm > 0 {
+			continue
+		}
+
+		fields := make([]string, 0, len(req.Expected))
+		for field := range req.Expected {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		items = append(items, &elastic.MultiGetRequest{Index: req.Index, Type: req.Type, ID: req.ID,
+			Routing: req.Routing, Source: fields})
+		verified = append(verified, i)
+	}
+	if len(items) == 0 {
+		return reqs, nil
+	}
+
+	docs, err := r.multiGetWithRetry(ctx, items)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// the verified delete of the request, nil if skipped
+	verifiedReqs := make(map[int]*elastic.BulkRequest, len(docs))
+	for j, doc := range docs {
+		req := reqs[verified[j]]
+		if !doc.Found || !matchDocFields(doc.Source, req.Expected) {
+			verifiedReqs[verified[j]] = nil
+			esDeleteVerifySkippedNum.WithLabelValues(req.Index).Inc()
+			log.Debugf("delete index: %s, type: %s, id: %s is skipped, the doc is not found or changed",
+				req.Index, req.Type, req.ID)
+			continue
+		}
+		verifiedReq := *req
+		verifiedReq.IfSeqNo, verifiedReq.IfPrimaryTerm = doc.SeqNo, doc.PrimaryTerm
+		verifiedReqs[verified[j]] = &verifiedReq
+	}
+
+	kept := make([]*elastic.BulkRequest, 0, len(reqs))
+	for i, req := range reqs {
+		if verifiedReq, ok := verifiedReqs[i]; ok {
+			req = verifiedReq
+		}
+		if req != nil {
+			kept = append(kept, req)
+		}
+	}
+	return kept, nil
+}
+
+// multiGetWithRetry retries the failed mget like the bulk, at most max_bulk_retry times.
+func (r *River) multiGetWithRetry(ctx context.Context, items []*elastic.MultiGetRequest) ([]elastic.ResponseItem, error) {
+	backoff := r.c.BulkRetryBackoff.Duration
+	for retry := 0; ; retry++ {
+		docs, err := r.es.MultiGet(ctx, items)
+		if err == nil {
+			return docs, nil
+		}
+		if retry >= r.c.MaxBulkRetry {
+			return nil, errors.Annotatef(err, "get %d docs to verify the deletes", len(items))
+		}
+
+		log.Error(logMsg(logFields{"error": err, "doc_count": len(items), "retry": retry + 1, "backoff": backoff.String()},
+			"get docs to verify the deletes err %v, retry %d/%d after %s", err, retry+1, r.c.MaxBulkRetry, backoff))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, errors.Trace(ctx.Err())
+		}
+		backoff *= 2
+		if backoff > r.c.MaxBulkBackoff.Duration {
+			backoff = r.c.MaxBulkBackoff.Duration
+		}
+	}
+}
+
+// matchDocFields returns whether the doc source has the expected fields, the values are
+// compared by JSON, so the numbers decoded as float64 match the integers.
+func matchDocFields(source map[string]interface{}, expected map[string]interface{}) bool {
+	for field, value := range expected {
+		got, _ := getDocField(source, field)
+		if !jsonEqual(got, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func jsonEqual(a interface{}, b interface{}) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(x, y)
+}
+
+// getDocField gets the value of the field, the field like "author.name" is in a nested object.
+func getDocField(data map[string]interface{}, field string) (interface{}, bool) {
+	names := strings.Split(field, ".")
+	for _, name := range names[:len(names)-1] {
+		child, ok := data[name].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		data = child
+	}
+
+	value, ok := data[names[len(names)-1]]
+	return value, ok
+}
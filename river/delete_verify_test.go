@@ -0,0 +1,117 @@
+package river
+
+import (
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/siddontang/go-mysql/canal"
+)
+
+func TestDeleteVerify(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(256)")
+
+	var bulkBodies []string
+	mgetBody := func() string {
+		return `{"docs":[{"_id":"1","_seq_no":7,"_primary_term":1,"found":true,"_source":{"title":"a"}},` +
+			`{"_id":"2","_seq_no":8,"_primary_term":1,"found":true,"_source":{"title":"newer"}},{"_id":"3","found":false}]}`
+	}
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/_mget" {
+			w.Write([]byte(mgetBody()))
+			return
+		}
+		data, _ := ioutil.ReadAll(req.Body)
+		bulkBodies = append(bulkBodies, string(data))
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	})
+	defer closeFn()
+	r.c.BulkSize = 10
+
+	rule := newTestRule(ta)
+	rule.DeleteVerifyFields = []string{"content"}
+	if err := rule.checkTable(); err == nil {
+		t.Error("Expected: an error for delete_verify_fields not synced, but: was nil")
+	}
+	rule.DeleteVerifyFields = []string{"title"}
+	if err := rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := r.makeRowsRequest(rule, canal.DeleteAction, [][]interface{}{{1, "a"}, {2, "b"}, {3, "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]interface{}{"title": "a"}; !reflect.DeepEqual(reqs[0].Expected, expected) {
+		t.Errorf("Expected: is %v, but: was %v", expected, reqs[0].Expected)
+	}
+
+	// a subscriber reads the published requests while they are sent
+	done := make(chan struct{})
+	var subscriberWg sync.WaitGroup
+	subscriberWg.Add(1)
+	go func() {
+		defer subscriberWg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				for _, req := range reqs {
+					_ = req.IfSeqNo + req.IfPrimaryTerm
+				}
+			}
+		}
+	}()
+
+	err = r.doBulk(r.ctx, reqs)
+	close(done)
+	subscriberWg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the unchanged doc is deleted, with its seq_no
+	expect := []string{`{"delete":{"_id":"1","_index":"test_sync","_type":"test_sync","if_primary_term":1,"if_seq_no":7}}` + "\n"}
+	if !reflect.DeepEqual(bulkBodies, expect) {
+		t.Errorf("Expected: is %q, but: was %q", expect, bulkBodies)
+	}
+	// the requests seen by the subscribers are not changed
+	if reqs[0].IfPrimaryTerm != 0 {
+		t.Errorf("IfPrimaryTerm Expected: is 0, but: was %d", reqs[0].IfPrimaryTerm)
+	}
+
+	// the row is updated then deleted in the same flush, the doc has the new title only
+	// after the update is sent
+	bulkBodies = nil
+	mgetBody = func() string {
+		title := "old"
+		if len(bulkBodies) > 0 {
+			title = "new"
+		}
+		return `{"docs":[{"_id":"4","_seq_no":9,"_primary_term":1,"found":true,"_source":{"title":"` + title + `"}}]}`
+	}
+	updateReqs, err := r.makeRowsRequest(rule, canal.UpdateAction, [][]interface{}{{4, "old"}, {4, "new"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteReqs, err := r.makeRowsRequest(rule, canal.DeleteAction, [][]interface{}{{4, "new"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs = coalesceRequests(append(updateReqs, deleteReqs...))
+	if len(reqs) != 2 {
+		t.Fatalf("Expected: the update is not coalesced, but: was %d requests", len(reqs))
+	}
+	if err = r.doBulk(r.ctx, reqs); err != nil {
+		t.Fatal(err)
+	}
+	expect = []string{
+		`{"update":{"_id":"4","_index":"test_sync","_type":"test_sync"}}` + "\n" + `{"doc":{"title":"new"}}` + "\n",
+		`{"delete":{"_id":"4","_index":"test_sync","_type":"test_sync","if_primary_term":1,"if_seq_no":9}}` + "\n",
+	}
+	if !reflect.DeepEqual(bulkBodies, expect) {
+		t.Errorf("Expected: is %q, but: was %q", expect, bulkBodies)
+	}
+}
@@ -0,0 +1,147 @@
+package river
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+)
+
+// dumpProgressInterval is the interval to log the dump progress.
+const dumpProgressInterval = 30 * time.Second
+
+// DumpStat is the progress of the initial mysqldump.
+type DumpStat struct {
+	// The number of rows dumped so far.
+	Rows int64 `json:"rows"`
+	// The estimated total rows from information_schema, which may be far from
+	// the real number for InnoDB.
+	TotalRows int64 `json:"total_rows"`
+	// The rough seconds left estimated by the dump speed, -1 if unknown.
+	ETASeconds int64 `json:"eta_seconds"`
+	Done       bool  `json:"done"`
+}
+
+// dumpProgress is updated atomically.
+type dumpProgress struct {
+	// 1 if the dump is started
+	started   int32
+	done      int32
+	startTime int64
+	rows      int64
+	totalRows int64
+}
+
+// needDump returns whether mysqldump runs before syncing the binlog.
+func (r *River) needDump() bool {
+	pos := r.master.Position()
+	return len(r.c.DumpExec) > 0 && (len(pos.Name) == 0 || pos.Pos == 0) && r.startGTID == nil
+}
+
+// watchDump logs the dump progress periodically until the dump is done.
+func (r *River) watchDump(done <-chan struct{}) {
+	defer r.wg.Done()
+
+	atomic.StoreInt64(&r.dump.startTime, time.Now().UnixNano())
+	atomic.StoreInt32(&r.dump.started, 1)
+
+	total, err := r.estimateDumpRows()
+	if err != nil {
+		log.Errorf("estimate the dump rows err %v, the dump ETA is unknown", err)
+	}
+	atomic.StoreInt64(&r.dump.totalRows, total)
+	log.Infof("start dumping about %d rows", total)
+
+	ticker := time.NewTicker(dumpProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s := r.dumpStat()
+			eta := "unknown"
+			if s.ETASeconds >= 0 {
+				eta = (time.Duration(s.ETASeconds) * time.Second).String()
+			}
+			log.Info(logMsg(logFields{"dump_rows": s.Rows, "dump_total_rows": s.TotalRows, "eta_seconds": s.ETASeconds},
+				"dumped %d of about %d rows, ETA %s", s.Rows, s.TotalRows, eta))
+		case <-done:
+			atomic.StoreInt32(&r.dump.done, 1)
+			log.Infof("dump done, %d rows in %s", atomic.LoadInt64(&r.dump.rows),
+				time.Since(time.Unix(0, atomic.LoadInt64(&r.dump.startTime))))
+			return
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// estimateDumpRows returns the estimated rows of the synced tables from information_schema.
+func (r *River) estimateDumpRows() (int64, error) {
+	tables := make(map[string][]string)
+	for _, rules := range r.rules {
+		rule := rules[0]
+		tables[rule.Schema] = append(tables[rule.Schema], rule.Table)
+	}
+
+	var total int64
+	for schema, names := range tables {
+		args := make([]interface{}, 0, len(names)+1)
+		args = append(args, schema)
+		for _, name := range names {
+			args = append(args, name)
+		}
+
+		res, err := r.canal.Execute("SELECT TABLE_ROWS FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_NAME IN (?"+
+			strings.Repeat(",?", len(names)-1)+")", args...)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+
+		for i := 0; i < res.Resultset.RowNumber(); i++ {
+			n, _ := res.GetInt(i, 0)
+			total += n
+		}
+	}
+
+	return total, nil
+}
+
+// dumpStat returns the dump progress, nil if the dump is not started.
+func (r *River) dumpStat() *DumpStat {
+	if atomic.LoadInt32(&r.dump.started) == 0 {
+		return nil
+	}
+
+	s := &DumpStat{
+		Rows:      atomic.LoadInt64(&r.dump.rows),
+		TotalRows: atomic.LoadInt64(&r.dump.totalRows),
+		Done:      atomic.LoadInt32(&r.dump.done) == 1,
+	}
+
+	elapsed := time.Since(time.Unix(0, atomic.LoadInt64(&r.dump.startTime)))
+	s.ETASeconds = int64(dumpETA(s.Rows, s.TotalRows, elapsed, s.Done) / time.Second)
+	if s.ETASeconds < 0 {
+		s.ETASeconds = -1
+	}
+
+	return s
+}
+
+// dumpETA estimates the time left by the dump speed so far, -1 if unknown.
+func dumpETA(rows int64, totalRows int64, elapsed time.Duration, done bool) time.Duration {
+	if done {
+		return 0
+	}
+	if rows == 0 || totalRows == 0 {
+		return -1
+	}
+	// the estimated total may be less than the real rows
+	if rows >= totalRows {
+		return 0
+	}
+
+	return time.Duration(float64(elapsed) / float64(rows) * float64(totalRows-rows))
+}
@@ -0,0 +1,44 @@
+package river
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDumpStat(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {})
+	defer closeFn()
+
+	if s := r.Stat(); s.Dump != nil {
+		t.Errorf("Expected: no dump stat before dumping, but: was %+v", s.Dump)
+	}
+
+	r.dump.started = 1
+	r.dump.startTime = time.Now().Add(-10 * time.Second).UnixNano()
+	r.dump.totalRows = 300
+	r.dump.rows = 100
+
+	s := r.Stat().Dump
+	// 100 rows in 10s, so 200 rows left need 20s
+	if s == nil || s.Rows != 100 || s.TotalRows != 300 || s.ETASeconds < 19 || s.ETASeconds > 21 || s.Done {
+		t.Errorf("Expected: is 100 of 300 rows with ETA 20s, but: was %+v", s)
+	}
+
+	tests := []struct {
+		rows      int64
+		totalRows int64
+		done      bool
+		expected  time.Duration
+	}{
+		{0, 300, false, -1},
+		{100, 0, false, -1},
+		{400, 300, false, 0},
+		{100, 300, true, 0},
+	}
+	for _, test := range tests {
+		if eta := dumpETA(test.rows, test.totalRows, 10*time.Second, test.done); eta != test.expected {
+			t.Errorf("%+v Expected: is %s, but: was %s", test, test.expected, eta)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package river
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go/ioutil2"
+)
+
+// dumpState is the progress of the resumable dump saved in dump.info of the data dir.
+type dumpState struct {
+	// The binlog position before the first dump, the binlog is synced from it after
+	// the dump, so the changes of the tables dumped before the restart are not lost.
+	StartName string `toml:"start_bin_name"`
+	StartPos  uint32 `toml:"start_bin_pos"`
+	// The executed GTID set before the first dump for gtid_mode.
+	StartGTID string `toml:"start_gtid,omitempty"`
+
+	// The tables whose rows are all sent to ES, by the rule keys.
+	DoneTables []string `toml:"done_tables"`
+
+	filePath string
+}
+
+func loadDumpState(dataDir string) (*dumpState, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	s := &dumpState{filePath: path.Join(dataDir, "dump.info")}
+
+	f, err := os.Open(s.filePath)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Trace(err)
+	} else if os.IsNotExist(errors.Cause(err)) {
+		return s, nil
+	}
+	defer f.Close()
+
+	_, err = toml.DecodeReader(f, s)
+	return s, errors.Trace(err)
+}
+
+func (s *dumpState) startPosition() mysql.Position {
+	return mysql.Position{Name: s.StartName, Pos: s.StartPos}
+}
+
+func (s *dumpState) save() error {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(s); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(ioutil2.WriteFileAtomic(s.filePath, buf.Bytes(), 0644))
+}
+
+func (s *dumpState) remove() error {
+	err := os.Remove(s.filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// dumpTablesDone is sent to the sync loop after the rows of the tables are sent,
+// so the tables are saved as done after the rows are in ES.
+type dumpTablesDone struct {
+	tables []string
+}
+
+// dumpFinished is sent to the sync loop after the dump to remove the dump state.
+type dumpFinished struct{}
+
+// dumpEventHandler handles the rows of the resumable dump, and marks the tables done.
+type dumpEventHandler struct {
+	eventHandler
+
+	// the rule key of the table being dumped
+	table string
+
+	// the tables are not marked done for the resync
+	resync bool
+}
+
+func (h *dumpEventHandler) OnRow(e *canal.RowsEvent) error {
+	key := ruleKey(e.Table.Schema, e.Table.Name)
+	// mysqldump dumps the tables one by one, so the last table is done
+	if key != h.table {
+		if err := h.tableDone(); err != nil {
+			return errors.Trace(err)
+		}
+		h.table = key
+	}
+
+	return h.eventHandler.OnRow(e)
+}
+
+func (h *dumpEventHandler) tableDone() error {
+	if len(h.table) == 0 || h.resync {
+		return nil
+	}
+
+	return h.r.sync(dumpTablesDone{[]string{h.table}})
+}
+
+// OnPosSynced does nothing, the position is saved after the dump by dumpTables.
+func (h *dumpEventHandler) OnPosSynced(pos mysql.Position, set mysql.GTIDSet, force bool) error {
+	return nil
+}
+
+func (h *dumpEventHandler) String() string {
+	return "ESRiverDumpEventHandler"
+}
+
+// dumpTables dumps the tables by dump_workers canals, skipping the tables done before
+// the restart for the resumable dump, and returns the position and the GTID set for
+// gtid_mode to sync the binlog from.
+//
+// The tables are not dumped in one snapshot, so the binlog is synced from the position
+// got before the dump, and the rows changed during the dump are synced again.
+func (r *River) dumpTables() (mysql.Position, mysql.GTIDSet, error) {
+	s := r.dumpState
+	if s == nil {
+		s = new(dumpState)
+	}
+
+	if len(s.StartName) == 0 {
+		pos, err := r.canal.GetMasterPos()
+		if err != nil {
+			return pos, nil, errors.Trace(err)
+		}
+		s.StartName, s.StartPos = pos.Name, pos.Pos
+		if r.c.GTIDMode {
+			gset, err := r.canal.GetMasterGTIDSet()
+			if err != nil {
+				return pos, nil, errors.Trace(err)
+			}
+			s.StartGTID = gset.String()
+		}
+		if r.dumpState != nil {
+			if err = s.save(); err != nil {
+				return pos, nil, errors.Trace(err)
+			}
+		}
+	} else {
+		log.Infof("resume the dump started at %s, %d tables are done", s.startPosition(), len(s.DoneTables))
+	}
+
+	var tables []*Rule
+	for key, rules := range r.rules {
+		if !containsString(s.DoneTables, key) {
+			tables = append(tables, rules[0])
+		}
+	}
+
+	pos := s.startPosition()
+	var gset mysql.GTIDSet
+	// sync from the position if no transaction is executed yet, or the canal dumps again
+	if r.c.GTIDMode && len(s.StartGTID) > 0 {
+		var err error
+		if gset, err = mysql.ParseGTIDSet(r.c.gtidFlavor(), s.StartGTID); err != nil {
+			return pos, nil, errors.Trace(err)
+		}
+	}
+
+	if len(tables) > 0 {
+		var err error
+		if r.c.DumpWorkers > 1 {
+			err = r.dumpParallel(tables)
+		} else {
+			err = r.dumpRules(tables, true, false)
+		}
+		if err != nil {
+			return pos, gset, errors.Trace(err)
+		}
+	}
+
+	// the dump state is removed after the position is saved
+	if err := r.sync(posSaver{pos, true, gset}); err != nil {
+		return pos, gset, errors.Trace(err)
+	}
+	return pos, gset, errors.Trace(r.sync(dumpFinished{}))
+}
+
+// dumpRules dumps the tables of the rules by one canal. The progress is watched
+// only for the initial dump, and not for the parallel dump or the resync.
+func (r *River) dumpRules(rules []*Rule, watch bool, resync bool) error {
+	c, err := r.newDumpCanal(rules)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer closeCanal(c)
+
+	h := &dumpEventHandler{eventHandler: eventHandler{r}, resync: resync}
+	c.SetEventHandler(h)
+
+	if watch && r.addWorker(1) == nil {
+		go r.watchDump(c.WaitDumpDone())
+	}
+
+	if err = c.Dump(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(h.tableDone())
+}
+
+// dumpParallel dumps every table by a canal, at most dump_workers tables at the same time.
+func (r *River) dumpParallel(rules []*Rule) error {
+	done := make(chan struct{})
+	if r.addWorker(1) == nil {
+		go r.watchDump(done)
+	}
+	defer close(done)
+
+	ch := make(chan *Rule)
+	errCh := make(chan error, r.c.DumpWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < r.c.DumpWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rule := range ch {
+				if err := r.dumpRules([]*Rule{rule}, false, false); err != nil {
+					errCh <- errors.Annotatef(err, "dump %s.%s", rule.Schema, rule.Table)
+					return
+				}
+			}
+		}()
+	}
+
+	var err error
+loop:
+	for _, rule := range rules {
+		select {
+		case ch <- rule:
+		case err = <-errCh:
+			break loop
+		}
+	}
+	close(ch)
+	wg.Wait()
+
+	if err == nil {
+		select {
+		case err = <-errCh:
+		default:
+		}
+	}
+	return errors.Trace(err)
+}
+
+// newDumpCanal creates a canal only to dump the tables of the rules.
+func (r *River) newDumpCanal(rules []*Rule) (*canal.Canal, error) {
+	cfg := r.newCanalConfig()
+	cfg.IncludeTableRegex = nil
+
+	dbs := make(map[string][]string)
+	for _, rule := range rules {
+		cfg.IncludeTableRegex = append(cfg.IncludeTableRegex, regexp.QuoteMeta(rule.Schema)+"\\."+regexp.QuoteMeta(rule.Table))
+		dbs[rule.Schema] = append(dbs[rule.Schema], rule.Table)
+	}
+
+	for db, tables := range dbs {
+		if len(dbs) == 1 {
+			cfg.Dump.TableDB = db
+			cfg.Dump.Tables = tables
+		} else {
+			// the tables not included are skipped when parsing the dump
+			cfg.Dump.Databases = append(cfg.Dump.Databases, db)
+		}
+	}
+
+	if len(dbs) > 1 {
+		for _, key := range r.dumpState.DoneTables {
+			if rules, ok := r.rules[key]; ok {
+				cfg.Dump.IgnoreTables = append(cfg.Dump.IgnoreTables, rules[0].Schema+","+rules[0].Table)
+			}
+		}
+	}
+
+	// the binlog position is got before the dump
+	cfg.Dump.SkipMasterData = true
+
+	c, err := canal.NewCanal(cfg)
+	return c, errors.Trace(err)
+}
@@ -0,0 +1,57 @@
+package river
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSyncLoopDumpState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "river")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	})
+	defer closeFn()
+
+	s, err := loadDumpState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.StartName, s.StartPos = "mysql-bin.000001", 4
+	if err = s.save(); err != nil {
+		t.Fatal(err)
+	}
+	r.dumpState = s
+
+	r.wg.Add(1)
+	go r.syncLoop()
+
+	r.syncCh <- testBulkRequests()
+	r.syncCh <- dumpTablesDone{[]string{ruleKey("test", "river")}}
+	time.Sleep(50 * time.Millisecond)
+
+	loaded, err := loadDumpState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos := loaded.startPosition(); pos != s.startPosition() {
+		t.Errorf("Start Expected: is %s, but: was %s", s.startPosition(), pos)
+	}
+	if len(loaded.DoneTables) != 1 || loaded.DoneTables[0] != "test:river" {
+		t.Errorf("DoneTables Expected: is [test:river], but: was %v", loaded.DoneTables)
+	}
+
+	r.syncCh <- dumpFinished{}
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err = os.Stat(s.filePath); !os.IsNotExist(err) {
+		t.Errorf("Dump State Expected: is removed, but: was %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package river
+
+import (
+	"reflect"
+	"sync/atomic"
+
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+)
+
+// makeHistoryRequest makes the history doc of the updated row for history_index, nil if
+// no synced column is changed. The changed columns are the ones of the partial update,
+// and the values are made like the doc fields, e.g, masked. The history doc has no id,
+// so ES generates one, and a replayed update adds another history doc.
+func (r *River) makeHistoryRequest(rule *Rule, id string, beforeValues []interface{}, afterValues []interface{}) *elastic.BulkRequest {
+	var columns []string
+	changes := make(map[string]interface{})
+	for i, c := range rule.TableInfo.Columns {
+		if !rule.CheckFilter(c.Name) || reflect.DeepEqual(beforeValues[i], afterValues[i]) {
+			continue
+		}
+
+		columns = append(columns, c.Name)
+		// keyed by the column, so every column has its own mapping for the values
+		changes[c.Name] = map[string]interface{}{
+			"old": r.makeFieldData(rule, &c, "", beforeValues[i]),
+			"new": r.makeFieldData(rule, &c, "", afterValues[i]),
+		}
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+
+	data := map[string]interface{}{
+		"id":      id,
+		"schema":  rule.Schema,
+		"table":   rule.Table,
+		"columns": columns,
+		"changes": changes,
+	}
+	// the rows are made right after the event time is stored, the dump has no update
+	if ts := atomic.LoadInt64(&r.lastEventTime); ts > 0 {
+		data["timestamp"] = ts
+	}
+
+	esHistoryNum.WithLabelValues(rule.HistoryIndex).Inc()
+	return &elastic.BulkRequest{Action: elastic.ActionIndex, Index: rule.HistoryIndex, Type: rule.Type, Data: data}
+}
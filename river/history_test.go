@@ -0,0 +1,75 @@
+package river
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+	"github.com/siddontang/go-mysql/canal"
+)
+
+func TestHistoryIndex(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(256)", "content", "varchar(256)")
+
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {})
+	defer closeFn()
+	r.lastEventTime = 1600000000
+
+	rule := newTestRule(ta)
+	rule.HistoryIndex = "TEST_SYNC"
+	if err := rule.prepare(); err == nil {
+		t.Error("Expected: an error for history_index same as the index, but: was nil")
+	}
+	rule.HistoryIndex = "test_history"
+	rule.Filter = []string{"id", "title"}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := r.makeRowsRequest(rule, canal.UpdateAction, [][]interface{}{{1, "a", "x"}, {1, "b", "y"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("Expected: is the update and the history, but: was %d requests", len(reqs))
+	}
+
+	history := reqs[1]
+	expected := map[string]interface{}{
+		"id":        "1",
+		"schema":    rule.Schema,
+		"table":     rule.Table,
+		"columns":   []string{"title"},
+		"changes":   map[string]interface{}{"title": map[string]interface{}{"old": "a", "new": "b"}},
+		"timestamp": int64(1600000000),
+	}
+	if history.Action != elastic.ActionIndex || history.Index != "test_history" || len(history.ID) > 0 {
+		t.Errorf("Expected: is an index request without id to test_history, but: was %s %s %q", history.Action, history.Index, history.ID)
+	}
+	if !reflect.DeepEqual(history.Data, expected) {
+		t.Errorf("Expected: is %v, but: was %v", expected, history.Data)
+	}
+	if reqs[0].Action != elastic.ActionUpdate || reqs[0].Index != "test_sync" {
+		t.Errorf("Expected: is the update to test_sync, but: was %s %s", reqs[0].Action, reqs[0].Index)
+	}
+
+	// only the filtered out column is changed
+	if reqs, err = r.makeRowsRequest(rule, canal.UpdateAction, [][]interface{}{{1, "b", "y"}, {1, "b", "z"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 0 {
+		t.Errorf("Expected: is no request, but: was %d", len(reqs))
+	}
+
+	// the update skipped by the transformer has no history
+	r.SetDocumentTransformer(DocumentTransformerFunc(func(rule *Rule, action string, values []interface{}, data map[string]interface{}) (map[string]interface{}, error) {
+		return nil, ErrSkipDocument
+	}))
+	if reqs, err = r.makeRowsRequest(rule, canal.UpdateAction, [][]interface{}{{1, "b", "y"}, {1, "c", "y"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 0 {
+		t.Errorf("Expected: is no request for the skipped update, but: was %d", len(reqs))
+	}
+}
@@ -0,0 +1,130 @@
+package river
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/juju/errors"
+)
+
+// includedConfig is the content of an included file, only the sources and rules.
+type includedConfig struct {
+	Sources []SourceConfig `toml:"source"`
+	Rules   []*Rule        `toml:"rule"`
+}
+
+// include merges the sources and rules of the files matching the include patterns
+// into the config loaded from the file name, empty if not from a file. The files are
+// merged in order, and the files matched by the patterns are sorted by name, a file
+// matched again is merged once. It returns an error if a table of the sources, or a
+// rule with the same table, index and type is in more than one file.
+func (c *Config) include(name string) error {
+	if len(c.Include) == 0 {
+		return nil
+	}
+
+	dir := ""
+	if len(name) > 0 {
+		dir = filepath.Dir(name)
+	} else {
+		name = "the config"
+	}
+
+	m := newConfigMerger()
+	m.addSources(name, c.Sources)
+	m.addRules(name, c.Rules)
+
+	included := make(map[string]struct{})
+	for _, pattern := range c.Include {
+		if !filepath.IsAbs(pattern) && len(dir) > 0 {
+			pattern = filepath.Join(dir, pattern)
+		}
+
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return errors.Annotatef(err, "invalid include %s", pattern)
+		}
+
+		for _, file := range files {
+			if _, ok := included[file]; ok {
+				continue
+			}
+			included[file] = struct{}{}
+
+			var ic includedConfig
+			md, err := toml.DecodeFile(file, &ic)
+			if err != nil {
+				return errors.Annotatef(err, "include %s", file)
+			}
+			for _, key := range md.Keys() {
+				if len(key) == 1 && key[0] != "source" && key[0] != "rule" {
+					return errors.Errorf("include %s can only have source and rule, but %s", file, key[0])
+				}
+			}
+
+			if err = m.addSources(file, ic.Sources); err != nil {
+				return errors.Trace(err)
+			}
+			if err = m.addRules(file, ic.Rules); err != nil {
+				return errors.Trace(err)
+			}
+			c.Sources = append(c.Sources, ic.Sources...)
+			c.Rules = append(c.Rules, ic.Rules...)
+		}
+	}
+
+	return nil
+}
+
+// configMerger records the file of every source table and rule to find the conflicts.
+// The duplicates in the same file are left to be checked like a single file config.
+type configMerger struct {
+	tables map[string]string
+	rules  map[string]string
+}
+
+func newConfigMerger() *configMerger {
+	return &configMerger{tables: make(map[string]string), rules: make(map[string]string)}
+}
+
+func (m *configMerger) addSources(file string, sources []SourceConfig) error {
+	for _, s := range sources {
+		for _, table := range s.Tables {
+			key := ruleKey(s.Schema, table)
+			if err := m.add(m.tables, key, file); err != nil {
+				return errors.Annotatef(err, "source table %s.%s", s.Schema, table)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *configMerger) addRules(file string, rules []*Rule) error {
+	for _, rule := range rules {
+		// the same defaults as Rule.prepare
+		index := rule.Index
+		if len(index) == 0 {
+			index = rule.Table
+		}
+		docType := rule.Type
+		if len(docType) == 0 {
+			docType = index
+		}
+
+		key := fmt.Sprintf("%s/%s/%s", ruleKey(rule.Schema, rule.Table), strings.ToLower(index), docType)
+		if err := m.add(m.rules, key, file); err != nil {
+			return errors.Annotatef(err, "rule %s.%s to index %s, type %s", rule.Schema, rule.Table, index, docType)
+		}
+	}
+	return nil
+}
+
+func (m *configMerger) add(files map[string]string, key string, file string) error {
+	if f, ok := files[key]; ok && f != file {
+		return errors.Errorf("is in both %s and %s", f, file)
+	}
+	files[key] = file
+	return nil
+}
@@ -0,0 +1,106 @@
+package river
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestConfigInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "river_include")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string, data string) {
+		if err := os.MkdirAll(path.Dir(path.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("river.toml", `
+bulk_size = 10
+include = ["rules/*.toml"]
+
+[[source]]
+schema = "test"
+tables = ["t1"]
+
+[[rule]]
+schema = "test"
+table = "t1"
+`)
+	write("rules/a.toml", `
+[[source]]
+schema = "test"
+tables = ["t2"]
+
+[[rule]]
+schema = "test"
+table = "t2"
+
+[[rule]]
+schema = "test"
+table = "t1"
+index = "t1_copy"
+`)
+	write("rules/b.toml", `
+[[source]]
+schema = "test"
+tables = ["t3"]
+
+[[rule]]
+schema = "test"
+table = "t3"
+`)
+
+	cfg, err := NewConfigWithFile(path.Join(dir, "river.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for _, rule := range cfg.Rules {
+		tables = append(tables, rule.Table+"/"+rule.Index)
+	}
+	expect := []string{"t1/", "t2/", "t1/t1_copy", "t3/"}
+	if !reflect.DeepEqual(tables, expect) {
+		t.Errorf("Rules Expected: is %v, but: was %v", expect, tables)
+	}
+	if len(cfg.Sources) != 3 || cfg.BulkSize != 10 {
+		t.Errorf("Expected: is 3 sources and bulk_size 10, but: was %v, %d", cfg.Sources, cfg.BulkSize)
+	}
+
+	// the same table in two files
+	write("rules/c.toml", `
+[[source]]
+schema = "test"
+tables = ["t3"]
+`)
+	if _, err = NewConfigWithFile(path.Join(dir, "river.toml")); err == nil {
+		t.Error("Expected: an error for the duplicate source table, but: was nil")
+	}
+
+	// the same index and type by default
+	write("rules/c.toml", `
+[[rule]]
+schema = "test"
+table = "t2"
+index = "t2"
+`)
+	if _, err = NewConfigWithFile(path.Join(dir, "river.toml")); err == nil {
+		t.Error("Expected: an error for the duplicate rule, but: was nil")
+	}
+
+	write("rules/c.toml", `
+bulk_size = 20
+`)
+	if _, err = NewConfigWithFile(path.Join(dir, "river.toml")); err == nil {
+		t.Error("Expected: an error for the option in the included file, but: was nil")
+	}
+}
@@ -0,0 +1,160 @@
+package river
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+)
+
+// jsonPathField is the parsed json_path for the ES field.
+type jsonPathField struct {
+	field  string
+	column string
+	path   string
+	steps  []jsonPathStep
+}
+
+// jsonPathStep is a member key, or an array index if key is empty.
+type jsonPathStep struct {
+	key   string
+	index int
+}
+
+// parseJSONPaths parses the json_path of the rule, like country = "metadata.$.address.country",
+// the column is before "$", the path is a MySQL JSON path with the member keys, the quoted
+// member keys like ."first name", and the array indexes like [0].
+func parseJSONPaths(paths map[string]string) ([]jsonPathField, error) {
+	fields := make([]string, 0, len(paths))
+	for field := range paths {
+		fields = append(fields, field)
+	}
+	// set the fields in a stable order
+	sort.Strings(fields)
+
+	jsonPaths := make([]jsonPathField, 0, len(fields))
+	for _, field := range fields {
+		v := paths[field]
+		n := strings.Index(v, "$")
+		if n <= 0 || len(field) == 0 {
+			return nil, errors.Errorf("json_path %s must be like column.$.key, but %q", field, v)
+		}
+
+		steps, err := parseJSONPath(v[n:])
+		if err != nil {
+			return nil, errors.Annotatef(err, "json_path %s", field)
+		}
+		jsonPaths = append(jsonPaths, jsonPathField{field: field, column: strings.TrimSuffix(v[:n], "."),
+			path: v[n:], steps: steps})
+	}
+	return jsonPaths, nil
+}
+
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	var steps []jsonPathStep
+	// skip the "$"
+	for i := 1; i < len(path); {
+		switch path[i] {
+		case '.':
+			i++
+			if i < len(path) && path[i] == '"' {
+				end := strings.IndexByte(path[i+1:], '"')
+				if end <= 0 {
+					return nil, errors.Errorf("invalid path %s, the quoted key is not closed or empty", path)
+				}
+				steps = append(steps, jsonPathStep{key: path[i+1 : i+1+end]})
+				i += end + 2
+				continue
+			}
+
+			end := i
+			for end < len(path) && path[end] != '.' && path[end] != '[' {
+				end++
+			}
+			if end == i {
+				return nil, errors.Errorf("invalid path %s, the key is empty", path)
+			}
+			steps = append(steps, jsonPathStep{key: path[i:end]})
+			i = end
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, errors.Errorf("invalid path %s, the index is not closed", path)
+			}
+			index, err := strconv.Atoi(path[i+1 : i+end])
+			if err != nil || index < 0 {
+				return nil, errors.Errorf("invalid path %s, the index must be a non-negative integer", path)
+			}
+			steps = append(steps, jsonPathStep{index: index})
+			i += end + 1
+		default:
+			return nil, errors.Errorf("invalid path %s at %d", path, i)
+		}
+	}
+	return steps, nil
+}
+
+// extract returns the value at the path, false if not found.
+func (p *jsonPathField) extract(value interface{}) (interface{}, bool) {
+	for _, step := range p.steps {
+		if len(step.key) > 0 {
+			m, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if value, ok = m[step.key]; !ok {
+				return nil, false
+			}
+			continue
+		}
+
+		a, ok := value.([]interface{})
+		if !ok || step.index >= len(a) {
+			return nil, false
+		}
+		value = a[step.index]
+	}
+	return value, true
+}
+
+// makeJSONPathData sets the json_path fields extracted from the JSON columns. The field is
+// NULL if the column is NULL or the path is not found, and is skipped if the column is
+// not a valid JSON. For update, only the fields of the changed columns are set.
+func (r *River) makeJSONPathData(req *elastic.BulkRequest, rule *Rule, values []interface{}, beforeValues []interface{}) {
+	for i := range rule.jsonPaths {
+		p := &rule.jsonPaths[i]
+		index := rule.TableInfo.FindColumn(p.column)
+		if beforeValues != nil && reflect.DeepEqual(beforeValues[index], values[index]) {
+			continue
+		}
+		if values[index] == nil {
+			r.setReqData(req, rule, p.field, nil)
+			continue
+		}
+
+		var data []byte
+		switch v := values[index].(type) {
+		case []byte:
+			data = v
+		case string:
+			data = []byte(v)
+		}
+
+		var doc interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			log.Warnf("invalid JSON value of column %s for json_path %s, err %v, skip it", p.column, p.field, err)
+			continue
+		}
+
+		value, ok := p.extract(doc)
+		if !ok {
+			log.Debugf("json_path %s of column %s is not found for field %s", p.path, p.column, p.field)
+		}
+		r.setReqData(req, rule, p.field, value)
+	}
+}
@@ -0,0 +1,64 @@
+package river
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMakeRequestJSONPath(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "metadata", "json", "title", "varchar(256)")
+
+	r := new(River)
+	r.c = &Config{ColumnMismatch: columnMismatchError}
+	rule := newTestRule(ta)
+	for _, path := range []string{"$.country", "metadata.country", "metadata.$.", "metadata.$[a]", `metadata.$."a`, "metadata.$a"} {
+		rule.JSONPaths = map[string]string{"country": path}
+		if err := rule.prepare(); err == nil {
+			t.Errorf("Expected: an error for the invalid path %s, but: was nil", path)
+		}
+	}
+
+	rule.JSONPaths = map[string]string{
+		"country": "metadata.$.address.country",
+		"first":   `metadata.$."first tag"[0]`,
+		"missing": "metadata.$.address.zip",
+	}
+	// the whole JSON is not synced
+	rule.Filter = []string{"id", "title"}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := `{"address":{"country":"NZ"},"first tag":["a","b"]}`
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{1, []byte(metadata), "t"}, {2, "not json", "t"}, {3, nil, "t"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []map[string]interface{}{
+		{"id": int64(1), "title": "t", "country": "NZ", "first": "a", "missing": nil},
+		{"id": int64(2), "title": "t"},
+		{"id": int64(3), "title": "t", "country": nil, "first": nil, "missing": nil},
+	}
+	for i, req := range reqs {
+		if !reflect.DeepEqual(req.Data, expected[i]) {
+			t.Errorf("Insert %d Expected: is %v, but: was %v", i, expected[i], req.Data)
+		}
+	}
+
+	// only the JSON column is changed, the update is not skipped
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{1, metadata, "t"}, {1, `{"address":{"country":"AU"}}`, "t"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]interface{}{"country": "AU", "first": nil, "missing": nil}; len(reqs) != 1 || !reflect.DeepEqual(reqs[0].Data, expected) {
+		t.Errorf("Update Expected: is %v, but: was %+v", expected, reqs)
+	}
+
+	rule.Mask = map[string]string{"metadata": maskNull}
+	if err = rule.checkTable(); err == nil {
+		t.Error("Expected: an error for json_path of the masked column, but: was nil")
+	}
+}
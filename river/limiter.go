@@ -0,0 +1,56 @@
+package river
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the documents sent to ES per second. The first request is
+// sent at once, and the following ones wait to keep the rate.
+type rateLimiter struct {
+	sync.Mutex
+
+	// documents per second, 0 means no limit
+	rate int
+	// the time to send the next request
+	next time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+func (l *rateLimiter) setRate(rate int) {
+	l.Lock()
+	l.rate = rate
+	l.Unlock()
+}
+
+// wait waits until n documents can be sent, or the context is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.Lock()
+	if l.rate <= 0 {
+		l.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(l.rate))
+	l.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
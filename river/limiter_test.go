@@ -0,0 +1,40 @@
+package river
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoBulkRateLimit(t *testing.T) {
+	var bulkNum int32
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&bulkNum, 1)
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	})
+	defer closeFn()
+
+	// 1 doc for every bulk, so 3 bulks need at least 200ms
+	r.SetBulkDocsPerSecond(10)
+
+	start := time.Now()
+	reqs := append(append(testBulkRequests(), testBulkRequests()...), testBulkRequests()...)
+	if err := r.doBulk(r.ctx, reqs); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("Expected: is at least 200ms, but: was %s", d)
+	}
+	if n := atomic.LoadInt32(&bulkNum); n != 3 {
+		t.Errorf("Bulk Expected: is 3, but: was %d", n)
+	}
+
+	// the waiting is cancelled with the ctx
+	r.SetBulkDocsPerSecond(1)
+	r.doBulk(r.ctx, testBulkRequests())
+	r.cancel()
+	if err := r.doBulk(r.ctx, testBulkRequests()); err == nil {
+		t.Error("Expected: an error for the cancelled waiting, but: was nil")
+	}
+}
@@ -0,0 +1,117 @@
+package river
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+)
+
+// The supported log formats.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// logFieldsMark starts the message with the JSON fields, see logMsg.
+const logFieldsMark = "\x1e"
+
+// jsonLog is 1 if the JSON log format is used, updated atomically.
+var jsonLog int32
+
+// logFields are the fields like the binlog position, error and document count,
+// which are the JSON keys in the JSON log format.
+type logFields map[string]interface{}
+
+// SetLogFormat sets the format of the default logger writing to w, LogFormatText or LogFormatJSON.
+// The JSON format writes one JSON object per line with the time, level, file and msg, and the
+// important events have more fields like binlog_name, binlog_pos, error, table and doc_count.
+// The logger is replaced for the JSON format, so set the log level after it.
+func SetLogFormat(format string, w io.Writer) error {
+	switch format {
+	case LogFormatText:
+		atomic.StoreInt32(&jsonLog, 0)
+	case LogFormatJSON:
+		log.SetDefaultLogger(log.New(&jsonLogHandler{w: w}, log.Llevel|log.Lfile))
+		atomic.StoreInt32(&jsonLog, 1)
+	default:
+		return errors.Errorf("log format must be %s or %s, but %s", LogFormatText, LogFormatJSON, format)
+	}
+
+	return nil
+}
+
+// logMsg returns the log message with the fields. The message is the same as
+// fmt.Sprintf for the text format, so the text logs don't change, and the fields
+// are encoded in it for the JSON log handler.
+func logMsg(fields logFields, format string, args ...interface{}) string {
+	msg := fmt.Sprintf(format, args...)
+	if atomic.LoadInt32(&jsonLog) == 0 {
+		return msg
+	}
+
+	entry := make(map[string]interface{}, len(fields)+1)
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[k] = v
+	}
+	entry["msg"] = msg
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return msg
+	}
+
+	return logFieldsMark + string(data)
+}
+
+// jsonLogHandler converts the log lines to JSON objects.
+type jsonLogHandler struct {
+	w io.Writer
+}
+
+// Write implements log.Handler, the line is "[level] file:line msg" by the logger flags.
+func (h *jsonLogHandler) Write(b []byte) (int, error) {
+	line := strings.TrimRight(string(b), "\n")
+	entry := make(map[string]interface{})
+
+	if strings.HasPrefix(line, "[") {
+		if i := strings.Index(line, "] "); i > 0 {
+			entry["level"] = line[1:i]
+			line = line[i+2:]
+
+			if i = strings.IndexByte(line, ' '); i > 0 {
+				entry["file"] = line[:i]
+				line = line[i+1:]
+			}
+		}
+	}
+
+	if !strings.HasPrefix(line, logFieldsMark) || json.Unmarshal([]byte(line[len(logFieldsMark):]), &entry) != nil {
+		entry["msg"] = line
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	if _, err = h.w.Write(append(data, '\n')); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return len(b), nil
+}
+
+// Close implements log.Handler.
+func (h *jsonLogHandler) Close() error {
+	return nil
+}
@@ -0,0 +1,68 @@
+package river
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+func TestJSONLog(t *testing.T) {
+	var buf bytes.Buffer
+	if err := SetLogFormat(LogFormatJSON, &buf); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		SetLogFormat(LogFormatText, os.Stdout)
+		h, _ := log.NewStreamHandler(os.Stdout)
+		log.SetDefaultLogger(log.NewDefault(h))
+	}()
+
+	pos := mysql.Position{Name: "mysql-bin.000001", Pos: 4}
+	log.Error(logMsg(logFields{"error": errors.New("timeout"), "binlog_name": pos.Name, "binlog_pos": pos.Pos, "doc_count": 2},
+		"do ES bulk err %v after binlog %s", "timeout", pos))
+	log.Infof("plain %s", "message")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected: is 2 lines, but: was %q", buf.String())
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"level": "error", "error": "timeout", "binlog_name": "mysql-bin.000001",
+		"binlog_pos": float64(4), "doc_count": float64(2), "msg": "do ES bulk err timeout after binlog (mysql-bin.000001, 4)"}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Errorf("%s Expected: is %v, but: was %v", k, v, entry[k])
+		}
+	}
+	if file, _ := entry["file"].(string); !strings.HasPrefix(file, "log_test.go:") {
+		t.Errorf("file Expected: is log_test.go, but: was %v", entry["file"])
+	}
+
+	entry = nil
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["msg"] != "plain message" || entry["level"] != "info" {
+		t.Errorf("Expected: is the plain info message, but: was %v", entry)
+	}
+
+	// the text message is not changed
+	SetLogFormat(LogFormatText, os.Stdout)
+	if msg := logMsg(logFields{"doc_count": 2}, "%d requests", 2); msg != "2 requests" {
+		t.Errorf("Expected: is 2 requests, but: was %s", msg)
+	}
+
+	if err := SetLogFormat("xml", os.Stdout); err == nil {
+		t.Error("Expected: an error for unknown log format, but: was nil")
+	}
+}
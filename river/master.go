@@ -1,82 +1,71 @@
 package river
 
 import (
-	"bytes"
-	"os"
-	"path"
 	"sync"
-	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/juju/errors"
 	"github.com/siddontang/go-log/log"
 	"github.com/siddontang/go-mysql/mysql"
-	"github.com/siddontang/go/ioutil2"
 )
 
 type masterInfo struct {
 	sync.RWMutex
 
-	Name string `toml:"bin_name"`
-	Pos  uint32 `toml:"bin_pos"`
+	Name string
+	Pos  uint32
+	// the executed GTID set for gtid_mode, empty if not known
+	GTID string
 
-	filePath     string
-	lastSaveTime time.Time
+	// store persists the position, the position is only kept in memory if nil.
+	store positionStore
 }
 
-func loadMasterInfo(dataDir string) (*masterInfo, error) {
+func loadMasterInfo(store positionStore) (*masterInfo, error) {
 	var m masterInfo
 
-	if len(dataDir) == 0 {
+	if store == nil {
 		return &m, nil
 	}
 
-	m.filePath = path.Join(dataDir, "master.info")
-	m.lastSaveTime = time.Now()
+	m.store = store
 
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
+	pos, gtid, err := store.load()
+	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	f, err := os.Open(m.filePath)
-	if err != nil && !os.IsNotExist(errors.Cause(err)) {
-		return nil, errors.Trace(err)
-	} else if os.IsNotExist(errors.Cause(err)) {
-		return &m, nil
-	}
-	defer f.Close()
+	m.Name = pos.Name
+	m.Pos = pos.Pos
+	m.GTID = gtid
 
-	_, err = toml.DecodeReader(f, &m)
-	return &m, errors.Trace(err)
+	return &m, nil
 }
 
-func (m *masterInfo) Save(pos mysql.Position) error {
-	log.Infof("save position %s", pos)
+// Save saves the position and the GTID set to the store, the GTID set is nil if not
+// in gtid_mode. The sync loop decides how often to save it with save_position_interval.
+func (m *masterInfo) Save(pos mysql.Position, gset mysql.GTIDSet) error {
+	var gtid string
+	if gset != nil {
+		gtid = gset.String()
+	}
+	log.Info(logMsg(logFields{"binlog_name": pos.Name, "binlog_pos": pos.Pos, "binlog_gtid": gtid},
+		"save position %s, GTID set %s", pos, gtid))
 
 	m.Lock()
 	defer m.Unlock()
 
 	m.Name = pos.Name
 	m.Pos = pos.Pos
+	m.GTID = gtid
 
-	if len(m.filePath) == 0 {
+	if m.store == nil {
 		return nil
 	}
 
-	n := time.Now()
-	if n.Sub(m.lastSaveTime) < time.Second {
-		return nil
-	}
-
-	m.lastSaveTime = n
-	var buf bytes.Buffer
-	e := toml.NewEncoder(&buf)
-
-	e.Encode(m)
-
-	var err error
-	if err = ioutil2.WriteFileAtomic(m.filePath, buf.Bytes(), 0644); err != nil {
-		log.Errorf("canal save master info to file %s err %v", m.filePath, err)
+	err := m.store.save(pos, gtid)
+	if err != nil {
+		log.Error(logMsg(logFields{"error": err, "binlog_name": pos.Name, "binlog_pos": pos.Pos},
+			"canal save master info to %s err %v", m.store, err))
 	}
 
 	return errors.Trace(err)
@@ -92,8 +81,21 @@ func (m *masterInfo) Position() mysql.Position {
 	}
 }
 
+// GTIDSet returns the saved GTID set, empty if not known.
+func (m *masterInfo) GTIDSet() string {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.GTID
+}
+
 func (m *masterInfo) Close() error {
-	pos := m.Position()
+	m.RLock()
+	pos, gtid := mysql.Position{Name: m.Name, Pos: m.Pos}, m.GTID
+	m.RUnlock()
 
-	return m.Save(pos)
+	if m.store == nil {
+		return nil
+	}
+	return errors.Trace(m.store.save(pos, gtid))
 }
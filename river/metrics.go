@@ -1,12 +1,15 @@
 package river
 
 import (
+	"encoding/json"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/siddontang/go-log/log"
 )
 
 var (
@@ -28,6 +31,48 @@ var (
 			Help: "The number of docs deleted from elasticsearch",
 		}, []string{"index"},
 	)
+	esSkippedUpdateNum = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mysql2es_skipped_update_num",
+			Help: "The number of updates skipped for not changing any synced column",
+		}, []string{"index"},
+	)
+	esCoalescedNum = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mysql2es_coalesced_num",
+			Help: "The number of requests dropped for being overwritten by a later request of the same doc",
+		}, []string{"index"},
+	)
+	esDeleteVerifySkippedNum = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mysql2es_delete_verify_skipped_num",
+			Help: "The number of conditional deletes skipped because the doc is not found or newer than the deleted row",
+		}, []string{"index"},
+	)
+	esDeleteByQueryNum = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mysql2es_delete_by_query_deleted_num",
+			Help: "The number of docs deleted by the delete by query of delete_by_query_field",
+		}, []string{"index"},
+	)
+	esHistoryNum = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mysql2es_history_num",
+			Help: "The number of history docs of the updates indexed to history_index",
+		}, []string{"index"},
+	)
+	skippedRowsNum = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mysql2es_skipped_rows_num",
+			Help: "The number of rows skipped for not matching the table columns",
+		}, []string{"index"},
+	)
+	nullRoutingNum = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mysql2es_null_routing_num",
+			Help: "The number of rows synced without routing for the NULL routing_column value",
+		}, []string{"index"},
+	)
 	canalSyncState = promauto.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "mysql2es_canal_state",
@@ -37,18 +82,165 @@ var (
 	canalDelay = promauto.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "mysql2es_canal_delay",
-			Help: "The canal slave lag",
+			Help: "The canal slave lag in seconds",
+		},
+	)
+	mysqlReconnectNum = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mysql2es_mysql_reconnect_num",
+			Help: "The number of the attempts to reconnect to MySQL after the binlog sync failed",
+		},
+	)
+	savePositionErrorNum = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mysql2es_save_position_error_num",
+			Help: "The number of failed attempts to save the position",
+		},
+	)
+	bulkPendingNum = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mysql2es_bulk_pending_num",
+			Help: "The number of requests waiting to be sent to elasticsearch",
+		},
+	)
+	syncChanLen = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mysql2es_sync_chan_len",
+			Help: "The number of events waiting in the channel to the sync loop",
 		},
 	)
+	syncChanFullNum = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mysql2es_sync_chan_full_num",
+			Help: "The number of times the binlog reader blocked for the full sync channel",
+		},
+	)
+	bulkErrorNum = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mysql2es_bulk_error_num",
+			Help: "The number of failed bulk requests to elasticsearch",
+		},
+	)
+	bulkRejectedNum = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mysql2es_bulk_rejected_num",
+			Help: "The number of bulk requests rejected by elasticsearch for too many requests",
+		},
+	)
+	subscriberDroppedNum = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mysql2es_subscriber_dropped_num",
+			Help: "The number of bulk request batches dropped for the full subscriber channels",
+		},
+	)
+	bulkItemErrorNum = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mysql2es_bulk_item_error_num",
+			Help: "The number of failed items in the elasticsearch bulk responses",
+		}, []string{"index"},
+	)
 )
 
 func (r *River) collectMetrics() {
-	for range time.Tick(10 * time.Second) {
-		canalDelay.Set(float64(r.canal.GetDelay()))
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			canalDelay.Set(float64(r.getCanal().GetDelay()))
+			syncChanLen.Set(float64(len(r.syncCh)))
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// statPath is the path of the river status in JSON.
+const statPath = "/stat"
+
+// Stat is the river status.
+type Stat struct {
+	// The saved binlog position.
+	BinName string `json:"bin_name"`
+	BinPos  uint32 `json:"bin_pos"`
+	// The saved executed GTID set for gtid_mode.
+	BinGTID string `json:"bin_gtid,omitempty"`
+
+	// The number of requests waiting to be sent to ES.
+	PendingNum int64 `json:"pending_num"`
+
+	// The unix timestamp of the last handled binlog event, 0 if no event.
+	LastEventTime int64 `json:"last_event_time"`
+
+	// The initial dump progress, nil if there is no dump.
+	Dump *DumpStat `json:"dump,omitempty"`
+}
+
+// Stat returns the current river status.
+func (r *River) Stat() Stat {
+	pos := r.master.Position()
+	return Stat{
+		BinName:       pos.Name,
+		BinPos:        pos.Pos,
+		BinGTID:       r.master.GTIDSet(),
+		PendingNum:    atomic.LoadInt64(&r.pendingNum),
+		LastEventTime: atomic.LoadInt64(&r.lastEventTime),
+		Dump:          r.dumpStat(),
+	}
+}
+
+func (r *River) handleStat(w http.ResponseWriter, req *http.Request) {
+	data, err := json.Marshal(r.Stat())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// newStatMux serves the metrics and the status, and the admin endpoints if stat_admin is set.
+func (r *River) newStatMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(r.c.StatPath, promhttp.Handler())
+	mux.HandleFunc(statPath, r.handleStat)
+	if r.c.StatAdmin {
+		mux.HandleFunc(resyncPath, r.handleResync)
+		mux.HandleFunc(refreshTablePath, r.handleRefreshTable)
 	}
+	return mux
 }
 
+// initStatus serves the metrics and the river status on stat_addr, does nothing if stat_addr is empty.
+func (r *River) initStatus() {
+	if len(r.c.StatAddr) == 0 {
+		return
+	}
+
+	r.statServer = &http.Server{Addr: r.c.StatAddr, Handler: r.newStatMux()}
+	go func(s *http.Server) {
+		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("serve status on %s err %v", s.Addr, err)
+		}
+	}(r.statServer)
+}
+
+// InitStatus serves the metrics with path on addr, it blocks until the server fails,
+// and does nothing if addr is empty.
+//
+// Deprecated: NewRiver serves the metrics and the river status on stat_addr by itself.
 func InitStatus(addr string, path string) {
-	http.Handle(path, promhttp.Handler())
-	http.ListenAndServe(addr, nil)
+	if len(addr) == 0 {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.Handler())
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("serve status on %s err %v", addr, err)
+	}
 }
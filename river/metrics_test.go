@@ -0,0 +1,62 @@
+package river
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+func TestHandleStat(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {})
+	defer closeFn()
+
+	r.master.Save(mysql.Position{Name: "mysql-bin.000001", Pos: 4}, nil)
+	r.setPendingNum(3)
+
+	w := httptest.NewRecorder()
+	r.handleStat(w, httptest.NewRequest("GET", statPath, nil))
+
+	expect := `{"bin_name":"mysql-bin.000001","bin_pos":4,"pending_num":3,"last_event_time":0}`
+	if w.Body.String() != expect {
+		t.Errorf("Expected: is %s, but: was %s", expect, w.Body.String())
+	}
+}
+
+func TestStatAdmin(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {})
+	defer closeFn()
+
+	// the admin endpoints are not served by default
+	for _, p := range []string{resyncPath, refreshTablePath} {
+		w := httptest.NewRecorder()
+		r.newStatMux().ServeHTTP(w, httptest.NewRequest("POST", p+"?table=test.t1", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s Expected: is %d, but: was %d", p, http.StatusNotFound, w.Code)
+		}
+	}
+
+	r.c.StatAdmin = true
+	for _, p := range []string{resyncPath, refreshTablePath} {
+		w := httptest.NewRecorder()
+		r.newStatMux().ServeHTTP(w, httptest.NewRequest("GET", p+"?table=test.t1", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s Expected: is %d, but: was %d", p, http.StatusMethodNotAllowed, w.Code)
+		}
+	}
+}
+
+func TestPendingDocs(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {})
+	defer closeFn()
+
+	r.setPendingNum(3)
+	if n := r.PendingDocs(); n != 3 || r.Stat().PendingNum != 3 {
+		t.Errorf("Expected: is 3, but: was %d, stat %d", n, r.Stat().PendingNum)
+	}
+	r.setPendingNum(0)
+	if n := r.PendingDocs(); n != 0 {
+		t.Errorf("Expected: is 0, but: was %d", n)
+	}
+}
@@ -0,0 +1,76 @@
+package river
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// useMyTLS returns whether to connect to MySQL with TLS.
+func (c *Config) useMyTLS() bool {
+	return len(c.MySSLCA) > 0 || len(c.MySSLCert) > 0 || len(c.MySSLKey) > 0 || c.MySSLSkipVerify
+}
+
+// prepareMyTLS loads the TLS configuration for the binlog and query connections to MySQL.
+// The server certificate is verified with my_ssl_ca, or the system CA certificates if not
+// set, and its name must match the host of my_addr.
+func (c *Config) prepareMyTLS() error {
+	c.myTLS = nil
+	if !c.useMyTLS() {
+		return nil
+	}
+	if (len(c.MySSLCert) == 0) != (len(c.MySSLKey) == 0) {
+		return errors.New("my_ssl_cert and my_ssl_key must be set together")
+	}
+
+	cfg, err := newTLSConfig(c.MySSLCA, c.MySSLSkipVerify)
+	if err != nil {
+		return errors.Annotate(err, "my_ssl_ca")
+	}
+	if len(c.MySSLCert) > 0 {
+		cert, err := tls.LoadX509KeyPair(c.MySSLCert, c.MySSLKey)
+		if err != nil {
+			return errors.Annotatef(err, "load my_ssl_cert %s and my_ssl_key %s", c.MySSLCert, c.MySSLKey)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if host, _, err := net.SplitHostPort(c.MyAddr); err == nil {
+		cfg.ServerName = host
+	}
+
+	c.myTLS = cfg
+	return nil
+}
+
+// mySSLDumpArgs returns the mysqldump options to connect with TLS like the binlog. mysqldump
+// only verifies the server with my_ssl_ca, not with the system CA certificates.
+func (c *Config) mySSLDumpArgs() []string {
+	if !c.useMyTLS() {
+		return nil
+	}
+
+	var args []string
+	if len(c.MySSLCA) > 0 {
+		args = append(args, fmt.Sprintf("--ssl-ca=%s", c.MySSLCA))
+	}
+	if len(c.MySSLCert) > 0 {
+		args = append(args, fmt.Sprintf("--ssl-cert=%s", c.MySSLCert), fmt.Sprintf("--ssl-key=%s", c.MySSLKey))
+	}
+
+	verify := len(c.MySSLCA) > 0 && !c.MySSLSkipVerify
+	// the mysqldump of MariaDB has no --ssl-mode
+	if c.Flavor == mysql.MariaDBFlavor {
+		args = append(args, "--ssl")
+		if verify {
+			args = append(args, "--ssl-verify-server-cert")
+		}
+	} else if verify {
+		args = append(args, "--ssl-mode=VERIFY_IDENTITY")
+	} else {
+		args = append(args, "--ssl-mode=REQUIRED")
+	}
+	return args
+}
@@ -0,0 +1,119 @@
+package river
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate and its key as PEM files in dir.
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mysql"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestConfigMySSL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "river_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+
+	cfg, err := NewConfig(fmt.Sprintf(`
+my_addr = "mysql.example.com:3306"
+my_ssl_ca = %q
+my_ssl_cert = %q
+my_ssl_key = %q
+`, certFile, certFile, keyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.myTLS == nil {
+		t.Fatal("TLS config Expected: is loaded, but: was nil")
+	}
+	if cfg.myTLS.ServerName != "mysql.example.com" {
+		t.Errorf("ServerName Expected: is mysql.example.com, but: was %s", cfg.myTLS.ServerName)
+	}
+	if cfg.myTLS.RootCAs == nil || len(cfg.myTLS.Certificates) != 1 {
+		t.Errorf("TLS config Expected: has the CA and the client certificate, but: was %d certificates", len(cfg.myTLS.Certificates))
+	}
+	expected := []string{"--ssl-ca=" + certFile, "--ssl-cert=" + certFile, "--ssl-key=" + keyFile, "--ssl-mode=VERIFY_IDENTITY"}
+	if args := cfg.mySSLDumpArgs(); !reflect.DeepEqual(args, expected) {
+		t.Errorf("mysqldump args Expected: is %v, but: was %v", expected, args)
+	}
+
+	cfg.MySSLSkipVerify = true
+	cfg.Flavor = "mariadb"
+	if err = cfg.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.myTLS.InsecureSkipVerify {
+		t.Error("InsecureSkipVerify Expected: is true, but: was false")
+	}
+	expected = []string{"--ssl-ca=" + certFile, "--ssl-cert=" + certFile, "--ssl-key=" + keyFile, "--ssl"}
+	if args := cfg.mySSLDumpArgs(); !reflect.DeepEqual(args, expected) {
+		t.Errorf("mysqldump args Expected: is %v, but: was %v", expected, args)
+	}
+
+	cfg.MySSLKey = ""
+	if err = cfg.prepare(); err == nil {
+		t.Error("Expected: an error for my_ssl_cert without my_ssl_key, but: was nil")
+	}
+
+	cfg.MySSLKey = keyFile
+	cfg.MySSLCA = keyFile
+	if err = cfg.prepare(); err == nil {
+		t.Error("Expected: an error for my_ssl_ca without a certificate, but: was nil")
+	}
+
+	cfg.MySSLCA, cfg.MySSLCert, cfg.MySSLKey, cfg.MySSLSkipVerify = "", "", "", false
+	if err = cfg.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.myTLS != nil || cfg.mySSLDumpArgs() != nil {
+		t.Error("TLS Expected: is not used, but: was used")
+	}
+}
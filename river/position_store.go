@@ -0,0 +1,156 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/BurntSushi/toml"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go/ioutil2"
+)
+
+// The supported position stores.
+const (
+	positionStoreFile = "file"
+	positionStoreES   = "es"
+)
+
+// positionStore persists the binlog position, so the sync can be resumed after restart.
+type positionStore interface {
+	// load returns the saved position and the GTID set, or an empty position if
+	// nothing is saved. The GTID set is empty if not in gtid_mode.
+	load() (mysql.Position, string, error)
+	save(pos mysql.Position, gtid string) error
+	String() string
+}
+
+// filePosition is the position saved in the file.
+type filePosition struct {
+	Name string `toml:"bin_name"`
+	Pos  uint32 `toml:"bin_pos"`
+	GTID string `toml:"bin_gtid,omitempty"`
+}
+
+// fileStore saves the position in the master.info file in the data dir.
+type fileStore struct {
+	filePath string
+}
+
+func newFileStore(dataDir string) (*fileStore, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &fileStore{filePath: path.Join(dataDir, "master.info")}, nil
+}
+
+func (s *fileStore) load() (mysql.Position, string, error) {
+	var p filePosition
+
+	f, err := os.Open(s.filePath)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return mysql.Position{}, "", errors.Trace(err)
+	} else if os.IsNotExist(errors.Cause(err)) {
+		return mysql.Position{}, "", nil
+	}
+	defer f.Close()
+
+	_, err = toml.DecodeReader(f, &p)
+	return mysql.Position{Name: p.Name, Pos: p.Pos}, p.GTID, errors.Trace(err)
+}
+
+func (s *fileStore) save(pos mysql.Position, gtid string) error {
+	var buf bytes.Buffer
+	e := toml.NewEncoder(&buf)
+
+	if err := e.Encode(filePosition{Name: pos.Name, Pos: pos.Pos, GTID: gtid}); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(ioutil2.WriteFileAtomic(s.filePath, buf.Bytes(), 0644))
+}
+
+func (s *fileStore) String() string {
+	return "file " + s.filePath
+}
+
+// esPositionType is the mapping type of the position document before ES 7.
+const esPositionType = "position"
+
+// esStore saves the position as a document in an ES index, so the river
+// needs no local storage.
+type esStore struct {
+	es    *elastic.Client
+	index string
+	id    string
+}
+
+func newESStore(es *elastic.Client, index string, id string) *esStore {
+	return &esStore{es: es, index: index, id: id}
+}
+
+func (s *esStore) load() (mysql.Position, string, error) {
+	r, err := s.es.Get(s.index, esPositionType, s.id)
+	if err != nil {
+		return mysql.Position{}, "", errors.Trace(err)
+	}
+
+	switch r.Code {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return mysql.Position{}, "", nil
+	default:
+		return mysql.Position{}, "", errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+	}
+
+	name, ok := r.Source["bin_name"].(string)
+	if !ok {
+		return mysql.Position{}, "", errors.Errorf("invalid bin_name %v in %s", r.Source["bin_name"], s)
+	}
+	// the JSON numbers are decoded as float64
+	pos, ok := r.Source["bin_pos"].(float64)
+	if !ok {
+		return mysql.Position{}, "", errors.Errorf("invalid bin_pos %v in %s", r.Source["bin_pos"], s)
+	}
+	// saved before gtid_mode if not found
+	gtid, _ := r.Source["bin_gtid"].(string)
+
+	return mysql.Position{Name: name, Pos: uint32(pos)}, gtid, nil
+}
+
+func (s *esStore) save(pos mysql.Position, gtid string) error {
+	data := map[string]interface{}{
+		"bin_name": pos.Name,
+		"bin_pos":  pos.Pos,
+		"bin_gtid": gtid,
+	}
+
+	return errors.Trace(s.es.Update(s.index, esPositionType, s.id, data))
+}
+
+func (s *esStore) String() string {
+	return fmt.Sprintf("ES index %s id %s", s.index, s.id)
+}
+
+// newPositionStore creates the configured position store, nil if the position
+// is not persisted.
+func (r *River) newPositionStore() (positionStore, error) {
+	switch r.c.PositionStore {
+	case positionStoreES:
+		return newESStore(r.es, r.c.PositionIndex, fmt.Sprint(r.c.ServerID)), nil
+	default:
+		if len(r.c.DataDir) == 0 {
+			return nil, nil
+		}
+		s, err := newFileStore(r.c.DataDir)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return s, nil
+	}
+}
@@ -0,0 +1,81 @@
+package river
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+func TestPositionStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "river")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var docs sync.Map
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			if doc, ok := docs.Load(req.URL.Path); ok {
+				w.Write([]byte(`{"found":true,"_source":` + doc.(string) + `}`))
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"found":false}`))
+		case "PUT":
+			data, _ := ioutil.ReadAll(req.Body)
+			docs.Store(req.URL.Path, string(data))
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"result":"created"}`))
+		}
+	}))
+	defer ts.Close()
+
+	fs, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://"), Version: 7})
+
+	pos := mysql.Position{Name: "mysql-bin.000002", Pos: 1234}
+	gset, err := mysql.ParseMysqlGTIDSet("3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []positionStore{fs, newESStore(es, "mysql2es_position", "1001")} {
+		m, err := loadMasterInfo(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p := m.Position(); p != (mysql.Position{}) {
+			t.Errorf("%s Expected: is empty, but: was %s", s, p)
+		}
+
+		m.Save(pos, gset)
+		if err = m.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if m, err = loadMasterInfo(s); err != nil {
+			t.Fatal(err)
+		}
+		if p := m.Position(); p != pos {
+			t.Errorf("%s Expected: is %s, but: was %s", s, pos, p)
+		}
+		if g := m.GTIDSet(); g != gset.String() {
+			t.Errorf("%s GTID Expected: is %s, but: was %s", s, gset, g)
+		}
+	}
+
+	if _, ok := docs.Load("/mysql2es_position/_doc/1001"); !ok {
+		t.Error("Expected: the position doc in ES, but: was not found")
+	}
+}
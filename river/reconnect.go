@@ -0,0 +1,160 @@
+package river
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// syncerReconnectAttempts is the max times the binlog syncer retries by itself
+// before the canal fails and is recreated by runCanal.
+const syncerReconnectAttempts = 3
+
+// getCanal returns the current canal, which may be replaced by runCanal.
+func (r *River) getCanal() *canal.Canal {
+	r.canalMu.RLock()
+	defer r.canalMu.RUnlock()
+	return r.canal
+}
+
+// runCanal syncs the binlog from the position until the river is closed. If the sync
+// fails, like the connection is lost or MySQL restarts, it reconnects with a new canal
+// from the saved position, waiting my_reconnect_backoff at first and doubling the wait
+// time after every failure. The events after the saved position may be synced again.
+// The dump can't be resumed, so the river is closed if the sync fails before the
+// position is saved.
+func (r *River) runCanal(pos mysql.Position, gset mysql.GTIDSet) error {
+	backoff := r.c.MyReconnectBackoff.Duration
+	for {
+		start := time.Now()
+
+		var err error
+		if gset != nil {
+			err = r.canal.StartFromGTID(gset)
+		} else {
+			err = r.canal.RunFrom(pos)
+		}
+		canalSyncState.Set(0)
+		if r.ctx.Err() != nil {
+			return nil
+		}
+		if err == nil || r.needDump() {
+			log.Error(logMsg(logFields{"error": err, "binlog_name": pos.Name, "binlog_pos": pos.Pos}, "start canal err %v", err))
+			r.cancel()
+			return errors.Trace(err)
+		}
+
+		// the sync ran well for a while, so start the backoff again
+		if time.Since(start) > r.c.MyMaxReconnectBackoff.Duration {
+			backoff = r.c.MyReconnectBackoff.Duration
+		}
+
+		for {
+			log.Error(logMsg(logFields{"error": err, "binlog_name": pos.Name, "binlog_pos": pos.Pos, "backoff": backoff.String()},
+				"sync binlog err %v, reconnect to MySQL after %s", err, backoff))
+			select {
+			case <-time.After(backoff):
+			case <-r.ctx.Done():
+				return nil
+			}
+			backoff = nextReconnectBackoff(backoff, r.c.MyMaxReconnectBackoff.Duration)
+
+			mysqlReconnectNum.Inc()
+			if pos, gset, err = r.resumePosition(); err != nil {
+				r.cancel()
+				return errors.Trace(err)
+			}
+			if err = r.reconnectCanal(); err == nil {
+				break
+			}
+			if r.ctx.Err() != nil {
+				return nil
+			}
+		}
+
+		log.Infof("reconnected to MySQL, sync from position %s", pos)
+		canalSyncState.Set(1)
+	}
+}
+
+// reconnectCanal closes the failed canal and replaces it with a new one. The closed
+// canal is kept if the new one can't be created, and not closed again by the next
+// retry or Close.
+func (r *River) reconnectCanal() error {
+	r.closeCanal()
+
+	c, err := canal.NewCanal(r.newCanalConfig())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	r.canalMu.Lock()
+	defer r.canalMu.Unlock()
+
+	// Close reads the canal after cancel, so the new canal must not be used here
+	if err = r.ctx.Err(); err != nil {
+		closeCanal(c)
+		return errors.Trace(err)
+	}
+
+	r.canal = c
+	r.canalClosed = false
+	if err = r.prepareCanal(); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// closeCanal closes the current canal if it isn't closed by reconnectCanal.
+func (r *River) closeCanal() {
+	r.canalMu.Lock()
+	c, closed := r.canal, r.canalClosed
+	r.canalClosed = true
+	r.canalMu.Unlock()
+
+	if !closed {
+		closeCanal(c)
+	}
+}
+
+// closeCanal closes the canal. go-mysql panics closing the query connection if it was
+// lost and not reconnected, the binlog syncer is closed before, so the panic is ignored.
+func closeCanal(c *canal.Canal) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Warnf("close canal without the lost MySQL connection, %v", err)
+		}
+	}()
+	c.Close()
+}
+
+// resumePosition returns the saved position, or the saved GTID set for gtid_mode.
+func (r *River) resumePosition() (mysql.Position, mysql.GTIDSet, error) {
+	pos := r.master.Position()
+	if !r.c.GTIDMode {
+		return pos, nil, nil
+	}
+
+	gtid := r.master.GTIDSet()
+	if len(gtid) == 0 {
+		// nothing is saved since starting from start_gtid
+		return pos, r.startGTID, nil
+	}
+	gset, err := mysql.ParseGTIDSet(r.c.gtidFlavor(), gtid)
+	if err != nil {
+		return pos, nil, errors.Annotatef(err, "invalid saved GTID set %s", gtid)
+	}
+	return pos, gset, nil
+}
+
+// nextReconnectBackoff doubles the wait time up to max.
+func nextReconnectBackoff(backoff time.Duration, max time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
@@ -0,0 +1,51 @@
+package river
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+func TestResumePosition(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {})
+	defer closeFn()
+
+	pos := mysql.Position{Name: "mysql-bin.000002", Pos: 120}
+	r.master.Save(pos, nil)
+	p, gset, err := r.resumePosition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != pos || gset != nil {
+		t.Errorf("Expected: is %s, but: was %s, %v", pos, p, gset)
+	}
+
+	r.c.GTIDMode = true
+	r.startGTID, _ = mysql.ParseGTIDSet(mysql.MySQLFlavor, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5")
+	if _, gset, err = r.resumePosition(); err != nil {
+		t.Fatal(err)
+	}
+	if gset.String() != r.startGTID.String() {
+		t.Errorf("Start GTID Expected: is %s, but: was %s", r.startGTID, gset)
+	}
+
+	saved, _ := mysql.ParseGTIDSet(mysql.MySQLFlavor, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-23")
+	r.master.Save(pos, saved)
+	if _, gset, err = r.resumePosition(); err != nil {
+		t.Fatal(err)
+	}
+	if gset.String() != saved.String() {
+		t.Errorf("Saved GTID Expected: is %s, but: was %s", saved, gset)
+	}
+}
+
+func TestNextReconnectBackoff(t *testing.T) {
+	backoff := time.Second
+	for _, expected := range []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if backoff = nextReconnectBackoff(backoff, 5*time.Second); backoff != expected {
+			t.Errorf("Expected: is %s, but: was %s", expected, backoff)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package river
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+)
+
+// resyncPath is the path to resync a table by POST, like /resync?table=db.table.
+const resyncPath = "/resync"
+
+// Resync dumps the table again into its indices in the background, while the binlog
+// is still synced. It returns an error if the table has no rule, or it is being
+// dumped already.
+//
+// The dumped rows may overwrite the newer documents synced from the binlog during
+// the resync, use version_column to keep the newer ones.
+func (r *River) Resync(schema string, table string) error {
+	if len(r.c.DumpExec) == 0 {
+		return errors.New("resync needs mysqldump")
+	}
+	if atomic.LoadInt32(&r.dump.started) == 1 && atomic.LoadInt32(&r.dump.done) == 0 {
+		return errors.New("the initial dump is running")
+	}
+
+	key := ruleKey(schema, table)
+	rules, ok := r.rules[key]
+	if !ok {
+		return errors.Annotatef(ErrRuleNotExist, "%s.%s", schema, table)
+	}
+
+	r.resyncMu.Lock()
+	defer r.resyncMu.Unlock()
+	if r.resyncing == nil {
+		r.resyncing = make(map[string]struct{})
+	}
+	if _, ok = r.resyncing[key]; ok {
+		return errors.Errorf("%s.%s is being resynced", schema, table)
+	}
+	if err := r.addWorker(1); err != nil {
+		return errors.Trace(err)
+	}
+	r.resyncing[key] = struct{}{}
+
+	go func() {
+		defer r.wg.Done()
+		defer func() {
+			r.resyncMu.Lock()
+			delete(r.resyncing, key)
+			r.resyncMu.Unlock()
+		}()
+
+		log.Infof("start resyncing %s.%s", schema, table)
+		if err := r.dumpRules(rules[:1], false, true); err != nil {
+			log.Error(logMsg(logFields{"error": err, "schema": schema, "table": table},
+				"resync %s.%s err %v", schema, table, err))
+			return
+		}
+		log.Infof("resync %s.%s done", schema, table)
+	}()
+
+	return nil
+}
+
+func (r *River) handleResync(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "resync needs POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	seps := strings.SplitN(req.URL.Query().Get("table"), ".", 2)
+	if len(seps) != 2 || len(seps[0]) == 0 || len(seps[1]) == 0 {
+		http.Error(w, "table must be db.table", http.StatusBadRequest)
+		return
+	}
+
+	if err := r.Resync(seps[0], seps[1]); err != nil {
+		code := http.StatusConflict
+		if errors.Cause(err) == ErrRuleNotExist {
+			code = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,43 @@
+package river
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleResync(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {})
+	defer closeFn()
+
+	ta := newTestTable([]string{"id"}, "id", "int")
+	rule := newTestRule(ta)
+	r.rules = map[string][]*Rule{ruleKey(rule.Schema, rule.Table): {rule}}
+	r.c.DumpExec = "mysqldump"
+	r.resyncing = map[string]struct{}{ruleKey(rule.Schema, rule.Table): {}}
+
+	tests := []struct {
+		method string
+		table  string
+		code   int
+	}{
+		{"GET", rule.Schema + "." + rule.Table, http.StatusMethodNotAllowed},
+		{"POST", rule.Table, http.StatusBadRequest},
+		{"POST", rule.Schema + ".not_exist", http.StatusNotFound},
+		// being resynced
+		{"POST", rule.Schema + "." + rule.Table, http.StatusConflict},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r.handleResync(w, httptest.NewRequest(test.method, resyncPath+"?table="+test.table, nil))
+		if w.Code != test.code {
+			t.Errorf("%s %s Expected: is %d, but: was %d", test.method, test.table, test.code, w.Code)
+		}
+	}
+
+	r.c.DumpExec = ""
+	if err := r.Resync(rule.Schema, rule.Table); err == nil {
+		t.Error("Expected: an error without mysqldump, but: was nil")
+	}
+}
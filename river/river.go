@@ -2,20 +2,36 @@ package river
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/siddontang/go-log/log"
 	"github.com/siddontang/go-mysql-elasticsearch/elastic"
 	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
 )
 
 // ErrRuleNotExist is the error if rule is not defined.
 var ErrRuleNotExist = errors.New("rule is not exist")
 
+// ErrRiverRunning is the error if Run is called again.
+var ErrRiverRunning = errors.New("river is already running")
+
+// ErrRiverClosed is the error if Run is called after Close.
+var ErrRiverClosed = errors.New("river is closed")
+
 // River is a pluggable service within Elasticsearch pulling data then indexing it into Elasticsearch.
 // We use this definition here too, although it may not run within Elasticsearch.
 // Maybe later I can implement a acutal river in Elasticsearch, but I must learn java. :-)
@@ -23,35 +39,119 @@ type River struct {
 	c *Config
 
 	canal *canal.Canal
+	// canalMu protects canal replaced after reconnecting to MySQL, only needed
+	// outside the Run goroutine
+	canalMu sync.RWMutex
+	// canalClosed is whether the canal is closed, by a failed reconnection or Close
+	canalClosed bool
 
-	rules map[string]*Rule
+	// one table may be synced to many indices, so a table may have many rules
+	rules map[string][]*Rule
+
+	// the rule keys of deny_tables
+	denyTables map[string]struct{}
 
 	ctx    context.Context
 	cancel context.CancelFunc
 
 	wg sync.WaitGroup
 
+	// running is set by Run, so it can't run twice, updated atomically
+	running   int32
+	closeOnce sync.Once
+	// workerMu makes adding to wg and closing exclusive, see addWorker
+	workerMu sync.Mutex
+
 	es *elastic.Client
 
 	master *masterInfo
 
+	deadLetter *deadLetter
+
+	limiter *rateLimiter
+
+	transformer DocumentTransformer
+
+	// the channels to tee the bulk requests, see Subscribe
+	subscribers []chan []*elastic.BulkRequest
+
 	syncCh chan interface{}
+
+	statServer *http.Server
+
+	// updated atomically, see Stat
+	pendingNum    int64
+	lastEventTime int64
+	// the items sent to the sync channel but not handled by the sync loop yet, which
+	// still counts the ones received but not added to pendingNum
+	queuedNum int64
+
+	// the unix nano time of the last warning for the full sync channel, updated atomically
+	syncChanFullWarnTime int64
+
+	dump dumpProgress
+
+	// the resumable dump state, nil if resumable_dump is not set
+	dumpState *dumpState
+
+	// the GTID set to sync from, the saved one for gtid_mode, or start_gtid on the first run
+	startGTID mysql.GTIDSet
+
+	// the rule keys of the tables to refresh the table information, see RefreshTable
+	staleTables sync.Map
+	// reloadTable loads the table information from MySQL again, reloadCanalTable if nil
+	reloadTable func(db string, table string) (*schema.Table, error)
+
+	// the rule keys of the tables being resynced
+	resyncMu  sync.Mutex
+	resyncing map[string]struct{}
 }
 
-// NewRiver creates the River from config
-func NewRiver(c *Config) (*River, error) {
+// NewRiver creates the River from config, it connects to MySQL and ES and loads the
+// saved position, but syncs nothing until Run. The connections are closed if it fails.
+func NewRiver(c *Config) (_ *River, err error) {
+	if err = c.prepare(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
 	r := new(River)
+	defer func() {
+		if err == nil {
+			return
+		}
+		if r.canal != nil {
+			closeCanal(r.canal)
+		}
+		if r.master != nil {
+			r.master.Close()
+		}
+	}()
+
+	if c.DryRun {
+		log.Warnf("dry run is active, nothing is written to Elasticsearch, but the position is still saved")
+	}
+
+	if c.ServerID == 0 {
+		c.ServerID = randomServerID()
+		log.Warnf("server_id is not set, use the random server_id %d, please set a unique one for every river of the MySQL source", c.ServerID)
+	}
 
 	r.c = c
-	r.rules = make(map[string]*Rule)
-	r.syncCh = make(chan interface{}, 4096)
+	r.rules = make(map[string][]*Rule)
+	r.syncCh = make(chan interface{}, c.SyncChanSize)
 	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.limiter = newRateLimiter(c.BulkDocsPerSecond)
 
-	var err error
-	if r.master, err = loadMasterInfo(c.DataDir); err != nil {
+	if r.deadLetter, err = newDeadLetter(c.DeadLetterFile); err != nil {
 		return nil, errors.Trace(err)
 	}
 
+	if c.ResumableDump {
+		if r.dumpState, err = loadDumpState(c.DataDir); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
 	if err = r.newCanal(); err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -69,47 +169,172 @@ func NewRiver(c *Config) (*River, error) {
 		return nil, errors.Trace(err)
 	}
 
+	if r.es, err = r.newESClient(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// fail fast before the long dump, the dry run never writes ES
+	if !c.DryRun {
+		if err = r.pingES(esPingRetry, esPingBackoff); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	// the position may be stored in ES, so load it after creating the client
+	store, err := r.newPositionStore()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if r.master, err = loadMasterInfo(store); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = r.seedPosition(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	r.initStatus()
+
+	return r, nil
+}
+
+func (r *River) newESClient() (*elastic.Client, error) {
 	cfg := new(elastic.ClientConfig)
 	cfg.Addr = r.c.ESAddr
 	cfg.User = r.c.ESUser
 	cfg.Password = r.c.ESPassword
+	cfg.PathPrefix = r.c.ESPathPrefix
 	cfg.HTTPS = r.c.ESHttps
-	r.es = elastic.NewClient(cfg)
+	cfg.Version = r.c.ESVersion
+	cfg.Gzip = r.c.ESGzip
+	cfg.Timeout = r.c.ESTimeout.Duration
+	cfg.Headers = r.c.ESHeaders
+	cfg.RequestIDHeader = r.c.ESRequestIDHeader
+	if cfg.HTTPS {
+		var err error
+		if cfg.TLSConfig, err = newTLSConfig(r.c.ESCACert, r.c.ESInsecureSkipVerify); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return elastic.NewClient(cfg), nil
+}
 
-	go InitStatus(r.c.StatAddr, r.c.StatPath)
+// The retry to check ES at startup, for ES starting at the same time.
+const (
+	esPingRetry   = 3
+	esPingBackoff = time.Second
+)
 
-	return r, nil
+// pingES checks ES is reachable, it retries at most retry times with exponential backoff,
+// but not for the rejected credentials.
+func (r *River) pingES(retry int, backoff time.Duration) error {
+	for i := 0; ; i++ {
+		err := r.es.Ping()
+		if err == nil {
+			return nil
+		}
+		if errors.Cause(err) == elastic.ErrUnauthorized || i >= retry {
+			return errors.Annotatef(err, "check ES %s", r.c.ESAddr)
+		}
+
+		log.Warnf("check ES %s err %v, retry after %s", r.c.ESAddr, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// randomServerID returns a random replication server id, far from the small ids
+// of the MySQL servers set by hand.
+func randomServerID() uint32 {
+	return uint32(rand.New(rand.NewSource(time.Now().UnixNano())).Int31n(1<<30)) + 1001
+}
+
+// seedPosition uses the saved GTID set for gtid_mode, or the configured start position
+// if no position is saved.
+func (r *River) seedPosition() error {
+	if gtid := r.master.GTIDSet(); r.c.GTIDMode && len(gtid) > 0 {
+		gset, err := mysql.ParseGTIDSet(r.c.gtidFlavor(), gtid)
+		if err != nil {
+			return errors.Annotatef(err, "invalid saved GTID set %s", gtid)
+		}
+		r.startGTID = gset
+		return nil
+	}
+
+	if pos := r.master.Position(); len(pos.Name) > 0 {
+		return nil
+	}
+
+	if len(r.c.StartBinName) > 0 {
+		pos := mysql.Position{Name: r.c.StartBinName, Pos: r.c.StartBinPos}
+		log.Infof("no saved position, sync from the start position %s", pos)
+		r.master.Lock()
+		r.master.Name, r.master.Pos = pos.Name, pos.Pos
+		r.master.Unlock()
+	} else if len(r.c.StartGTID) > 0 {
+		gset, err := mysql.ParseGTIDSet(r.c.gtidFlavor(), r.c.StartGTID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		log.Infof("no saved position, sync from the start GTID set %s", gset)
+		r.startGTID = gset
+	}
+	return nil
 }
 
 func (r *River) newCanal() error {
+	var err error
+	r.canal, err = canal.NewCanal(r.newCanalConfig())
+	return errors.Trace(err)
+}
+
+func (r *River) newCanalConfig() *canal.Config {
 	cfg := canal.NewDefaultConfig()
 	cfg.Addr = r.c.MyAddr
 	cfg.User = r.c.MyUser
 	cfg.Password = r.c.MyPassword
 	cfg.Charset = r.c.MyCharset
 	cfg.Flavor = r.c.Flavor
-
+	cfg.TLSConfig = r.c.myTLS
 	cfg.ServerID = r.c.ServerID
 	cfg.Dump.ExecutionPath = r.c.DumpExec
 	cfg.Dump.DiscardErr = false
 	cfg.Dump.SkipMasterData = r.c.SkipMasterData
+	cfg.Dump.ExtraOptions = r.c.mySSLDumpArgs()
+	// the binlog and the dump keep the TIMESTAMP values in UTC, the dump writes them
+	// in the server time zone by default
+	if r.c.timeLocation() != time.Local {
+		cfg.TimestampStringLocation = time.UTC
+		cfg.Dump.ExtraOptions = append(cfg.Dump.ExtraOptions, "--tz-utc")
+	}
+
+	// the syncer gives up after a few retries, then a new canal reconnects
+	// from the saved position with the backoff
+	cfg.MaxReconnectAttempts = syncerReconnectAttempts
+	if r.c.MyReadTimeout.Duration > 0 {
+		cfg.ReadTimeout = r.c.MyReadTimeout.Duration
+		cfg.HeartbeatPeriod = r.c.MyReadTimeout.Duration / 2
+	}
 
 	for _, s := range r.c.Sources {
 		for _, t := range s.Tables {
 			cfg.IncludeTableRegex = append(cfg.IncludeTableRegex, s.Schema+"\\."+t)
 		}
 	}
+	// the canal doesn't get the table information for the rows of the denied tables,
+	// they are matched case-insensitively like the rules
+	for _, t := range r.c.DenyTables {
+		cfg.ExcludeTableRegex = append(cfg.ExcludeTableRegex, "(?i)^"+regexp.QuoteMeta(t)+"$")
+	}
 
-	var err error
-	r.canal, err = canal.NewCanal(cfg)
-	return errors.Trace(err)
+	return cfg
 }
 
 func (r *River) prepareCanal() error {
 	var db string
 	dbs := map[string]struct{}{}
 	tables := make([]string, 0, len(r.rules))
-	for _, rule := range r.rules {
+	for _, rules := range r.rules {
+		rule := rules[0]
 		db = rule.Schema
 		dbs[rule.Schema] = struct{}{}
 		tables = append(tables, rule.Table)
@@ -140,12 +365,12 @@ func (r *River) newRule(schema, table string) error {
 		return errors.Errorf("duplicate source %s, %s defined in config", schema, table)
 	}
 
-	r.rules[key] = newDefaultRule(schema, table)
+	r.rules[key] = []*Rule{newDefaultRule(schema, table)}
 	return nil
 }
 
 func (r *River) updateRule(schema, table string) error {
-	rule, ok := r.rules[ruleKey(schema, table)]
+	rules, ok := r.rules[ruleKey(schema, table)]
 	if !ok {
 		return ErrRuleNotExist
 	}
@@ -155,8 +380,17 @@ func (r *River) updateRule(schema, table string) error {
 		return errors.Trace(err)
 	}
 
-	rule.TableInfo = tableInfo
+	return errors.Trace(setRulesTable(rules, tableInfo))
+}
 
+// setRulesTable updates the table information of the rules of the table.
+func setRulesTable(rules []*Rule, tableInfo *schema.Table) error {
+	for _, rule := range rules {
+		rule.TableInfo = tableInfo
+		if err := rule.checkTable(); err != nil {
+			return errors.Trace(err)
+		}
+	}
 	return nil
 }
 
@@ -191,15 +425,15 @@ func (r *River) parseSource() (map[string][]string, error) {
 
 				for i := 0; i < res.Resultset.RowNumber(); i++ {
 					f, _ := res.GetString(i, 0)
-					err := r.newRule(s.Schema, f)
-					if err != nil {
-						return nil, errors.Trace(err)
-					}
-
 					tables = append(tables, f)
 				}
+				if tables, err = r.newWildRules(s.Schema, tables); err != nil {
+					return nil, errors.Trace(err)
+				}
 
 				wildTables[ruleKey(s.Schema, table)] = tables
+			} else if r.isDeniedTable(s.Schema, table) {
+				log.Infof("skip the source table %s.%s in deny_tables", s.Schema, table)
 			} else {
 				err := r.newRule(s.Schema, table)
 				if err != nil {
@@ -216,12 +450,45 @@ func (r *River) parseSource() (map[string][]string, error) {
 	return wildTables, nil
 }
 
+// newWildRules creates the default rules for the tables matched by a wildcard table, except
+// the ones in deny_tables, so they are neither dumped nor synced. It returns the tables
+// of the rules.
+func (r *River) newWildRules(schema string, tables []string) ([]string, error) {
+	kept := make([]string, 0, len(tables))
+	for _, table := range tables {
+		if r.isDeniedTable(schema, table) {
+			log.Infof("skip the table %s.%s in deny_tables", schema, table)
+			continue
+		}
+		if err := r.newRule(schema, table); err != nil {
+			return nil, errors.Trace(err)
+		}
+		kept = append(kept, table)
+	}
+	return kept, nil
+}
+
+// isDeniedTable returns whether the table is in deny_tables.
+func (r *River) isDeniedTable(schema string, table string) bool {
+	_, denied := r.denyTables[ruleKey(schema, table)]
+	return denied
+}
+
 func (r *River) prepareRule() error {
+	r.denyTables = make(map[string]struct{}, len(r.c.DenyTables))
+	for _, table := range r.c.DenyTables {
+		seps := strings.Split(table, ".")
+		r.denyTables[ruleKey(seps[0], seps[1])] = struct{}{}
+	}
+
 	wildtables, err := r.parseSource()
 	if err != nil {
 		return errors.Trace(err)
 	}
 
+	// the tables with custom rules, the value is whether the rules are wildcard rules
+	customTables := make(map[string]bool)
+
 	if r.c.Rules != nil {
 		// then, set custom mapping rule
 		for _, rule := range r.c.Rules {
@@ -240,84 +507,392 @@ func (r *River) prepareRule() error {
 					return errors.Errorf("wildcard table rule %s.%s must have a index, can not empty", rule.Schema, rule.Table)
 				}
 
-				rule.prepare()
+				if err := rule.prepare(); err != nil {
+					return errors.Trace(err)
+				}
 
 				for _, table := range tables {
-					rr := r.rules[ruleKey(rule.Schema, table)]
-					rr.Index = rule.Index
-					rr.Type = rule.Type
-					rr.Parent = rule.Parent
-					rr.ID = rule.ID
-					rr.FieldMapping = rule.FieldMapping
+					// the options of the wildcard rule are shared, only the table is per table
+					rr := *rule
+					rr.Table = table
+					rr.TableInfo = nil
+					rr.skippedColumns = nil
+					r.addCustomRule(customTables, ruleKey(rule.Schema, table), &rr, true)
 				}
 			} else {
 				key := ruleKey(rule.Schema, rule.Table)
+				if r.isDeniedTable(rule.Schema, rule.Table) {
+					log.Infof("skip the rule of %s.%s in deny_tables", rule.Schema, rule.Table)
+					continue
+				}
 				if _, ok := r.rules[key]; !ok {
 					return errors.Errorf("rule %s, %s not defined in source", rule.Schema, rule.Table)
 				}
-				rule.prepare()
-				r.rules[key] = rule
+				if err := rule.prepare(); err != nil {
+					return errors.Trace(err)
+				}
+				r.addCustomRule(customTables, key, rule, false)
 			}
 		}
 	}
 
-	rules := make(map[string]*Rule)
-	for key, rule := range r.rules {
-		if rule.TableInfo, err = r.canal.GetTable(rule.Schema, rule.Table); err != nil {
+	rules := make(map[string][]*Rule)
+	var invalid []string
+	for key, tableRules := range r.rules {
+		first := tableRules[0]
+		tableInfo, err := r.canal.GetTable(first.Schema, first.Table)
+		if err != nil {
 			return errors.Trace(err)
 		}
 
-		if len(rule.TableInfo.PKColumns) == 0 {
+		// the table without a PK can be synced by the id columns or auto_id of the rules
+		if len(tableInfo.PKColumns) == 0 && !rulesHaveID(tableRules) {
 			if !r.c.SkipNoPkTable {
-				return errors.Errorf("%s.%s must have a PK for a column", rule.Schema, rule.Table)
+				return errors.Errorf("%s.%s has no PK, set id for the rules of the table, or skip_no_pk_table", first.Schema, first.Table)
 			}
 
-			log.Errorf("ignored table without a primary key: %s\n", rule.TableInfo.Name)
-		} else {
-			rules[key] = rule
+			log.Errorf("ignored table without a primary key: %s\n", tableInfo.Name)
+			continue
 		}
+
+		for _, rule := range tableRules {
+			rule.addIndexAffix(r.c.IndexPrefix, r.c.IndexSuffix)
+			rule.excludeColumnRegexps = r.c.excludeColumnRegexps
+			if len(rule.Parent) > 0 && r.c.ESVersion >= 7 {
+				return errors.Errorf("parent for rule %s.%s is not supported by ES %d, use a join field with routing instead",
+					rule.Schema, rule.Table, r.c.ESVersion)
+			}
+			if len(rule.DeleteVerifyFields) > 0 && r.c.ESVersion < 7 {
+				return errors.Errorf("delete_verify_fields for rule %s.%s needs es_version 7 or later for if_seq_no",
+					rule.Schema, rule.Table)
+			}
+			if len(rule.TypeColumn) > 0 && r.c.ESVersion >= 7 {
+				return errors.Errorf("type_column for rule %s.%s is not supported by ES %d, sync the column as a field instead",
+					rule.Schema, rule.Table, r.c.ESVersion)
+			}
+		}
+
+		if err = checkRuleIndices(tableRules); err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, rule := range tableRules {
+			rule.TableInfo = tableInfo
+			// check all the rules, so all the typos are found at once
+			if err = rule.checkTable(); err != nil {
+				invalid = append(invalid, err.Error())
+			}
+		}
+		rules[key] = tableRules
+	}
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return errors.Errorf("invalid rules:\n%s", strings.Join(invalid, "\n"))
 	}
 	r.rules = rules
 
 	return nil
 }
 
+// rulesHaveID returns whether all the rules have the id columns or auto_id.
+func rulesHaveID(rules []*Rule) bool {
+	for _, rule := range rules {
+		if len(rule.ID) == 0 && !rule.AutoID {
+			return false
+		}
+	}
+	return true
+}
+
+// addCustomRule adds the custom rule for the table, the first custom rule replaces
+// the default one, and the others are appended to sync the table to more indices.
+// A rule for the table name has precedence over the wildcard table rules,
+// the wildcard rules are ignored for the table.
+func (r *River) addCustomRule(customTables map[string]bool, key string, rule *Rule, wildcard bool) {
+	customWildcard, ok := customTables[key]
+	switch {
+	case !ok || (customWildcard && !wildcard):
+		customTables[key] = wildcard
+		r.rules[key] = []*Rule{rule}
+	case customWildcard == wildcard:
+		r.rules[key] = append(r.rules[key], rule)
+	}
+}
+
+// checkAliases checks the rule indices which are aliases can be written, the bulk to
+// an alias with many indices fails unless one of them is the write index.
+func (r *River) checkAliases() error {
+	checked := make(map[string]struct{})
+	for _, rules := range r.rules {
+		for _, rule := range rules {
+			// the time-based indices are made by the rows
+			if len(rule.IndexPattern) > 0 {
+				continue
+			}
+			if _, ok := checked[rule.Index]; ok {
+				continue
+			}
+			checked[rule.Index] = struct{}{}
+
+			indices, err := r.es.GetAliasIndices(rule.Index)
+			if err != nil {
+				return errors.Annotatef(err, "get alias %s", rule.Index)
+			}
+			if err = checkWriteAlias(rule.Index, indices); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkWriteAlias checks the alias points to exactly one index, or has a write index.
+func checkWriteAlias(alias string, indices map[string]bool) error {
+	if len(indices) <= 1 {
+		return nil
+	}
+
+	names := make([]string, 0, len(indices))
+	for index, write := range indices {
+		if write {
+			log.Infof("alias %s writes to its write index %s", alias, index)
+			return nil
+		}
+		names = append(names, index)
+	}
+	sort.Strings(names)
+
+	return errors.Errorf("alias %s points to %d indices %s without a write index, make it point to one index, or set is_write_index",
+		alias, len(names), strings.Join(names, ", "))
+}
+
+// prepareIndices creates the indices with the rule mapping_file if they don't exist,
+// the existing indices are never changed.
+func (r *River) prepareIndices() error {
+	created := make(map[string]struct{})
+	for _, rules := range r.rules {
+		for _, rule := range rules {
+			if rule.mapping == nil {
+				continue
+			}
+			if _, ok := created[rule.Index]; ok {
+				continue
+			}
+			created[rule.Index] = struct{}{}
+
+			exists, err := r.es.IndexExists(rule.Index)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if exists {
+				log.Infof("index %s exists, skip creating it with mapping file %s", rule.Index, rule.MappingFile)
+				continue
+			}
+
+			if r.c.DryRun {
+				log.Infof("[dry run] create index %s with mapping file %s", rule.Index, rule.MappingFile)
+				continue
+			}
+
+			log.Infof("create index %s with mapping file %s", rule.Index, rule.MappingFile)
+			if err = r.es.CreateIndex(rule.Index, rule.mapping); err != nil {
+				return errors.Annotatef(err, "create index %s", rule.Index)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkRuleIndices checks the rules of one table don't sync to the same index and type.
+func checkRuleIndices(rules []*Rule) error {
+	indices := make(map[string]struct{}, len(rules))
+	for _, rule := range rules {
+		key := rule.Index + "/" + rule.Type
+		if _, ok := indices[key]; ok {
+			return errors.Errorf("duplicate rule for %s.%s to index %s, type %s", rule.Schema, rule.Table, rule.Index, rule.Type)
+		}
+		indices[key] = struct{}{}
+	}
+	return nil
+}
+
 func ruleKey(schema string, table string) string {
 	return strings.ToLower(fmt.Sprintf("%s:%s", schema, table))
 }
 
-// Run syncs the data from MySQL and inserts to ES.
+// Run syncs the data from MySQL and inserts to ES. It blocks until the sync stops by
+// Close or an error, and can only be called once. If it returns an error, the river
+// is cancelled, so Ctx is done, but Close must still be called to send the pending
+// requests and save the position.
 func (r *River) Run() error {
-	r.wg.Add(1)
+	if !atomic.CompareAndSwapInt32(&r.running, 0, 1) {
+		return errors.Trace(ErrRiverRunning)
+	}
+	// Close waits Run to return
+	if err := r.addWorker(1); err != nil {
+		return err
+	}
+	defer r.wg.Done()
+
+	err := r.run()
+	if err != nil {
+		r.cancel()
+	}
+	return err
+}
+
+func (r *River) run() error {
+	if !r.c.DryRun {
+		if err := r.checkAliases(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if err := r.prepareIndices(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := r.addWorker(2); err != nil {
+		return errors.Trace(err)
+	}
 	canalSyncState.Set(float64(1))
 	go r.syncLoop()
+	go r.collectMetrics()
 
-	pos := r.master.Position()
-	if err := r.canal.RunFrom(pos); err != nil {
-		log.Errorf("start canal err %v", err)
-		canalSyncState.Set(0)
-		return errors.Trace(err)
+	var err error
+	pos, gset := r.master.Position(), r.startGTID
+	if r.needDump() {
+		if r.dumpState != nil || r.c.DumpWorkers > 1 {
+			if pos, gset, err = r.dumpTables(); err != nil {
+				log.Error(logMsg(logFields{"error": err}, "dump tables err %v", err))
+				canalSyncState.Set(0)
+				return errors.Trace(err)
+			}
+		} else {
+			if r.addWorker(1) == nil {
+				go r.watchDump(r.canal.WaitDumpDone())
+			}
+
+			// the canal gets the GTID set before the dump if starting from an empty set
+			if r.c.GTIDMode {
+				if gset, err = mysql.ParseGTIDSet(r.c.gtidFlavor(), ""); err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+	} else if r.dumpState != nil {
+		// the position may be saved but the state is not removed before a crash
+		if err := r.dumpState.remove(); err != nil {
+			log.Errorf("remove dump state err %v", err)
+			return errors.Trace(err)
+		}
 	}
 
-	return nil
+	return r.runCanal(pos, gset)
+}
+
+// SetBulkDocsPerSecond changes the limit of the documents sent to ES per second at runtime,
+// 0 means no limit.
+func (r *River) SetBulkDocsPerSecond(n int) {
+	r.limiter.setRate(n)
 }
 
-// Ctx returns the internal context for outside use.
+// SetDocumentTransformer sets the transformer for the documents, it must be called before Run.
+func (r *River) SetDocumentTransformer(t DocumentTransformer) {
+	r.transformer = t
+}
+
+// Subscribe returns a channel receiving every batch of the bulk requests before sending
+// them to ES, it must be called before Run. The delivery is best effort: the batch is
+// dropped for the subscriber if the channel with size buffer is full, so a slow consumer
+// never stalls the sync, and the batches may be received again after restart because the
+// position is saved later. The requests are shared, so don't modify them. The channel is
+// closed when the sync is closed.
+func (r *River) Subscribe(size int) <-chan []*elastic.BulkRequest {
+	ch := make(chan []*elastic.BulkRequest, size)
+	r.subscribers = append(r.subscribers, ch)
+	return ch
+}
+
+// Position returns the saved binlog position and the executed GTID set for gtid_mode,
+// all the events before it are synced to ES.
+func (r *River) Position() (mysql.Position, string) {
+	return r.master.Position(), r.master.GTIDSet()
+}
+
+// PendingDocs returns the number of the requests waiting in the sync loop to be sent
+// to ES, the same as pending_num of the status, e.g, for the health checks.
+func (r *River) PendingDocs() int64 {
+	return atomic.LoadInt64(&r.pendingNum)
+}
+
+// Ctx returns the internal context for outside use, it's done when the river is
+// closed or the sync stops for an error.
 func (r *River) Ctx() context.Context {
 	return r.ctx
 }
 
-// Close closes the River
+// Close stops the sync, sends the pending requests and saves the position, then closes
+// the connections. It waits Run to stop, and can be called more than once, even if
+// Run is not called.
 func (r *River) Close() {
+	r.closeOnce.Do(r.close)
+}
+
+func (r *River) close() {
 	log.Infof("closing river")
 
 	r.cancel()
+	// wait the running addWorker, no goroutine is added after it
+	r.workerMu.Lock()
+	r.workerMu.Unlock()
 
-	r.canal.Close()
+	if r.statServer != nil {
+		r.statServer.Close()
+	}
 
-	r.master.Close()
+	// the canal is read after cancel, so it is not replaced by a reconnection any more
+	r.closeCanal()
 
+	// wait Run to return and the sync loop to flush the pending requests before
+	// saving the position
 	r.wg.Wait()
+
+	r.master.Close()
+}
+
+// addWorker adds n goroutines for Close to wait, it returns ErrRiverClosed if the
+// river is closed, so the goroutines must not be started.
+func (r *River) addWorker(n int) error {
+	r.workerMu.Lock()
+	defer r.workerMu.Unlock()
+
+	if r.ctx.Err() != nil {
+		return errors.Trace(ErrRiverClosed)
+	}
+	r.wg.Add(n)
+	return nil
+}
+
+// newTLSConfig creates the TLS configuration, the CA certificate is optional.
+func newTLSConfig(caCert string, insecureSkipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+
+	if len(caCert) > 0 {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no valid certificate in CA file %s", caCert)
+		}
+	}
+
+	return cfg, nil
 }
 
 func isValidTables(tables []string) bool {
@@ -3,10 +3,17 @@ package river
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/juju/errors"
 	. "github.com/pingcap/check"
 	"github.com/siddontang/go-mysql-elasticsearch/elastic"
 	"github.com/siddontang/go-mysql/client"
@@ -100,7 +107,7 @@ func (s *riverTestSuite) SetUpSuite(c *C) {
 			Table:        "test_river",
 			Index:        "river",
 			Type:         "river",
-			FieldMapping: map[string]string{"title": "es_title", "mylist": "es_mylist,list", "mydate": ",date"},
+			FieldMapping: map[string]FieldTargets{"title": {"es_title"}, "mylist": {"es_mylist,list"}, "mydate": {",date"}},
 		},
 
 		&Rule{Schema: "test",
@@ -108,14 +115,14 @@ func (s *riverTestSuite) SetUpSuite(c *C) {
 			Index:        "river",
 			Type:         "river",
 			ID:           []string{"id", "title"},
-			FieldMapping: map[string]string{"title": "es_title", "mylist": "es_mylist,list", "mydate": ",date"},
+			FieldMapping: map[string]FieldTargets{"title": {"es_title"}, "mylist": {"es_mylist,list"}, "mydate": {",date"}},
 		},
 
 		&Rule{Schema: "test",
 			Table:        "test_river_[0-9]{4}",
 			Index:        "river",
 			Type:         "river",
-			FieldMapping: map[string]string{"title": "es_title", "mylist": "es_mylist,list", "mydate": ",date"},
+			FieldMapping: map[string]FieldTargets{"title": {"es_title"}, "mylist": {"es_mylist,list"}, "mydate": {",date"}},
 		},
 
 		&Rule{Schema: "test",
@@ -261,20 +268,8 @@ func (s *riverTestSuite) testElasticMapping(c *C) *elastic.MappingResponse {
 }
 
 func testWaitSyncDone(c *C, r *River) {
-	<-r.canal.WaitDumpDone()
-
-	err := r.canal.CatchMasterPos(10 * time.Second)
+	err := r.WaitSynced(10*time.Second, 10*time.Millisecond)
 	c.Assert(err, IsNil)
-
-	for i := 0; i < 1000; i++ {
-		if len(r.syncCh) == 0 {
-			return
-		}
-
-		time.Sleep(10 * time.Millisecond)
-	}
-
-	c.Fatalf("wait 1s but still have %d items to be synced", len(r.syncCh))
 }
 
 func (s *riverTestSuite) TestRiver(c *C) {
@@ -292,7 +287,7 @@ func (s *riverTestSuite) TestRiver(c *C) {
 	r = s.testElasticGet(c, "1")
 	c.Assert(r.Found, IsTrue)
 	c.Assert(r.Source["tenum"], Equals, "e1")
-	c.Assert(r.Source["tset"], Equals, "a,b")
+	c.Assert(r.Source["tset"], DeepEquals, []interface{}{"a", "b"})
 
 	r = s.testElasticGet(c, "1:first")
 	c.Assert(r.Found, IsTrue)
@@ -344,14 +339,14 @@ func (s *riverTestSuite) TestRiver(c *C) {
 	c.Assert(r.Found, IsTrue)
 	c.Assert(r.Source["es_title"], Equals, "second 2")
 	c.Assert(r.Source["tenum"], Equals, "e3")
-	c.Assert(r.Source["tset"], Equals, "a,b,c")
+	c.Assert(r.Source["tset"], DeepEquals, []interface{}{"a", "b", "c"})
 	c.Assert(r.Source["es_mylist"], DeepEquals, []interface{}{"a", "b", "c"})
 	c.Assert(r.Source["tbit"], Equals, float64(1))
 
 	r = s.testElasticGet(c, "4")
 	c.Assert(r.Found, IsTrue)
 	c.Assert(r.Source["tenum"], Equals, "")
-	c.Assert(r.Source["tset"], Equals, "a,b,c")
+	c.Assert(r.Source["tset"], DeepEquals, []interface{}{"a", "b", "c"})
 	c.Assert(r.Source["tbit"], Equals, float64(0))
 
 	r = s.testElasticGet(c, "3")
@@ -433,3 +428,339 @@ func TestBuildTable(t *testing.T) {
 		}
 	}
 }
+
+func TestConfigPrepare(t *testing.T) {
+	cfg := new(Config)
+	if err := cfg.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.BulkSize != defaultBulkSize {
+		t.Errorf("BulkSize Expected: is %d, but: was %d", defaultBulkSize, cfg.BulkSize)
+	}
+	if cfg.FlushBulkTime.Duration != defaultFlushBulkTime {
+		t.Errorf("FlushBulkTime Expected: is %s, but: was %s", defaultFlushBulkTime, cfg.FlushBulkTime.Duration)
+	}
+	if cfg.DumpWorkers != 1 {
+		t.Errorf("DumpWorkers Expected: is 1, but: was %d", cfg.DumpWorkers)
+	}
+	if cfg.MyCharset != defaultMyCharset {
+		t.Errorf("MyCharset Expected: is %s, but: was %s", defaultMyCharset, cfg.MyCharset)
+	}
+
+	cfg.FlushBulkTime = TomlDuration{-time.Second}
+	if err := cfg.prepare(); err == nil {
+		t.Error("Expected: an error for negative flush_bulk_time, but: was nil")
+	}
+
+	cfg.FlushBulkTime = TomlDuration{}
+	cfg.ESVersion = -1
+	if err := cfg.prepare(); err == nil {
+		t.Error("Expected: an error for negative es_version, but: was nil")
+	}
+
+	cfg.ESVersion = 0
+	cfg.PositionStore = positionStoreES
+	if err := cfg.prepare(); err == nil {
+		t.Error("Expected: an error for position_store es without server_id, but: was nil")
+	}
+
+	cfg.ServerID = 1001
+	if err := cfg.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PositionIndex != defaultPositionIndex {
+		t.Errorf("PositionIndex Expected: is %s, but: was %s", defaultPositionIndex, cfg.PositionIndex)
+	}
+
+	cfg.PositionStore = "etcd"
+	if err := cfg.prepare(); err == nil {
+		t.Error("Expected: an error for unknown position_store, but: was nil")
+	}
+
+	cfg.PositionStore = ""
+	cfg.StartBinName = "mysql-bin.000001"
+	if err := cfg.prepare(); err == nil {
+		t.Error("Expected: an error for start_bin_name without start_bin_pos, but: was nil")
+	}
+
+	cfg.StartBinPos = 4
+	cfg.StartGTID = "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5"
+	if err := cfg.prepare(); err == nil {
+		t.Error("Expected: an error for both start_bin_name and start_gtid, but: was nil")
+	}
+
+	cfg.StartGTID = ""
+	cfg.DumpWorkers = 4
+	if err := cfg.prepare(); err == nil {
+		t.Error("Expected: an error for the start position with dump_workers, but: was nil")
+	}
+
+	cfg.DumpWorkers = 1
+	cfg.StartBinName, cfg.StartBinPos = "", 0
+	cfg.StartGTID = "invalid"
+	if err := cfg.prepare(); err == nil {
+		t.Error("Expected: an error for invalid start_gtid, but: was nil")
+	}
+
+	cfg.StartGTID = ""
+	for _, table := range []string{"test", "test.", ".t1", "test.t1.t2"} {
+		cfg.DenyTables = []string{table}
+		if err := cfg.prepare(); err == nil {
+			t.Errorf("Expected: an error for deny_tables %q, but: was nil", table)
+		}
+	}
+
+	cfg.DenyTables = nil
+	cfg.ExcludeColumnPatterns = []string{"created_(by"}
+	if err := cfg.prepare(); err == nil {
+		t.Error("Expected: an error for invalid exclude_column_patterns, but: was nil")
+	}
+}
+
+func TestAddCustomRule(t *testing.T) {
+	r := new(River)
+	r.rules = map[string][]*Rule{"test:orders_2021": {newDefaultRule("test", "orders_2021")}}
+
+	customTables := make(map[string]bool)
+	wildcard := &Rule{Index: "orders"}
+	wildcard2 := &Rule{Index: "orders_all"}
+	explicit := &Rule{Index: "orders_2021"}
+
+	r.addCustomRule(customTables, "test:orders_2021", wildcard, true)
+	r.addCustomRule(customTables, "test:orders_2021", wildcard2, true)
+	if rules := r.rules["test:orders_2021"]; len(rules) != 2 || rules[0] != wildcard || rules[1] != wildcard2 {
+		t.Errorf("Expected: is the wildcard rules, but: was %+v", rules)
+	}
+
+	// the table rule always has precedence
+	r.addCustomRule(customTables, "test:orders_2021", explicit, false)
+	r.addCustomRule(customTables, "test:orders_2021", wildcard, true)
+	if rules := r.rules["test:orders_2021"]; len(rules) != 1 || rules[0] != explicit {
+		t.Errorf("Expected: is the table rule, but: was %+v", rules)
+	}
+}
+
+func TestPrepareIndices(t *testing.T) {
+	var createNum int32
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == "HEAD" && req.URL.Path == "/exists":
+		case req.Method == "HEAD":
+			w.WriteHeader(http.StatusNotFound)
+		case req.Method == "PUT" && req.URL.Path == "/river":
+			atomic.AddInt32(&createNum, 1)
+			w.Write([]byte(`{"acknowledged":true}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	defer closeFn()
+
+	dir, err := ioutil.TempDir("", "mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mappingFile := path.Join(dir, "river.json")
+	if err = ioutil.WriteFile(mappingFile, []byte(`{"mappings":{"properties":{"created":{"type":"date"}}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r.rules = make(map[string][]*Rule)
+	for _, index := range []string{"river", "river", "exists"} {
+		rule := newDefaultRule("test", index)
+		rule.MappingFile = mappingFile
+		if err = rule.prepare(); err != nil {
+			t.Fatal(err)
+		}
+		key := ruleKey("test", index)
+		r.rules[key] = append(r.rules[key], rule)
+	}
+
+	if err = r.prepareIndices(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&createNum); n != 1 {
+		t.Errorf("Expected: is only creating river once, but: was %d", n)
+	}
+
+	rule := newDefaultRule("test", "river")
+	rule.MappingFile = path.Join(dir, "not_exists.json")
+	if err = rule.prepare(); err == nil {
+		t.Error("Expected: an error for not existing mapping file, but: was nil")
+	}
+}
+
+func TestSeedPosition(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {})
+	defer closeFn()
+
+	r.c.DumpExec = "mysqldump"
+	r.c.StartBinName, r.c.StartBinPos = "mysql-bin.000002", 120
+	if err := r.seedPosition(); err != nil {
+		t.Fatal(err)
+	}
+
+	seed := mysql.Position{Name: "mysql-bin.000002", Pos: 120}
+	if pos := r.master.Position(); pos != seed {
+		t.Errorf("Position Expected: is %s, but: was %s", seed, pos)
+	}
+	if r.needDump() {
+		t.Error("Expected: no dump with the start position, but: was dumped")
+	}
+
+	// the saved position is used
+	saved := mysql.Position{Name: "mysql-bin.000003", Pos: 4}
+	r.master.Save(saved, nil)
+	r.c.StartBinName, r.c.StartBinPos = "", 0
+	r.c.StartGTID = "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5"
+	if err := r.seedPosition(); err != nil {
+		t.Fatal(err)
+	}
+	if pos := r.master.Position(); pos != saved || r.startGTID != nil {
+		t.Errorf("Position Expected: is %s, but: was %s, GTID %v", saved, pos, r.startGTID)
+	}
+
+	r.master.Save(mysql.Position{}, nil)
+	if err := r.seedPosition(); err != nil {
+		t.Fatal(err)
+	}
+	if r.startGTID == nil || r.needDump() {
+		t.Errorf("Expected: sync from the GTID set without dump, but: was %v", r.startGTID)
+	}
+}
+
+func TestWildcardRuleDenyTables(t *testing.T) {
+	r := new(River)
+	r.c = &Config{DenyTables: []string{"test.T_internal"}}
+	r.rules = make(map[string][]*Rule)
+	r.denyTables = map[string]struct{}{ruleKey("test", "T_internal"): {}}
+
+	// the tables matched by the wildcard table test.t_.*
+	tables, err := r.newWildRules("test", []string{"t_1", "t_internal", "t_2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"t_1", "t_2"}; !reflect.DeepEqual(tables, expected) {
+		t.Errorf("Tables Expected: is %v, but: was %v", expected, tables)
+	}
+	// the denied table has no rule, so it's not dumped
+	if _, ok := r.rules[ruleKey("test", "t_internal")]; ok || len(r.rules) != 2 {
+		t.Errorf("Rules Expected: are test.t_1 and test.t_2, but: was %v", r.rules)
+	}
+
+	// the canal ignores the rows of the denied table
+	cfg := r.newCanalConfig()
+	if expected := []string{`(?i)^test\.T_internal$`}; !reflect.DeepEqual(cfg.ExcludeTableRegex, expected) {
+		t.Errorf("ExcludeTableRegex Expected: is %v, but: was %v", expected, cfg.ExcludeTableRegex)
+	}
+}
+
+func TestPingES(t *testing.T) {
+	var pingNum int32
+	code := http.StatusServiceUnavailable
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		// ES is ready at the third ping
+		if atomic.AddInt32(&pingNum, 1) >= 3 {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(code)
+		}
+		w.Write([]byte(`{}`))
+	})
+	defer closeFn()
+
+	if err := r.pingES(3, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&pingNum); n != 3 {
+		t.Errorf("Expected: is 3 pings, but: was %d", n)
+	}
+
+	atomic.StoreInt32(&pingNum, 0)
+	if err := r.pingES(1, time.Millisecond); err == nil {
+		t.Error("Expected: an error after the retries, but: was nil")
+	}
+
+	// the credentials are not retried
+	atomic.StoreInt32(&pingNum, -10)
+	code = http.StatusUnauthorized
+	if err := r.pingES(3, time.Millisecond); errors.Cause(err) != elastic.ErrUnauthorized {
+		t.Errorf("Expected: is %v, but: was %v", elastic.ErrUnauthorized, err)
+	}
+	if n := atomic.LoadInt32(&pingNum); n != -9 {
+		t.Errorf("Expected: is 1 ping, but: was %d", n+10)
+	}
+}
+
+func TestCheckAliases(t *testing.T) {
+	aliases := map[string]string{
+		"/_alias/one":   `{"one_v1":{"aliases":{"one":{}}}}`,
+		"/_alias/write": `{"write_v1":{"aliases":{"write":{}}},"write_v2":{"aliases":{"write":{"is_write_index":true}}}}`,
+		"/_alias/many":  `{"many_v1":{"aliases":{"many":{}}},"many_v2":{"aliases":{"many":{}}}}`,
+	}
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		if body, ok := aliases[req.URL.Path]; ok {
+			w.Write([]byte(body))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"status":404}`))
+	})
+	defer closeFn()
+
+	ta := newTestTable([]string{"id"}, "id", "int")
+	newRule := func(index string) *Rule {
+		rule := newTestRule(ta)
+		rule.Index = index
+		return rule
+	}
+
+	r.rules = map[string][]*Rule{"test:t1": {newRule("one"), newRule("write"), newRule("not_alias")}}
+	if err := r.checkAliases(); err != nil {
+		t.Fatal(err)
+	}
+
+	r.rules["test:t2"] = []*Rule{newRule("many")}
+	err := r.checkAliases()
+	if err == nil || !strings.Contains(err.Error(), "many_v1, many_v2") {
+		t.Errorf("Expected: an error for the alias of many indices, but: was %v", err)
+	}
+}
+
+func TestRandomServerID(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		if id := randomServerID(); id <= 1000 {
+			t.Errorf("Expected: is greater than 1000, but: was %d", id)
+		}
+	}
+}
+
+func TestRunLifecycle(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {})
+	defer closeFn()
+
+	pos := mysql.Position{Name: "mysql-bin.000003", Pos: 4}
+	r.master.Save(pos, nil)
+	if p, gtid := r.Position(); p != pos || len(gtid) > 0 {
+		t.Errorf("Expected: is %s, but: was %s, %q", pos, p, gtid)
+	}
+
+	if err := r.addWorker(1); err != nil {
+		t.Fatal(err)
+	}
+	r.wg.Done()
+
+	r.cancel()
+	if err := r.addWorker(1); errors.Cause(err) != ErrRiverClosed {
+		t.Errorf("Expected: is ErrRiverClosed after closing, but: was %v", err)
+	}
+	if err := r.Run(); errors.Cause(err) != ErrRiverClosed {
+		t.Errorf("Expected: is ErrRiverClosed for Run after closing, but: was %v", err)
+	}
+	if err := r.Run(); errors.Cause(err) != ErrRiverRunning {
+		t.Errorf("Expected: is ErrRiverRunning for Run again, but: was %v", err)
+	}
+}
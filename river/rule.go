@@ -1,11 +1,103 @@
 package river
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"text/template"
 
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
 	"github.com/siddontang/go-mysql/schema"
 )
 
+const defaultIDSeparator = ":"
+
+const defaultSoftDeleteField = "deleted"
+
+const defaultListSeparator = ","
+
+const (
+	// idStrategySeparator joins the id column values with IDSeparator, it's the default strategy.
+	idStrategySeparator = "separator"
+	// idStrategyConcat joins the id column values without any separator.
+	idStrategyConcat = "concat"
+	// idStrategyHash uses the SHA-1 hex of the length-prefixed id column values,
+	// so different values never make the same id even if they contain the separator.
+	idStrategyHash = "hash"
+)
+
+const (
+	// idNormalizeLower lowercases the id column values.
+	idNormalizeLower = "lower"
+	// idNormalizeTrim trims the leading and trailing spaces of the id column values.
+	idNormalizeTrim = "trim"
+)
+
+// The metadata of the rows event for MetaFields.
+const (
+	// metaFieldAction is the row action, "insert" or "update", the deletes have no doc.
+	metaFieldAction = "action"
+	// metaFieldBinlogName and metaFieldBinlogPos are the binlog position of the rows event,
+	// they are not added for the dump.
+	metaFieldBinlogName = "binlog_name"
+	metaFieldBinlogPos  = "binlog_pos"
+	// metaFieldTimestamp is the unix timestamp of the rows event, not added for the dump.
+	metaFieldTimestamp = "timestamp"
+)
+
+const (
+	// updateModeUpdate updates the changed columns only, it's the default mode.
+	updateModeUpdate = "update"
+	// updateModeUpsert updates the doc with all columns, and inserts it if not exists.
+	updateModeUpsert = "upsert"
+	// updateModeIndex reindexes the whole doc with all columns.
+	updateModeIndex = "index"
+)
+
+const (
+	// writeModeIndex indexes the whole doc for the MySQL INSERT event, it's the default mode.
+	writeModeIndex = "index"
+	// writeModeUpdate merges the row into the doc with an upsert, so the fields only in ES are kept.
+	writeModeUpdate = "update"
+)
+
+const (
+	// binaryModeSkip doesn't sync the binary columns, it's the default mode.
+	binaryModeSkip = "skip"
+	// binaryModeBase64 syncs the binary columns as base64 strings.
+	binaryModeBase64 = "base64"
+	// binaryModeHex syncs the binary columns as hex strings.
+	binaryModeHex = "hex"
+	// binaryModeString syncs the binary columns as strings, the invalid UTF-8 bytes are replaced.
+	binaryModeString = "string"
+)
+
+const (
+	// maskSHA256 replaces the value with the SHA-256 hex of MaskSalt and the value.
+	maskSHA256 = "sha256"
+	// maskLast4 keeps the last 4 characters and replaces the others with "*",
+	// all the characters are replaced if no more than 4.
+	maskLast4 = "last4"
+	// maskNull replaces the value with NULL.
+	maskNull = "null"
+)
+
+const (
+	// nullValueModeNull sets the ES field to null, it's the default mode.
+	nullValueModeNull = "null"
+	// nullValueModeSkip doesn't set the ES field, so the old value is kept for update.
+	nullValueModeSkip = "skip"
+	// nullValueModeDefault sets the ES field to the NullValue.
+	nullValueModeDefault = "default"
+)
+
 // Rule is the rule for how to sync data from MySQL to ES.
 // If you want to sync MySQL data into elasticsearch, you must set a rule to let use know how to do it.
 // The mapping rule may thi: schema + table <-> index + document type.
@@ -18,10 +110,46 @@ type Rule struct {
 	Parent string   `toml:"parent"`
 	ID     []string `toml:"id"`
 
+	// IDFormat formats the ES doc id with the PK or id columns, like "{tenant_id}-{id}",
+	// if empty, the column values are joined with IDSeparator.
+	IDFormat string `toml:"id_format"`
+
+	// RoutingColumn is the column whose value is used as the ES routing,
+	// so the docs with the same value are stored in the same shard.
+	RoutingColumn string `toml:"routing_column"`
+	// nullRoutingWarned is set atomically after the first NULL routing value is warned
+	nullRoutingWarned int32
+
+	// TypeColumn is the column whose value is used as the ES doc type, like the
+	// discriminator column of the single table inheritance. Type is used if the value
+	// is NULL or empty.
+	TypeColumn string `toml:"type_column"`
+
+	// IDSeparator is used to join the PK or id column values into the ES doc id,
+	// default is ":". Use another one if the column values may contain ":".
+	IDSeparator string `toml:"id_separator"`
+
+	// IDStrategy is how to make the ES doc id with the PK or id column values,
+	// "separator", "concat" or "hash", see the id strategies above.
+	IDStrategy string `toml:"id_strategy"`
+
+	// IDNormalize normalizes the string id column values before making the ES doc id,
+	// "lower" and "trim", e.g, for the case-insensitive collation of the PK.
+	IDNormalize []string `toml:"id_normalize"`
+
+	// AutoID omits the doc id, so ES generates one for every inserted row, e.g, for the
+	// append-only tables without a natural id. The updates and deletes can't find the doc,
+	// so they must be ignored by IgnoreEvents.
+	AutoID bool `toml:"auto_id"`
+
 	// Default, a MySQL table field name is mapped to Elasticsearch field name.
 	// Sometimes, you want to use different name, e.g, the MySQL file name is title,
 	// but in Elasticsearch, you want to name it my_title.
-	FieldMapping map[string]string `toml:"field"`
+	// A field can be mapped to many Elasticsearch fields by a list, like ["email", "email_search"].
+	FieldMapping map[string]FieldTargets `toml:"field"`
+
+	// The separator to split the column with the "list" modifier, "," by default.
+	ListSeparator map[string]string `toml:"list_separator"`
 
 	// MySQL table information
 	TableInfo *schema.Table
@@ -29,9 +157,124 @@ type Rule struct {
 	//only MySQL fields in filter will be synced , default sync all fields
 	Filter []string `toml:"filter"`
 
+	// Only columns in include_columns will be synced, and columns in exclude_columns
+	// will never be synced. The PK columns are still used for the doc id even excluded.
+	IncludeColumns []string `toml:"include_columns"`
+	ExcludeColumns []string `toml:"exclude_columns"`
+
+	// only MySQL rows matching the where condition will be synced, default sync all rows.
+	// see parseWhere for the supported syntax.
+	Where string `toml:"where"`
+	where whereExpr
+
+	// How to sync the MySQL UPDATE event, "update" (default), "upsert" or "index".
+	UpdateMode string `toml:"update_mode"`
+
+	// How to write the rows of the MySQL INSERT event, and the moved docs of the UPDATE event,
+	// "index" (default) or "update".
+	WriteMode string `toml:"write_mode"`
+
+	// How to sync the NULL column value, "null" (default), "skip" or "default".
+	// For "default", the NullValue is used instead.
+	NullValueMode string      `toml:"null_value_mode"`
+	NullValue     interface{} `toml:"null_value"`
+
 	// Elasticsearch pipeline
 	// To pre-process documents before indexing
 	Pipeline string `toml:"pipeline"`
+
+	// Sync the rows into the time-based indices like "logs-{YYYY}.{MM}.{DD}",
+	// the date placeholders are expanded with the IndexDateColumn value of the row.
+	// Supported placeholders are {YYYY}, {MM}, {DD} and {HH}.
+	IndexPattern    string `toml:"index_pattern"`
+	IndexDateColumn string `toml:"index_date_column"`
+
+	// The integer column used as the ES external version, so the replayed events
+	// can't overwrite the newer docs. The updates are always synced with the index action.
+	VersionColumn string `toml:"version_column"`
+
+	// DeleteVerifyFields makes the deletes conditional without a version_column: before a
+	// doc is deleted, the fields are got from ES and compared with the deleted row, and the
+	// doc is deleted with if_seq_no only if they still match, so a newer doc, like the one
+	// recreated by a resync, is not deleted. It needs ES 7 or later.
+	DeleteVerifyFields []string `toml:"delete_verify_fields"`
+
+	// DeleteByQueryField makes a deleted row delete its doc and all the docs of the index
+	// with the field set to the doc id by a delete-by-query, e.g, the children docs with
+	// the parent id, instead of deleting the doc by id.
+	DeleteByQueryField string `toml:"delete_by_query_field"`
+
+	// SoftDeleteColumn is the column like deleted_at marking the row deleted if not NULL,
+	// the doc is kept with the SoftDeleteField set to true instead of being deleted.
+	// Deleting the row still deletes the doc.
+	SoftDeleteColumn string `toml:"soft_delete_column"`
+	SoftDeleteField  string `toml:"soft_delete_field"`
+
+	// GeoPoints combines the latitude and longitude columns into the geo_point fields,
+	// keyed by the ES field names.
+	GeoPoints map[string]GeoPoint `toml:"geo_point"`
+
+	// MetaFields adds the metadata of the rows event to the doc, keyed by the metadata
+	// "action", "binlog_name", "binlog_pos" or "timestamp", the value is the ES field name.
+	MetaFields map[string]string `toml:"meta_field"`
+
+	// HistoryIndex makes every update of a row also index a new history doc into the index,
+	// with the changed columns and their old and new values, e.g, for the audit trails.
+	HistoryIndex string `toml:"history_index"`
+
+	// IgnoreEvents are the binlog row events not synced, "insert", "update" or "delete",
+	// e.g, ignore "delete" to protect the append-only indices.
+	IgnoreEvents []string `toml:"ignore_events"`
+
+	// NestUnder nests all the fields of the row under the object field in the doc, like
+	// "data", after the field mapping, templates and the document transformer, so the
+	// top level is left for the meta fields.
+	NestUnder string `toml:"nest_under"`
+
+	// Templates computes the ES fields with Go text/template after the columns are copied,
+	// the template data has the column values and the mapped fields, e.g,
+	// full_name = "{{.first_name}} {{.last_name}}"
+	Templates map[string]string `toml:"template"`
+	templates []fieldTemplate
+
+	// JSONPaths extracts the values of the JSON paths into the ES fields, keyed by the field,
+	// the value is the column and the path like "metadata.$.address.country". The column
+	// is read even if it's not synced, so the whole JSON can be filtered out.
+	JSONPaths map[string]string `toml:"json_path"`
+	jsonPaths []jsonPathField
+
+	// ValueMapping replaces the column values, like mapping the status code 0 to "draft".
+	// The key is the column name, the raw value key is the value in string.
+	// The unmapped values are not changed.
+	ValueMapping map[string]map[string]interface{} `toml:"value_mapping"`
+
+	// Mask replaces the values of the sensitive columns before making the doc, so the raw
+	// values are never sent to ES, the key is the column name, the value is the mask
+	// strategy, see the masks above. MaskSalt is prepended to the value for sha256.
+	Mask     map[string]string `toml:"mask"`
+	MaskSalt string            `toml:"mask_salt"`
+
+	// The tinyint(1) columns are synced as booleans, unless TinyInt1AsNumber is set.
+	TinyInt1AsNumber bool `toml:"tinyint1_as_number"`
+
+	// BinaryMode is how to sync the BINARY, VARBINARY and BLOB columns, see the binary modes above.
+	BinaryMode string `toml:"binary_mode"`
+	// the binary columns not synced for the skip mode, and the columns matching
+	// excludeColumnRegexps
+	skippedColumns map[string]bool
+	// the global exclude_column_patterns
+	excludeColumnRegexps []*regexp.Regexp
+
+	// The JSON file with the index settings and mappings, which is used to create
+	// the index before syncing if the index doesn't exist.
+	MappingFile string `toml:"mapping_file"`
+	mapping     map[string]interface{}
+}
+
+// fieldTemplate is the parsed template for the ES field.
+type fieldTemplate struct {
+	field string
+	tmpl  *template.Template
 }
 
 func newDefaultRule(schema string, table string) *Rule {
@@ -44,14 +287,37 @@ func newDefaultRule(schema string, table string) *Rule {
 	r.Index = lowerTable
 	r.Type = lowerTable
 
-	r.FieldMapping = make(map[string]string)
+	r.FieldMapping = make(map[string]FieldTargets)
+	r.IDSeparator = defaultIDSeparator
+	r.IDStrategy = idStrategySeparator
+	r.UpdateMode = updateModeUpdate
+	r.NullValueMode = nullValueModeNull
+	r.BinaryMode = binaryModeSkip
 
 	return r
 }
 
 func (r *Rule) prepare() error {
 	if r.FieldMapping == nil {
-		r.FieldMapping = make(map[string]string)
+		r.FieldMapping = make(map[string]FieldTargets)
+	}
+
+	for k, sep := range r.ListSeparator {
+		if len(sep) == 0 {
+			return errors.Errorf("list_separator of field %s must not be empty", k)
+		}
+	}
+
+	for k, targets := range r.FieldMapping {
+		if len(targets) == 0 {
+			return errors.Errorf("field %s must be mapped to at least one field", k)
+		}
+		// the empty name means the same name, which is ambiguous for many fields
+		for _, v := range targets {
+			if len(targets) > 1 && len(strings.Split(v, ",")[0]) == 0 {
+				return errors.Errorf("field %s is mapped to an empty field name in %v", k, targets)
+			}
+		}
 	}
 
 	if len(r.Index) == 0 {
@@ -62,24 +328,595 @@ func (r *Rule) prepare() error {
 		r.Type = r.Index
 	}
 
+	if len(r.IDSeparator) == 0 {
+		r.IDSeparator = defaultIDSeparator
+	}
+
+	switch r.IDStrategy {
+	case "":
+		r.IDStrategy = idStrategySeparator
+	case idStrategySeparator, idStrategyConcat, idStrategyHash:
+		if r.IDStrategy != idStrategySeparator && len(r.IDFormat) > 0 {
+			return errors.Errorf("id_strategy %s can't be used with id_format for rule %s.%s", r.IDStrategy, r.Schema, r.Table)
+		}
+	default:
+		return errors.Errorf("invalid id_strategy %s for rule %s.%s", r.IDStrategy, r.Schema, r.Table)
+	}
+
+	for _, v := range r.IDNormalize {
+		if v != idNormalizeLower && v != idNormalizeTrim {
+			return errors.Errorf("invalid id_normalize %s for rule %s.%s", v, r.Schema, r.Table)
+		}
+	}
+
+	for _, event := range r.IgnoreEvents {
+		switch event {
+		case canal.InsertAction, canal.UpdateAction, canal.DeleteAction:
+		default:
+			return errors.Errorf("invalid ignore_events %s for rule %s.%s", event, r.Schema, r.Table)
+		}
+	}
+	if containsString(r.IgnoreEvents, canal.InsertAction) && containsString(r.IgnoreEvents, canal.UpdateAction) &&
+		containsString(r.IgnoreEvents, canal.DeleteAction) {
+		return errors.Errorf("ignore_events can't ignore all the events for rule %s.%s", r.Schema, r.Table)
+	}
+
+	for _, name := range strings.Split(r.NestUnder, ".") {
+		if len(r.NestUnder) > 0 && len(name) == 0 {
+			return errors.Errorf("invalid nest_under %s for rule %s.%s", r.NestUnder, r.Schema, r.Table)
+		}
+	}
+
+	if r.AutoID {
+		if !containsString(r.IgnoreEvents, canal.UpdateAction) || !containsString(r.IgnoreEvents, canal.DeleteAction) {
+			return errors.Errorf("auto_id needs ignore_events update and delete for rule %s.%s, the docs can't be found by id",
+				r.Schema, r.Table)
+		}
+		if len(r.ID) > 0 || len(r.IDFormat) > 0 || len(r.VersionColumn) > 0 || r.WriteMode == writeModeUpdate {
+			return errors.Errorf("auto_id can't be used with id, id_format, version_column or write_mode update for rule %s.%s",
+				r.Schema, r.Table)
+		}
+	}
+
+	for k, field := range r.MetaFields {
+		switch k {
+		case metaFieldAction, metaFieldBinlogName, metaFieldBinlogPos, metaFieldTimestamp:
+		default:
+			return errors.Errorf("invalid meta_field %s for rule %s.%s", k, r.Schema, r.Table)
+		}
+		if len(field) == 0 {
+			return errors.Errorf("meta_field %s must have a field name for rule %s.%s", k, r.Schema, r.Table)
+		}
+	}
+
+	if len(r.SoftDeleteColumn) > 0 && len(r.SoftDeleteField) == 0 {
+		r.SoftDeleteField = defaultSoftDeleteField
+	}
+
+	switch r.BinaryMode {
+	case "":
+		r.BinaryMode = binaryModeSkip
+	case binaryModeSkip, binaryModeBase64, binaryModeHex, binaryModeString:
+	default:
+		return errors.Errorf("invalid binary_mode %s for rule %s.%s", r.BinaryMode, r.Schema, r.Table)
+	}
+
+	for column, mask := range r.Mask {
+		switch mask {
+		case maskSHA256, maskLast4, maskNull:
+		default:
+			return errors.Errorf("invalid mask %s of column %s for rule %s.%s, must be %s, %s or %s",
+				mask, column, r.Schema, r.Table, maskSHA256, maskLast4, maskNull)
+		}
+	}
+
+	switch r.UpdateMode {
+	case "":
+		r.UpdateMode = updateModeUpdate
+	case updateModeUpdate, updateModeUpsert, updateModeIndex:
+	default:
+		return errors.Errorf("invalid update_mode %s for rule %s.%s", r.UpdateMode, r.Schema, r.Table)
+	}
+
+	switch r.WriteMode {
+	case "":
+		r.WriteMode = writeModeIndex
+	case writeModeIndex:
+	case writeModeUpdate:
+		// the update action can't use them
+		if r.UpdateMode == updateModeIndex || len(r.Pipeline) > 0 || len(r.VersionColumn) > 0 {
+			return errors.Errorf("write_mode update can't be used with update_mode index, pipeline or version_column for rule %s.%s",
+				r.Schema, r.Table)
+		}
+	default:
+		return errors.Errorf("invalid write_mode %s for rule %s.%s", r.WriteMode, r.Schema, r.Table)
+	}
+
+	if len(r.DeleteVerifyFields) > 0 && len(r.VersionColumn) > 0 {
+		return errors.Errorf("delete_verify_fields can't be used with version_column for rule %s.%s, the deletes already use the external version",
+			r.Schema, r.Table)
+	}
+
+	if len(r.DeleteByQueryField) > 0 && (len(r.DeleteVerifyFields) > 0 || len(r.VersionColumn) > 0) {
+		return errors.Errorf("delete_by_query_field can't be used with delete_verify_fields or version_column for rule %s.%s, the delete by query is not conditional",
+			r.Schema, r.Table)
+	}
+
+	if len(r.Where) > 0 {
+		var err error
+		if r.where, err = parseWhere(r.Where); err != nil {
+			return errors.Annotatef(err, "rule %s.%s", r.Schema, r.Table)
+		}
+	}
+
+	if len(r.Pipeline) > 0 && strings.TrimSpace(r.Pipeline) != r.Pipeline {
+		return errors.Errorf("invalid pipeline %q for rule %s.%s", r.Pipeline, r.Schema, r.Table)
+	}
+
+	r.templates = nil
+	fields := make([]string, 0, len(r.Templates))
+	for field := range r.Templates {
+		fields = append(fields, field)
+	}
+	// execute the templates in a stable order
+	sort.Strings(fields)
+	for _, field := range fields {
+		tmpl, err := template.New(field).Option("missingkey=zero").Parse(r.Templates[field])
+		if err != nil {
+			return errors.Annotatef(err, "invalid template for field %s of rule %s.%s", field, r.Schema, r.Table)
+		}
+		r.templates = append(r.templates, fieldTemplate{field: field, tmpl: tmpl})
+	}
+
+	var err error
+	if r.jsonPaths, err = parseJSONPaths(r.JSONPaths); err != nil {
+		return errors.Annotatef(err, "rule %s.%s", r.Schema, r.Table)
+	}
+
+	if len(r.MappingFile) > 0 {
+		if len(r.IndexPattern) > 0 {
+			return errors.Errorf("mapping_file can't be used with index_pattern for rule %s.%s, use an index template instead", r.Schema, r.Table)
+		}
+
+		data, err := ioutil.ReadFile(r.MappingFile)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err = json.Unmarshal(data, &r.mapping); err != nil {
+			return errors.Annotatef(err, "invalid mapping_file %s for rule %s.%s", r.MappingFile, r.Schema, r.Table)
+		}
+	}
+
+	if len(r.IndexPattern) > 0 && len(r.IndexDateColumn) == 0 {
+		return errors.Errorf("index_date_column must be set for index_pattern for rule %s.%s", r.Schema, r.Table)
+	}
+
+	switch r.NullValueMode {
+	case "":
+		r.NullValueMode = nullValueModeNull
+	case nullValueModeNull, nullValueModeSkip:
+	case nullValueModeDefault:
+		if r.NullValue == nil {
+			return errors.Errorf("null_value must be set for null_value_mode default for rule %s.%s", r.Schema, r.Table)
+		}
+	default:
+		return errors.Errorf("invalid null_value_mode %s for rule %s.%s", r.NullValueMode, r.Schema, r.Table)
+	}
+
 	// ES must use a lower-case Type
 	// Here we also use for Index
 	r.Index = strings.ToLower(r.Index)
 	r.Type = strings.ToLower(r.Type)
 
+	if len(r.HistoryIndex) > 0 {
+		r.HistoryIndex = strings.ToLower(r.HistoryIndex)
+		if r.HistoryIndex == r.Index {
+			return errors.Errorf("history_index %s must not be the index of rule %s.%s", r.HistoryIndex, r.Schema, r.Table)
+		}
+		if containsString(r.IgnoreEvents, canal.UpdateAction) {
+			return errors.Errorf("history_index can't be used with ignore_events update for rule %s.%s", r.Schema, r.Table)
+		}
+	}
+
 	return nil
 }
 
-// CheckFilter checkers whether the field needs to be filtered.
-func (r *Rule) CheckFilter(field string) bool {
-	if r.Filter == nil {
+// addIndexAffix adds index_prefix and index_suffix to the index and index_pattern,
+// the type is not changed.
+func (r *Rule) addIndexAffix(prefix string, suffix string) {
+	prefix, suffix = strings.ToLower(prefix), strings.ToLower(suffix)
+	r.Index = prefix + r.Index + suffix
+	if len(r.IndexPattern) > 0 {
+		r.IndexPattern = prefix + r.IndexPattern + suffix
+	}
+	if len(r.HistoryIndex) > 0 {
+		r.HistoryIndex = prefix + r.HistoryIndex + suffix
+	}
+}
+
+// normalizeID applies id_normalize to the string id column value.
+func (r *Rule) normalizeID(value interface{}) interface{} {
+	var v string
+	switch value := value.(type) {
+	case string:
+		v = value
+	case []byte:
+		v = string(value)
+	default:
+		return value
+	}
+
+	for _, n := range r.IDNormalize {
+		switch n {
+		case idNormalizeLower:
+			v = strings.ToLower(v)
+		case idNormalizeTrim:
+			v = strings.TrimSpace(v)
+		}
+	}
+	return v
+}
+
+var idFormatColumnRegexp = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// missingColumns returns the rule options with the columns not in the table, like "filter name".
+func (r *Rule) missingColumns() []string {
+	var missing []string
+	check := func(option string, columns ...string) {
+		for _, column := range columns {
+			if r.TableInfo.FindColumn(column) < 0 {
+				missing = append(missing, fmt.Sprintf("%s %q", option, column))
+			}
+		}
+	}
+
+	check("id", r.ID...)
+	check("filter", r.Filter...)
+	check("include_columns", r.IncludeColumns...)
+	check("exclude_columns", r.ExcludeColumns...)
+	check("field", mapKeys(r.FieldMapping)...)
+	check("value_mapping", mapKeys(r.ValueMapping)...)
+	check("mask", mapKeys(r.Mask)...)
+	check("list_separator", mapKeys(r.ListSeparator)...)
+	for _, p := range r.jsonPaths {
+		check("json_path "+p.field, p.column)
+	}
+	for _, field := range mapKeys(r.GeoPoints) {
+		p := r.GeoPoints[field]
+		check("geo_point "+field+" lat", p.Lat)
+		check("geo_point "+field+" lon", p.Lon)
+	}
+
+	optional := []struct {
+		option string
+		column string
+	}{
+		{"parent", r.Parent},
+		{"routing_column", r.RoutingColumn},
+		{"type_column", r.TypeColumn},
+		{"index_date_column", r.IndexDateColumn},
+		{"version_column", r.VersionColumn},
+		{"soft_delete_column", r.SoftDeleteColumn},
+	}
+	for _, o := range optional {
+		if len(o.column) > 0 {
+			check(o.option, o.column)
+		}
+	}
+
+	return missing
+}
+
+// mapKeys returns the sorted keys of a map with the string keys.
+func mapKeys(m interface{}) []string {
+	keys := reflect.ValueOf(m).MapKeys()
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		names = append(names, k.String())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkTable checks the rule with the MySQL table information.
+func (r *Rule) checkTable() error {
+	// the PK may be dropped after the rule is loaded
+	if len(r.TableInfo.PKColumns) == 0 && len(r.ID) == 0 && !r.AutoID {
+		return errors.Errorf("table %s.%s has no PK, set id for rule", r.Schema, r.Table)
+	}
+
+	if missing := r.missingColumns(); len(missing) > 0 {
+		return errors.Errorf("rule %s.%s has the columns not in the table: %s",
+			r.Schema, r.Table, strings.Join(missing, ", "))
+	}
+
+	if len(r.VersionColumn) > 0 {
+		index := r.TableInfo.FindColumn(r.VersionColumn)
+		if t := r.TableInfo.Columns[index].Type; t != schema.TYPE_NUMBER && t != schema.TYPE_MEDIUM_INT {
+			return errors.Errorf("version_column %s must be an integer column in table %s.%s", r.VersionColumn, r.Schema, r.Table)
+		}
+	}
+
+	for _, field := range r.DeleteVerifyFields {
+		if !r.isColumnField(field) {
+			return errors.Errorf("delete_verify_fields %s is not a field synced from a column for rule %s.%s", field, r.Schema, r.Table)
+		}
+	}
+
+	for _, p := range r.jsonPaths {
+		if _, ok := r.Mask[p.column]; ok {
+			return errors.Errorf("json_path %s can't extract from the masked column %s of rule %s.%s", p.field, p.column, r.Schema, r.Table)
+		}
+	}
+
+	// the doc metadata can't be masked
+	for column := range r.Mask {
+		if containsString(r.idColumns(), column) {
+			return errors.Errorf("mask column %s is used for the doc id of rule %s.%s", column, r.Schema, r.Table)
+		}
+		switch column {
+		case r.Parent, r.RoutingColumn, r.TypeColumn, r.IndexDateColumn:
+			return errors.Errorf("mask column %s is used for the doc parent, routing, type or index of rule %s.%s",
+				column, r.Schema, r.Table)
+		}
+	}
+
+	if err := r.checkMetaFields(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := r.where.checkTable(r.TableInfo); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(r.IDFormat) > 0 {
+		columns := r.idColumns()
+		for _, m := range idFormatColumnRegexp.FindAllStringSubmatch(r.IDFormat, -1) {
+			if !containsString(columns, m[1]) {
+				return errors.Errorf("id_format column %s is not in the PK or id columns %v for rule %s.%s",
+					m[1], columns, r.Schema, r.Table)
+			}
+		}
+	}
+
+	r.skippedColumns = nil
+	idColumns := r.idColumns()
+	for _, c := range r.TableInfo.Columns {
+		if (r.BinaryMode == binaryModeSkip && isBinaryColumn(&c)) ||
+			(r.matchExcludeColumn(c.Name) && !containsString(idColumns, c.Name)) {
+			if r.skippedColumns == nil {
+				r.skippedColumns = make(map[string]bool)
+			}
+			r.skippedColumns[c.Name] = true
+		}
+	}
+
+	return nil
+}
+
+// maskValue returns the masked value of the column, or the value if the column has no mask.
+// The value is made by makeReqColumnData, NULL is not masked.
+func (r *Rule) maskValue(column string, value interface{}) interface{} {
+	mask, ok := r.Mask[column]
+	if !ok || value == nil {
+		return value
+	}
+
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	switch mask {
+	case maskSHA256:
+		sum := sha256.Sum256([]byte(r.MaskSalt + s))
+		return hex.EncodeToString(sum[:])
+	case maskLast4:
+		runes := []rune(s)
+		if len(runes) <= 4 {
+			return strings.Repeat("*", len(runes))
+		}
+		return strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-4:])
+	}
+	return nil
+}
+
+// isColumnField returns whether the doc field is synced from a column, by the column name
+// or the field mapping.
+func (r *Rule) isColumnField(field string) bool {
+	for _, c := range r.TableInfo.Columns {
+		if !r.CheckFilter(c.Name) {
+			continue
+		}
+		targets, mapped := r.FieldMapping[c.Name]
+		if !mapped && c.Name == field {
+			return true
+		}
+		for _, v := range targets {
+			name := strings.Split(v, ",")[0]
+			if name == field || (len(name) == 0 && c.Name == field) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchExcludeColumn returns whether the column matches any exclude_column_patterns.
+func (r *Rule) matchExcludeColumn(column string) bool {
+	for _, reg := range r.excludeColumnRegexps {
+		if reg.MatchString(column) {
+			return true
+		}
+	}
+	return false
+}
+
+// idColumns returns the column names to build the ES doc id.
+func (r *Rule) idColumns() []string {
+	if r.ID != nil {
+		return r.ID
+	}
+
+	columns := make([]string, 0, len(r.TableInfo.PKColumns))
+	for _, pk := range r.TableInfo.PKColumns {
+		columns = append(columns, r.TableInfo.Columns[pk].Name)
+	}
+	return columns
+}
+
+// GeoPoint is the latitude and longitude columns of an ES geo_point field.
+type GeoPoint struct {
+	Lat string `toml:"lat"`
+	Lon string `toml:"lon"`
+}
+
+// FieldTargets is the Elasticsearch fields a MySQL field is mapped to, like "es_name,type".
+// It is decoded from a string, or a list of strings for many fields.
+type FieldTargets []string
+
+// UnmarshalTOML implements toml.Unmarshaler.
+func (t *FieldTargets) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		*t = FieldTargets{v}
+	case []interface{}:
+		targets := make(FieldTargets, 0, len(v))
+		for _, target := range v {
+			s, ok := target.(string)
+			if !ok {
+				return errors.Errorf("field must be mapped to strings, but %v", v)
+			}
+			targets = append(targets, s)
+		}
+		*t = targets
+	default:
+		return errors.Errorf("field must be mapped to a string or a list of strings, but %v", v)
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// isBoolColumn returns whether the column is tinyint(1) and synced as a boolean.
+func (r *Rule) isBoolColumn(col *schema.TableColumn) bool {
+	return !r.TinyInt1AsNumber && col.Type == schema.TYPE_NUMBER &&
+		strings.HasPrefix(strings.ToLower(col.RawType), "tinyint(1)")
+}
+
+// isBinaryColumn returns whether the column is BINARY, VARBINARY or BLOB.
+func isBinaryColumn(col *schema.TableColumn) bool {
+	return col.Type == schema.TYPE_BINARY ||
+		col.Type == schema.TYPE_STRING && strings.Contains(strings.ToLower(col.RawType), "blob")
+}
+
+// checkMetaFields checks the meta fields don't collide with the fields of the columns,
+// or the nest_under object.
+func (r *Rule) checkMetaFields() error {
+	if len(r.MetaFields) == 0 {
+		return nil
+	}
+
+	fields := make(map[string]bool)
+	if len(r.NestUnder) > 0 {
+		// the fields of the row are all in the object
+		fields[strings.Split(r.NestUnder, ".")[0]] = true
+	} else {
+		for _, c := range r.TableInfo.Columns {
+			fields[c.Name] = true
+		}
+		for k, targets := range r.FieldMapping {
+			for _, v := range targets {
+				if field := strings.Split(v, ",")[0]; len(field) > 0 {
+					fields[field] = true
+				} else {
+					fields[k] = true
+				}
+			}
+		}
+		for field := range r.GeoPoints {
+			fields[field] = true
+		}
+		for field := range r.JSONPaths {
+			fields[field] = true
+		}
+		for field := range r.Templates {
+			fields[field] = true
+		}
+		if len(r.SoftDeleteColumn) > 0 {
+			fields[r.SoftDeleteField] = true
+		}
+	}
+
+	for _, k := range mapKeys(r.MetaFields) {
+		if field := r.MetaFields[k]; fields[field] {
+			return errors.Errorf("meta_field %s %s collides with a field of rule %s.%s", k, field, r.Schema, r.Table)
+		}
+	}
+	return nil
+}
+
+// isSyncedColumn returns whether the column is synced to the doc or used for the doc metadata.
+func (r *Rule) isSyncedColumn(column string) bool {
+	if r.CheckFilter(column) || containsString(r.idColumns(), column) {
+		return true
+	}
+
+	switch column {
+	case r.Parent, r.RoutingColumn, r.TypeColumn, r.IndexDateColumn, r.VersionColumn, r.SoftDeleteColumn:
 		return true
 	}
 
-	for _, f := range r.Filter {
-		if f == field {
+	for _, cond := range r.where {
+		if cond.column == column {
+			return true
+		}
+	}
+
+	for _, p := range r.GeoPoints {
+		if p.Lat == column || p.Lon == column {
+			return true
+		}
+	}
+
+	for _, p := range r.jsonPaths {
+		if p.column == column {
 			return true
 		}
 	}
 	return false
 }
+
+// CheckWhere checks whether the row matches the rule where condition.
+func (r *Rule) CheckWhere(row []interface{}) bool {
+	return r.where.match(r.TableInfo, row)
+}
+
+// CheckFilter checkers whether the field needs to be filtered.
+func (r *Rule) CheckFilter(field string) bool {
+	if r.skippedColumns[field] {
+		return false
+	}
+
+	if r.Filter != nil && !containsString(r.Filter, field) {
+		return false
+	}
+
+	if r.IncludeColumns != nil && !containsString(r.IncludeColumns, field) {
+		return false
+	}
+
+	return !containsString(r.ExcludeColumns, field)
+}
@@ -0,0 +1,64 @@
+package river
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRuleCheckTableID(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(256)")
+
+	rule := newTestRule(ta)
+	rule.ID = []string{"id", "title"}
+	if err := rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	rule.ID = []string{"id", "name"}
+	if err := rule.checkTable(); err == nil {
+		t.Error("Expected: an error for unknown id column, but: was nil")
+	}
+}
+
+func TestRulePreparePipeline(t *testing.T) {
+	rule := newDefaultRule("test", "t")
+	rule.Pipeline = "geoip"
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	rule.Pipeline = " "
+	if err := rule.prepare(); err == nil {
+		t.Error("Expected: an error for the blank pipeline, but: was nil")
+	}
+}
+
+func TestCheckTableMissingColumns(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(64)")
+
+	rule := newTestRule(ta)
+	rule.Filter = []string{"id", "titel"}
+	rule.FieldMapping = map[string]FieldTargets{"title": {"es_title"}, "conent": {"es_content"}}
+	rule.RoutingColumn = "tenant_id"
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := rule.checkTable()
+	if err == nil {
+		t.Fatal("Expected: an error for the missing columns, but: was nil")
+	}
+	// all the missing columns are listed
+	for _, s := range []string{`filter "titel"`, `field "conent"`, `routing_column "tenant_id"`} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("Expected: %s in the error, but: was %v", s, err)
+		}
+	}
+
+	rule.Filter = nil
+	rule.FieldMapping = map[string]FieldTargets{"title": {"es_title"}}
+	rule.RoutingColumn = ""
+	if err = rule.checkTable(); err != nil {
+		t.Errorf("Expected: no error, but: was %v", err)
+	}
+}
@@ -2,10 +2,20 @@ package river
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/juju/errors"
@@ -22,13 +32,30 @@ const (
 	// for the mysql int type to es date type
 	// set the [rule.field] created_time = ",date"
 	fieldTypeDate = "date"
+	// force to convert the mysql value to int64, float64 or string
+	// set the [rule.field] price = ",float"
+	fieldTypeInt    = "int"
+	fieldTypeFloat  = "float"
+	fieldTypeString = "string"
+	// parse the JSON string in a text column into an ES object
+	// set the [rule.field] info = ",json"
+	fieldTypeJSON = "json"
 )
 
 const mysqlDateFormat = "2006-01-02"
 
+// syncChanFullWarnInterval is the min interval to log the full sync channel.
+const syncChanFullWarnInterval = 30 * time.Second
+
+// closeFlushTimeout is the max time to wait the left events in the sync channel when closing,
+// and the max time for the last bulk.
+const closeFlushTimeout = 10 * time.Second
+
 type posSaver struct {
 	pos   mysql.Position
 	force bool
+	// the executed GTID set at pos, nil if not in gtid_mode
+	gset mysql.GTIDSet
 }
 
 type eventHandler struct {
@@ -36,133 +63,353 @@ type eventHandler struct {
 }
 
 func (h *eventHandler) OnRotate(e *replication.RotateEvent) error {
+	// the position is saved with the GTID set in OnPosSynced
+	if h.r.c.GTIDMode {
+		return nil
+	}
+
 	pos := mysql.Position{
 		Name: string(e.NextLogName),
 		Pos:  uint32(e.Position),
 	}
 
-	h.r.syncCh <- posSaver{pos, true}
-
-	return h.r.ctx.Err()
+	return h.r.sync(posSaver{pos, true, nil})
 }
 
-func (h *eventHandler) OnTableChanged(schema, table string) error {
-	err := h.r.updateRule(schema, table)
-	if err != nil && err != ErrRuleNotExist {
+func (h *eventHandler) OnTableChanged(db, table string) error {
+	err := h.r.updateRule(db, table)
+	switch errors.Cause(err) {
+	case nil, ErrRuleNotExist:
+		return nil
+	case schema.ErrTableNotExist:
+		// the table is dropped or renamed, the rules are updated if it's created again
+		log.Warnf("table %s.%s of the rules doesn't exist any more", db, table)
+		return nil
+	default:
 		return errors.Trace(err)
 	}
-	return nil
 }
 
 func (h *eventHandler) OnDDL(nextPos mysql.Position, _ *replication.QueryEvent) error {
-	h.r.syncCh <- posSaver{nextPos, true}
-	return h.r.ctx.Err()
+	if h.r.c.GTIDMode {
+		return nil
+	}
+	return h.r.sync(posSaver{nextPos, true, nil})
 }
 
 func (h *eventHandler) OnXID(nextPos mysql.Position) error {
-	h.r.syncCh <- posSaver{nextPos, false}
-	return h.r.ctx.Err()
+	if h.r.c.GTIDMode {
+		return nil
+	}
+	return h.r.sync(posSaver{nextPos, false, nil})
 }
 
 func (h *eventHandler) OnRow(e *canal.RowsEvent) error {
-	rule, ok := h.r.rules[ruleKey(e.Table.Schema, e.Table.Name)]
+	key := ruleKey(e.Table.Schema, e.Table.Name)
+	// the denied tables have no rules, it's only a guard
+	if h.r.isDeniedTable(e.Table.Schema, e.Table.Name) {
+		return nil
+	}
+	rules, ok := h.r.rules[key]
 	if !ok {
 		return nil
 	}
 
+	// the DDL may be missed, e.g, not parsed by canal, so refresh the table information
+	// if the columns don't match, the mismatch is handled by column_mismatch after the refresh
+	_, stale := h.r.staleTables.Load(key)
+	if stale || (len(e.Rows) > 0 && len(e.Rows[0]) != len(rules[0].TableInfo.Columns)) {
+		h.r.staleTables.Delete(key)
+		if err := h.r.refreshTable(e.Table.Schema, e.Table.Name); err != nil {
+			h.r.cancel()
+			return errors.Errorf("refresh table %s.%s err %v, close sync", e.Table.Schema, e.Table.Name, err)
+		}
+	}
+
+	// the dump rows have no header
+	if e.Header != nil {
+		atomic.StoreInt64(&h.r.lastEventTime, int64(e.Header.Timestamp))
+	} else {
+		atomic.AddInt64(&h.r.dump.rows, int64(len(e.Rows)))
+	}
+
+	meta := rowsMeta{action: e.Action}
+	if e.Header != nil && rulesHaveMetaFields(rules) {
+		meta.binlogName = h.r.canal.SyncedPosition().Name
+		meta.binlogPos = e.Header.LogPos
+		meta.timestamp = e.Header.Timestamp
+	}
+
 	var reqs []*elastic.BulkRequest
-	var err error
-	switch e.Action {
-	case canal.InsertAction:
-		reqs, err = h.r.makeInsertRequest(rule, e.Rows)
-	case canal.DeleteAction:
-		reqs, err = h.r.makeDeleteRequest(rule, e.Rows)
-	case canal.UpdateAction:
-		reqs, err = h.r.makeUpdateRequest(rule, e.Rows)
-	default:
-		err = errors.Errorf("invalid rows action %s", e.Action)
+	for _, rule := range rules {
+		ruleReqs, err := h.r.makeRowsRequest(rule, e.Action, e.Rows)
+		if err != nil {
+			h.r.cancel()
+			return errors.Errorf("make %s ES request err %v, close sync", e.Action, err)
+		}
+		addMetaFields(rule, ruleReqs, meta)
+		reqs = append(reqs, ruleReqs...)
 	}
 
-	if err != nil {
-		h.r.cancel()
-		return errors.Errorf("make %s ES request err %v, close sync", e.Action, err)
+	return h.r.sync(reqs)
+}
+
+// rowsMeta is the metadata of the rows event for meta_field, the binlog position
+// and timestamp are empty for the dump.
+type rowsMeta struct {
+	action     string
+	binlogName string
+	binlogPos  uint32
+	timestamp  uint32
+}
+
+func rulesHaveMetaFields(rules []*Rule) bool {
+	for _, rule := range rules {
+		if len(rule.MetaFields) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// addMetaFields adds the meta fields to the docs of the requests, the deletes have no doc.
+func addMetaFields(rule *Rule, reqs []*elastic.BulkRequest, meta rowsMeta) {
+	if len(rule.MetaFields) == 0 {
+		return
 	}
 
-	h.r.syncCh <- reqs
+	for _, req := range reqs {
+		if req.Data == nil {
+			continue
+		}
 
-	return h.r.ctx.Err()
+		for k, field := range rule.MetaFields {
+			switch k {
+			case metaFieldAction:
+				req.Data[field] = meta.action
+			case metaFieldBinlogName:
+				if len(meta.binlogName) > 0 {
+					req.Data[field] = meta.binlogName
+				}
+			case metaFieldBinlogPos:
+				if meta.binlogPos > 0 {
+					req.Data[field] = meta.binlogPos
+				}
+			case metaFieldTimestamp:
+				if meta.timestamp > 0 {
+					req.Data[field] = meta.timestamp
+				}
+			}
+		}
+	}
 }
 
 func (h *eventHandler) OnGTID(gtid mysql.GTIDSet) error {
 	return nil
 }
 
+// OnPosSynced is called after the rotate, DDL and XID events with the executed GTID set,
+// which is updated after OnXID, so the position is only saved here for gtid_mode.
 func (h *eventHandler) OnPosSynced(pos mysql.Position, set mysql.GTIDSet, force bool) error {
-	return nil
+	if !h.r.c.GTIDMode {
+		return nil
+	}
+
+	// the set is empty after the dump, the GTID set is saved from the next event
+	if set != nil && len(set.String()) > 0 {
+		set = set.Clone()
+	} else {
+		set = nil
+	}
+	return h.r.sync(posSaver{pos, force, set})
 }
 
 func (h *eventHandler) String() string {
 	return "ESRiverEventHandler"
 }
 
-func (r *River) syncLoop() {
-	bulkSize := r.c.BulkSize
-	if bulkSize == 0 {
-		bulkSize = 128
+// sync sends v to the sync loop. After the river is closed, v is dropped so
+// we won't block, and all the following ones are dropped too, so we never save
+// a position after an unsynced event.
+func (r *River) sync(v interface{}) error {
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+
+	// counted before sending, so waitPending never misses the item being received
+	atomic.AddInt64(&r.queuedNum, 1)
+	select {
+	case r.syncCh <- v:
+		return nil
+	default:
+	}
+
+	// the sync loop can't keep up, e.g, ES is slow, so the binlog reader is blocked
+	syncChanFullNum.Inc()
+	start := time.Now()
+	select {
+	case r.syncCh <- v:
+		r.warnSyncChanFull(time.Since(start))
+		return nil
+	case <-r.ctx.Done():
+		atomic.AddInt64(&r.queuedNum, -1)
+		return r.ctx.Err()
+	}
+}
+
+// warnSyncChanFull logs the full sync channel at most once every syncChanFullWarnInterval.
+func (r *River) warnSyncChanFull(wait time.Duration) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&r.syncChanFullWarnTime)
+	if now-last < int64(syncChanFullWarnInterval) || !atomic.CompareAndSwapInt64(&r.syncChanFullWarnTime, last, now) {
+		return
 	}
 
-	interval := r.c.FlushBulkTime.Duration
-	if interval == 0 {
-		interval = 200 * time.Millisecond
+	log.Warnf("the sync channel is full with %d items, the binlog reader waited %s, ES may be too slow, "+
+		"or increase sync_chan_size", cap(r.syncCh), wait)
+}
+
+// WaitSynced waits until the dump is done, the binlog catches the current MySQL position,
+// and all the requests are sent to ES, checking every interval. It returns an error if
+// not synced in timeout.
+func (r *River) WaitSynced(timeout time.Duration, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	select {
+	case <-r.getCanal().WaitDumpDone():
+	case <-time.After(timeout):
+		return errors.Errorf("wait the dump done timeout %s", timeout)
+	}
+
+	if err := r.getCanal().CatchMasterPos(time.Until(deadline)); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(r.waitPending(deadline, interval))
+}
+
+// waitPending waits until no request is left in the sync channel or pending to be sent.
+func (r *River) waitPending(deadline time.Time, interval time.Duration) error {
+	for {
+		n, pending := atomic.LoadInt64(&r.queuedNum), atomic.LoadInt64(&r.pendingNum)
+		if n == 0 && pending == 0 {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return errors.Errorf("wait the sync done timeout, still %d items in the sync channel and %d pending requests", n, pending)
+		}
+		time.Sleep(interval)
 	}
+}
 
-	ticker := time.NewTicker(interval)
+func (r *River) syncLoop() {
+	ticker := time.NewTicker(r.c.FlushBulkTime.Duration)
 	defer ticker.Stop()
 	defer r.wg.Done()
+	defer r.closeSubscribers()
 
 	lastSavedTime := time.Now()
 	reqs := make([]*elastic.BulkRequest, 0, 1024)
 
-	var pos mysql.Position
+	var pos posSaver
+	// the last got position, which may be not saved yet
+	var lastPos *posSaver
+	// the requests sent to ES since the last saved position
+	unsavedNum := 0
+	// the encoded bytes of the pending requests, only counted for bulk_max_bytes
+	pendingBytes := 0
 
 	for {
 		needFlush := false
 		needSavePos := false
+		// the resumable dump marker to save after the flush
+		var dumpMark interface{}
 
 		select {
 		case v := <-r.syncCh:
 			switch v := v.(type) {
 			case posSaver:
+				lastPos = &v
 				now := time.Now()
-				if v.force || now.Sub(lastSavedTime) > 3*time.Second {
+				if v.force || now.Sub(lastSavedTime) >= r.c.SavePositionInterval.Duration {
 					lastSavedTime = now
 					needFlush = true
 					needSavePos = true
-					pos = v.pos
+					pos = v
 				}
 			case []*elastic.BulkRequest:
+				r.publish(v)
 				reqs = append(reqs, v...)
-				needFlush = len(reqs) >= bulkSize
+				// fill a bulk request for every worker
+				needFlush = len(reqs) >= r.c.BulkSize*r.c.BulkWorkers
+				if r.c.BulkMaxBytes > 0 {
+					for _, req := range v {
+						pendingBytes += r.bulkReqSize(req)
+					}
+					needFlush = needFlush || pendingBytes >= r.c.BulkMaxBytes*r.c.BulkWorkers
+				}
+				r.setPendingNum(len(reqs))
+			case dumpTablesDone, dumpFinished:
+				needFlush = true
+				dumpMark = v
 			}
+			// the requests are in pendingNum now
+			atomic.AddInt64(&r.queuedNum, -1)
 		case <-ticker.C:
 			needFlush = true
 		case <-r.ctx.Done():
+			r.flushOnClose(reqs, lastPos)
 			return
 		}
 
 		if needFlush {
-			// TODO: retry some times?
-			if err := r.doBulk(reqs); err != nil {
-				log.Errorf("do ES bulk err %v, close sync", err)
+			reqs = coalesceRequests(reqs)
+			if err := r.doBulk(r.ctx, reqs); err != nil {
+				if r.ctx.Err() != nil {
+					// the position is not saved, so they will be synced again after restart
+					log.Warn(logMsg(logFields{"doc_count": len(reqs)},
+						"bulk is cancelled for closing, %d requests are not synced", len(reqs)))
+					return
+				}
+				p := r.master.Position()
+				log.Error(logMsg(logFields{"error": err, "binlog_name": p.Name, "binlog_pos": p.Pos, "doc_count": len(reqs)},
+					"do ES bulk err %v after binlog %s, close sync", err, p))
 				r.cancel()
 				return
 			}
+			unsavedNum += len(reqs)
 			reqs = reqs[0:0]
+			pendingBytes = 0
+			r.setPendingNum(0)
+
+			// all the requests before the last position are sent, so it is safe to save
+			if !needSavePos && lastPos != nil && r.c.SavePositionDocs > 0 && unsavedNum >= r.c.SavePositionDocs {
+				lastSavedTime = time.Now()
+				needSavePos = true
+				pos = *lastPos
+			}
 		}
 
 		if needSavePos {
-			if err := r.master.Save(pos); err != nil {
-				log.Errorf("save sync position %s err %v, close sync", pos, err)
+			if err := r.savePosition(r.ctx, pos); err == nil {
+				unsavedNum = 0
+			} else if r.ctx.Err() == nil {
+				if !r.c.ContinueOnSavePositionError {
+					log.Error(logMsg(logFields{"error": err, "binlog_name": pos.pos.Name, "binlog_pos": pos.pos.Pos},
+						"save sync position %s err %v, close sync", pos.pos, err))
+					r.cancel()
+					return
+				}
+				// the events after the last saved position are synced again after a crash
+				log.Error(logMsg(logFields{"error": err, "binlog_name": pos.pos.Name, "binlog_pos": pos.pos.Pos, "doc_count": unsavedNum},
+					"save sync position %s err %v, keep syncing with %d requests sent after the last saved position",
+					pos.pos, err, unsavedNum))
+			}
+		}
+
+		if dumpMark != nil {
+			if err := r.saveDumpMark(dumpMark); err != nil {
+				log.Error(logMsg(logFields{"error": err}, "save dump state err %v, close sync", err))
 				r.cancel()
 				return
 			}
@@ -170,11 +417,219 @@ func (r *River) syncLoop() {
 	}
 }
 
+// coalesceRequests removes all the requests of a document before its last index or delete
+// request, including the partial updates, because the last one overwrites them. The
+// requests after it, like the partial updates applied on it, are kept, and the kept
+// requests are still in order. The delete by query is never dropped, and the conditional
+// delete of delete_verify_fields doesn't overwrite, because it's verified with the doc
+// having the earlier requests applied.
+func coalesceRequests(reqs []*elastic.BulkRequest) []*elastic.BulkRequest {
+	// the position of the last index or delete request for every document
+	last := make(map[string]int)
+	for i, req := range reqs {
+		overwrite := req.Action == elastic.ActionIndex || (req.Action == elastic.ActionDelete && !isVerifiedDelete(req))
+		if len(req.ID) > 0 && overwrite {
+			last[docKey(req)] = i
+		}
+	}
+	if len(last) == 0 {
+		return reqs
+	}
+
+	kept := reqs[:0]
+	for i, req := range reqs {
+		// the delete by query also deletes the other docs, so it's never dropped
+		if n, ok := last[docKey(req)]; ok && len(req.ID) > 0 && i < n && req.Action != elastic.ActionDeleteByQuery {
+			esCoalescedNum.WithLabelValues(req.Index).Inc()
+			continue
+		}
+		kept = append(kept, req)
+	}
+	return kept
+}
+
+// docKey identifies the document of the request, the routing and parent are included
+// because the document with another routing may be in another shard.
+func docKey(req *elastic.BulkRequest) string {
+	return strings.Join([]string{req.Index, req.Type, req.ID, req.Routing, req.Parent}, "\x00")
+}
+
+// savePosition saves the position, and retries it at most max_save_position_retry times
+// if it fails. The wait time starts from save_position_backoff and doubles after every failure
+// up to max_save_position_backoff.
+func (r *River) savePosition(ctx context.Context, pos posSaver) error {
+	backoff := r.c.SavePositionBackoff.Duration
+	for retry := 0; ; retry++ {
+		err := r.master.Save(pos.pos, pos.gset)
+		if err == nil {
+			return nil
+		}
+		savePositionErrorNum.Inc()
+		if retry >= r.c.MaxSavePositionRetry {
+			return errors.Trace(err)
+		}
+
+		log.Error(logMsg(logFields{"error": err, "binlog_name": pos.pos.Name, "binlog_pos": pos.pos.Pos, "retry": retry + 1, "backoff": backoff.String()},
+			"save sync position %s err %v, retry %d/%d after %s", pos.pos, err, retry+1, r.c.MaxSavePositionRetry, backoff))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return errors.Trace(err)
+		}
+		backoff *= 2
+		if backoff > r.c.MaxSavePositionBackoff.Duration {
+			backoff = r.c.MaxSavePositionBackoff.Duration
+		}
+	}
+}
+
+// saveDumpMark saves the resumable dump state after the requests before the marker are sent.
+func (r *River) saveDumpMark(mark interface{}) error {
+	if r.dumpState == nil {
+		return nil
+	}
+
+	switch v := mark.(type) {
+	case dumpTablesDone:
+		r.dumpState.DoneTables = append(r.dumpState.DoneTables, v.tables...)
+		return errors.Trace(r.dumpState.save())
+	default:
+		return errors.Trace(r.dumpState.remove())
+	}
+}
+
+// publish sends the requests to the subscribers without blocking.
+func (r *River) publish(reqs []*elastic.BulkRequest) {
+	for _, ch := range r.subscribers {
+		select {
+		case ch <- reqs:
+		default:
+			subscriberDroppedNum.Inc()
+		}
+	}
+}
+
+func (r *River) closeSubscribers() {
+	for _, ch := range r.subscribers {
+		close(ch)
+	}
+}
+
+func (r *River) setPendingNum(n int) {
+	atomic.StoreInt64(&r.pendingNum, int64(n))
+	bulkPendingNum.Set(float64(n))
+}
+
+// flushOnClose syncs the pending requests and the ones left in the sync channel,
+// then saves the last position, so we won't sync them again after restart.
+func (r *River) flushOnClose(reqs []*elastic.BulkRequest, pos *posSaver) {
+	timeout := time.After(closeFlushTimeout)
+
+	for drained := false; !drained; {
+		select {
+		case v := <-r.syncCh:
+			switch v := v.(type) {
+			case posSaver:
+				pos = &v
+			case []*elastic.BulkRequest:
+				r.publish(v)
+				reqs = append(reqs, v...)
+			}
+		case <-timeout:
+			log.Warnf("wait the sync channel timeout when closing, still %d items", len(r.syncCh))
+			drained = true
+		default:
+			drained = true
+		}
+	}
+
+	// the river ctx is done, so use a new one to wait the bulk
+	ctx, cancel := context.WithTimeout(context.Background(), closeFlushTimeout)
+	defer cancel()
+
+	reqs = coalesceRequests(reqs)
+
+	if err := r.doBulk(ctx, reqs); err != nil {
+		p := r.master.Position()
+		log.Error(logMsg(logFields{"error": err, "binlog_name": p.Name, "binlog_pos": p.Pos, "doc_count": len(reqs)},
+			"do ES bulk err %v after binlog %s when closing", err, p))
+		return
+	}
+	r.setPendingNum(0)
+
+	if pos != nil {
+		if err := r.savePosition(ctx, *pos); err != nil {
+			log.Error(logMsg(logFields{"error": err, "binlog_name": pos.pos.Name, "binlog_pos": pos.pos.Pos},
+				"save sync position %s err %v when closing", pos.pos, err))
+		}
+	}
+}
+
+// makeRowsRequest makes the ES requests of the rows event for one rule.
+func (r *River) makeRowsRequest(rule *Rule, action string, rows [][]interface{}) ([]*elastic.BulkRequest, error) {
+	if containsString(rule.IgnoreEvents, action) {
+		return nil, nil
+	}
+
+	// the table may be altered, but the table information is not updated yet
+	for _, row := range rows {
+		if len(row) == len(rule.TableInfo.Columns) {
+			continue
+		}
+
+		switch r.c.ColumnMismatch {
+		case columnMismatchSkip:
+			// the update rows are in pairs, so skip the whole event
+			log.Warnf("skip %d %s rows of %s.%s, row has %d columns, but table has %d columns",
+				len(rows), action, rule.Schema, rule.TableInfo.Name, len(row), len(rule.TableInfo.Columns))
+			skippedRowsNum.WithLabelValues(rule.Index).Add(float64(len(rows)))
+			return nil, nil
+		case columnMismatchAdjust:
+			log.Warnf("adjust %d %s rows of %s.%s, row has %d columns, but table has %d columns",
+				len(rows), action, rule.Schema, rule.TableInfo.Name, len(row), len(rule.TableInfo.Columns))
+			rows = adjustRows(rows, len(rule.TableInfo.Columns))
+		default:
+			return nil, errors.Errorf("%s.%s row has %d columns, but table has %d columns",
+				rule.Schema, rule.TableInfo.Name, len(row), len(rule.TableInfo.Columns))
+		}
+		break
+	}
+
+	switch action {
+	case canal.InsertAction:
+		return r.makeInsertRequest(rule, rows)
+	case canal.DeleteAction:
+		return r.makeDeleteRequest(rule, rows)
+	case canal.UpdateAction:
+		return r.makeUpdateRequest(rule, rows)
+	default:
+		return nil, errors.Errorf("invalid rows action %s", action)
+	}
+}
+
+// adjustRows pads the rows with NULL or truncates them to the column count,
+// the rows are copied because they are shared by the rules of the table.
+func adjustRows(rows [][]interface{}, columns int) [][]interface{} {
+	adjusted := make([][]interface{}, 0, len(rows))
+	for _, row := range rows {
+		values := make([]interface{}, columns)
+		copy(values, row)
+		adjusted = append(adjusted, values)
+	}
+	return adjusted
+}
+
 // for insert and delete
 func (r *River) makeRequest(rule *Rule, action string, rows [][]interface{}) ([]*elastic.BulkRequest, error) {
 	reqs := make([]*elastic.BulkRequest, 0, len(rows))
 
 	for _, values := range rows {
+		// the rows not matching the where condition are never indexed,
+		// but we still delete them in case the where is changed.
+		if action != canal.DeleteAction && !rule.CheckWhere(values) {
+			continue
+		}
+
 		id, err := r.getDocID(rule, values)
 		if err != nil {
 			return nil, errors.Trace(err)
@@ -187,13 +642,42 @@ func (r *River) makeRequest(rule *Rule, action string, rows [][]interface{}) ([]
 			}
 		}
 
-		req := &elastic.BulkRequest{Index: rule.Index, Type: rule.Type, ID: id, Parent: parentID, Pipeline: rule.Pipeline}
+		routing, err := r.getRouting(rule, values)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		index, err := r.getIndex(rule, values)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		version, err := r.getVersion(rule, values)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		req := &elastic.BulkRequest{Index: index, Type: r.getType(rule, values), ID: id, Parent: parentID, Routing: routing, Pipeline: rule.Pipeline,
+			Version: version}
 
 		if action == canal.DeleteAction {
 			req.Action = elastic.ActionDelete
+			r.setDeleteExpected(req, rule, values)
 			esDeleteNum.WithLabelValues(rule.Index).Inc()
+			if len(rule.DeleteByQueryField) > 0 {
+				// the doc is deleted by id too, the delete by query may not see it before a refresh
+				reqs = append(reqs, req)
+				req = newDeleteByQueryRequest(req, rule)
+			}
 		} else {
-			r.makeInsertReqData(req, rule, values)
+			r.makeWriteReqData(req, rule, values)
+			skip, err := r.transformDoc(req, rule, action, values)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if skip {
+				continue
+			}
 			esInsertNum.WithLabelValues(rule.Index).Inc()
 		}
 
@@ -219,6 +703,16 @@ func (r *River) makeUpdateRequest(rule *Rule, rows [][]interface{}) ([]*elastic.
 	reqs := make([]*elastic.BulkRequest, 0, len(rows))
 
 	for i := 0; i < len(rows); i += 2 {
+		beforeMatch, afterMatch := rule.CheckWhere(rows[i]), rule.CheckWhere(rows[i+1])
+		if !beforeMatch && !afterMatch {
+			continue
+		}
+
+		if beforeMatch && afterMatch && r.isNoopUpdate(rule, rows[i], rows[i+1]) {
+			esSkippedUpdateNum.WithLabelValues(rule.Index).Inc()
+			continue
+		}
+
 		beforeID, err := r.getDocID(rule, rows[i])
 		if err != nil {
 			return nil, errors.Trace(err)
@@ -240,76 +734,158 @@ func (r *River) makeUpdateRequest(rule *Rule, rows [][]interface{}) ([]*elastic.
 			}
 		}
 
-		req := &elastic.BulkRequest{Index: rule.Index, Type: rule.Type, ID: beforeID, Parent: beforeParentID}
+		beforeRouting, err := r.getRouting(rule, rows[i])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		afterRouting, err := r.getRouting(rule, rows[i+1])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		beforeIndex, err := r.getIndex(rule, rows[i])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		afterIndex, err := r.getIndex(rule, rows[i+1])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		beforeType, afterType := r.getType(rule, rows[i]), r.getType(rule, rows[i+1])
 
-		if beforeID != afterID || beforeParentID != afterParentID {
+		// the old doc is deleted with the new version too
+		version, err := r.getVersion(rule, rows[i+1])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		req := &elastic.BulkRequest{Index: beforeIndex, Type: beforeType, ID: beforeID, Parent: beforeParentID, Routing: beforeRouting,
+			Version: version}
+
+		if !afterMatch {
+			// the row doesn't match the where condition any more
+			req.Action = elastic.ActionDelete
+			r.setDeleteExpected(req, rule, rows[i])
+			esDeleteNum.WithLabelValues(rule.Index).Inc()
+		} else if !beforeMatch {
+			// the row matches the where condition now, so it's never indexed before,
+			// index the whole row instead of updating the changed columns
+			req = &elastic.BulkRequest{Index: afterIndex, Type: afterType, ID: afterID, Parent: afterParentID, Routing: afterRouting, Pipeline: rule.Pipeline,
+				Version: version}
+			r.makeWriteReqData(req, rule, rows[i+1])
+
+			skip, err := r.transformDoc(req, rule, canal.UpdateAction, rows[i+1])
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if skip {
+				continue
+			}
+			esInsertNum.WithLabelValues(rule.Index).Inc()
+		} else if beforeID != afterID || beforeParentID != afterParentID || beforeRouting != afterRouting || beforeIndex != afterIndex ||
+			beforeType != afterType {
 			req.Action = elastic.ActionDelete
+			r.setDeleteExpected(req, rule, rows[i])
 			reqs = append(reqs, req)
 
-			req = &elastic.BulkRequest{Index: rule.Index, Type: rule.Type, ID: afterID, Parent: afterParentID, Pipeline: rule.Pipeline}
-			r.makeInsertReqData(req, rule, rows[i+1])
+			req = &elastic.BulkRequest{Index: afterIndex, Type: afterType, ID: afterID, Parent: afterParentID, Routing: afterRouting, Pipeline: rule.Pipeline,
+				Version: version}
+			r.makeWriteReqData(req, rule, rows[i+1])
 
 			esDeleteNum.WithLabelValues(rule.Index).Inc()
+
+			// the old doc is still deleted if the new one is skipped
+			skip, err := r.transformDoc(req, rule, canal.UpdateAction, rows[i+1])
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if skip {
+				continue
+			}
 			esInsertNum.WithLabelValues(rule.Index).Inc()
 		} else {
-			if len(rule.Pipeline) > 0 {
-				// Pipelines can only be specified on index action
+			if len(rule.Pipeline) > 0 || rule.UpdateMode == updateModeIndex || version > 0 {
+				// Pipelines and external versions can only be specified on index action
 				r.makeInsertReqData(req, rule, rows[i+1])
 				// Make sure action is index, not create
 				req.Action = elastic.ActionIndex
 				req.Pipeline = rule.Pipeline
+			} else if rule.UpdateMode == updateModeUpsert {
+				// Use the whole row, so we can insert a complete doc if it doesn't exist
+				r.makeInsertReqData(req, rule, rows[i+1])
+				req.Action = elastic.ActionUpdate
+				req.Upsert = true
 			} else {
 				r.makeUpdateReqData(req, rule, rows[i], rows[i+1])
 			}
+
+			skip, err := r.transformDoc(req, rule, canal.UpdateAction, rows[i+1])
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if skip {
+				continue
+			}
 			esUpdateNum.WithLabelValues(rule.Index).Inc()
 		}
 
 		reqs = append(reqs, req)
+
+		// after the skip checks, the dropped updates have no history
+		if len(rule.HistoryIndex) > 0 {
+			if history := r.makeHistoryRequest(rule, afterID, rows[i], rows[i+1]); history != nil {
+				reqs = append(reqs, history)
+			}
+		}
 	}
 
 	return reqs, nil
 }
 
+// isNoopUpdate returns whether the update doesn't change any synced column.
+func (r *River) isNoopUpdate(rule *Rule, beforeValues []interface{}, afterValues []interface{}) bool {
+	for i, c := range rule.TableInfo.Columns {
+		// the templates may use any column
+		if len(rule.templates) == 0 && !rule.isSyncedColumn(c.Name) {
+			continue
+		}
+		if !reflect.DeepEqual(beforeValues[i], afterValues[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 func (r *River) makeReqColumnData(col *schema.TableColumn, value interface{}) interface{} {
 	switch col.Type {
-	case schema.TYPE_ENUM:
+	case schema.TYPE_NUMBER, schema.TYPE_MEDIUM_INT:
+		// the value may be any int type for binlog, or be []byte and string sometimes,
+		// use int64 (uint64 for the big unsigned value) for a consistent ES mapping
+		if v, ok := toInt64(value); ok {
+			return v
+		}
+		if v, ok := toUint64(value); ok {
+			return v
+		}
+	case schema.TYPE_FLOAT, schema.TYPE_DECIMAL:
+		if v, ok := toFloat64(value); ok {
+			return v
+		}
+	case schema.TYPE_ENUM, schema.TYPE_SET:
+		return makeEnumSetData(col, value)
+	case schema.TYPE_BIT:
 		switch value := value.(type) {
-		case int64:
-			// for binlog, ENUM may be int64, but for dump, enum is string
-			eNum := value - 1
-			if eNum < 0 || eNum >= int64(len(col.EnumValues)) {
-				// we insert invalid enum value before, so return empty
-				log.Warnf("invalid binlog enum index %d, for enum %v", eNum, col.EnumValues)
-				return ""
+		case string:
+			// for binlog, BIT is int64, but for dump, BIT is string
+			// for dump 0x01 is for 1, \0 is for 0
+			if value == "\x01" {
+				return int64(1)
 			}
 
-			return col.EnumValues[eNum]
+			return int64(0)
 		}
-	case schema.TYPE_SET:
-		switch value := value.(type) {
-		case int64:
-			// for binlog, SET may be int64, but for dump, SET is string
-			bitmask := value
-			sets := make([]string, 0, len(col.SetValues))
-			for i, s := range col.SetValues {
-				if bitmask&int64(1<<uint(i)) > 0 {
-					sets = append(sets, s)
-				}
-			}
-			return strings.Join(sets, ",")
-		}
-	case schema.TYPE_BIT:
-		switch value := value.(type) {
-		case string:
-			// for binlog, BIT is int64, but for dump, BIT is string
-			// for dump 0x01 is for 1, \0 is for 0
-			if value == "\x01" {
-				return int64(1)
-			}
-
-			return int64(0)
-		}
-	case schema.TYPE_STRING:
+	case schema.TYPE_STRING, schema.TYPE_BINARY, schema.TYPE_POINT:
 		switch value := value.(type) {
 		case []byte:
 			return string(value[:])
@@ -327,13 +903,20 @@ func (r *River) makeReqColumnData(col *schema.TableColumn, value interface{}) in
 			return f
 		}
 	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP:
+		// the zero date is synced as NULL, so it follows the rule null_value_mode
 		switch v := value.(type) {
 		case string:
-			vt, err := time.ParseInLocation(mysql.TimeFormat, string(v), time.Local)
+			// the fractional seconds like DATETIME(6) are parsed too
+			vt, err := time.ParseInLocation(mysql.TimeFormat, string(v), r.columnTimeLocation(col))
 			if err != nil || vt.IsZero() { // failed to parse date or zero date
 				return nil
 			}
-			return vt.Format(time.RFC3339)
+			return r.formatTime(vt)
+		case time.Time:
+			if v.IsZero() {
+				return nil
+			}
+			return r.formatTime(v)
 		}
 	case schema.TYPE_DATE:
 		switch v := value.(type) {
@@ -343,12 +926,73 @@ func (r *River) makeReqColumnData(col *schema.TableColumn, value interface{}) in
 				return nil
 			}
 			return vt.Format(mysqlDateFormat)
+		case time.Time:
+			if v.IsZero() {
+				return nil
+			}
+			return v.Format(mysqlDateFormat)
 		}
 	}
 
 	return value
 }
 
+// makeEnumSetData returns the string value of the ENUM or SET column, the binlog value
+// may be the int64 index or bitmask, and the dump value is the string.
+func makeEnumSetData(col *schema.TableColumn, value interface{}) interface{} {
+	switch col.Type {
+	case schema.TYPE_ENUM:
+		switch value := value.(type) {
+		case int64:
+			// for binlog, ENUM may be int64, but for dump, enum is string
+			eNum := value - 1
+			if eNum < 0 || eNum >= int64(len(col.EnumValues)) {
+				// we insert invalid enum value before, so return empty
+				log.Warnf("invalid binlog enum index %d, for enum %v", eNum, col.EnumValues)
+				return ""
+			}
+
+			return col.EnumValues[eNum]
+		case []byte:
+			return string(value)
+		}
+	case schema.TYPE_SET:
+		switch value := value.(type) {
+		case []byte:
+			return string(value)
+		case int64:
+			// for binlog, SET may be int64, but for dump, SET is string
+			bitmask := value
+			sets := make([]string, 0, len(col.SetValues))
+			for i, s := range col.SetValues {
+				if bitmask&int64(1<<uint(i)) > 0 {
+					sets = append(sets, s)
+				}
+			}
+			return strings.Join(sets, ",")
+		}
+	}
+	return value
+}
+
+// formatTime formats the time as ISO8601 for ES, in UTC if my_time_zone is set,
+// otherwise in the local time zone.
+func (r *River) formatTime(t time.Time) string {
+	if r.c.timeLocation() != time.Local {
+		t = t.UTC()
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// columnTimeLocation returns the time zone of the column values. The TIMESTAMP values
+// are in UTC if my_time_zone is set, and the DATETIME values are in my_time_zone.
+func (r *River) columnTimeLocation(col *schema.TableColumn) *time.Location {
+	if col.Type == schema.TYPE_TIMESTAMP && r.c.timeLocation() != time.Local {
+		return time.UTC
+	}
+	return r.c.timeLocation()
+}
+
 func (r *River) getFieldParts(k string, v string) (string, string, string) {
 	composedField := strings.Split(v, ",")
 
@@ -375,17 +1019,33 @@ func (r *River) makeInsertReqData(req *elastic.BulkRequest, rule *Rule, values [
 			continue
 		}
 		mapped := false
-		for k, v := range rule.FieldMapping {
-			mysql, elastic, fieldType := r.getFieldParts(k, v)
-			if mysql == c.Name {
-				mapped = true
-				req.Data[elastic] = r.getFieldValue(&c, fieldType, values[i])
+		for k, targets := range rule.FieldMapping {
+			for _, v := range targets {
+				mysql, elastic, fieldType := r.getFieldParts(k, v)
+				if mysql == c.Name {
+					mapped = true
+					r.setReqData(req, rule, elastic, r.makeFieldData(rule, &c, fieldType, values[i]))
+				}
 			}
 		}
 		if mapped == false {
-			req.Data[c.Name] = r.makeReqColumnData(&c, values[i])
+			r.setReqData(req, rule, c.Name, r.makeFieldData(rule, &c, "", values[i]))
 		}
 	}
+
+	r.makeSoftDeleteData(req, rule, values)
+	r.makeGeoPointData(req, rule, values, nil)
+	r.makeJSONPathData(req, rule, values, nil)
+	r.makeTemplateData(req, rule, values, req.Data)
+}
+
+// makeWriteReqData makes the whole doc for the row by the rule write_mode, index or upsert.
+func (r *River) makeWriteReqData(req *elastic.BulkRequest, rule *Rule, values []interface{}) {
+	r.makeInsertReqData(req, rule, values)
+	if rule.WriteMode == writeModeUpdate {
+		req.Action = elastic.ActionUpdate
+		req.Upsert = true
+	}
 }
 
 func (r *River) makeUpdateReqData(req *elastic.BulkRequest, rule *Rule,
@@ -404,23 +1064,271 @@ func (r *River) makeUpdateReqData(req *elastic.BulkRequest, rule *Rule,
 			//nothing changed
 			continue
 		}
-		for k, v := range rule.FieldMapping {
-			mysql, elastic, fieldType := r.getFieldParts(k, v)
-			if mysql == c.Name {
-				mapped = true
-				req.Data[elastic] = r.getFieldValue(&c, fieldType, afterValues[i])
+		for k, targets := range rule.FieldMapping {
+			for _, v := range targets {
+				mysql, elastic, fieldType := r.getFieldParts(k, v)
+				if mysql == c.Name {
+					mapped = true
+					r.setReqData(req, rule, elastic, r.makeFieldData(rule, &c, fieldType, afterValues[i]))
+				}
 			}
 		}
 		if mapped == false {
-			req.Data[c.Name] = r.makeReqColumnData(&c, afterValues[i])
+			r.setReqData(req, rule, c.Name, r.makeFieldData(rule, &c, "", afterValues[i]))
 		}
+	}
+
+	if len(rule.SoftDeleteColumn) > 0 && r.isSoftDeleted(rule, beforeValues) != r.isSoftDeleted(rule, afterValues) {
+		r.makeSoftDeleteData(req, rule, afterValues)
+	}
+	r.makeGeoPointData(req, rule, afterValues, beforeValues)
+	r.makeJSONPathData(req, rule, afterValues, beforeValues)
+
+	if len(rule.templates) > 0 {
+		// the templates may use the unchanged fields, so make them with the whole doc
+		doc := new(elastic.BulkRequest)
+		r.makeInsertReqData(doc, rule, afterValues)
+		r.makeTemplateData(req, rule, afterValues, doc.Data)
+	}
+}
+
+// transformDoc replaces the request data with the one returned by the document transformer,
+// and returns true if the transformer skips the document. Then the data is nested under
+// the rule nest_under, so the transformer gets the fields of the row as they are.
+func (r *River) transformDoc(req *elastic.BulkRequest, rule *Rule, action string, values []interface{}) (bool, error) {
+	if r.transformer != nil {
+		data, err := r.transformer.Transform(rule, action, values, req.Data)
+		if errors.Cause(err) == ErrSkipDocument {
+			return true, nil
+		} else if err != nil {
+			return false, errors.Annotatef(err, "transform doc %s of table %s", req.ID, rule.TableInfo)
+		}
+		req.Data = data
+	}
+
+	if len(rule.NestUnder) > 0 {
+		doc := make(map[string]interface{}, 1)
+		setDocField(doc, rule.NestUnder, req.Data)
+		req.Data = doc
+	}
+	return false, nil
+}
 
+// makeSoftDeleteData sets the rule soft_delete_field for the soft_delete_column.
+func (r *River) makeSoftDeleteData(req *elastic.BulkRequest, rule *Rule, values []interface{}) {
+	if len(rule.SoftDeleteColumn) == 0 {
+		return
 	}
+
+	setDocField(req.Data, rule.SoftDeleteField, r.isSoftDeleted(rule, values))
+}
+
+// isSoftDeleted returns whether the soft_delete_column is not NULL, the zero date is NULL too.
+func (r *River) isSoftDeleted(rule *Rule, values []interface{}) bool {
+	index := rule.TableInfo.FindColumn(rule.SoftDeleteColumn)
+	return r.makeReqColumnData(&rule.TableInfo.Columns[index], values[index]) != nil
+}
+
+// makeGeoPointData sets the rule geo_point fields as {"lat": lat, "lon": lon}, the field
+// is skipped if either column is NULL. For update, only the changed points are set.
+func (r *River) makeGeoPointData(req *elastic.BulkRequest, rule *Rule, values []interface{}, beforeValues []interface{}) {
+	for field, p := range rule.GeoPoints {
+		lat, lon := rule.TableInfo.FindColumn(p.Lat), rule.TableInfo.FindColumn(p.Lon)
+		if beforeValues != nil && reflect.DeepEqual(beforeValues[lat], values[lat]) &&
+			reflect.DeepEqual(beforeValues[lon], values[lon]) {
+			continue
+		}
+
+		latValue, ok := toFloat64(r.makeReqColumnData(&rule.TableInfo.Columns[lat], values[lat]))
+		if !ok {
+			continue
+		}
+		lonValue, ok := toFloat64(r.makeReqColumnData(&rule.TableInfo.Columns[lon], values[lon]))
+		if !ok {
+			continue
+		}
+		setDocField(req.Data, field, map[string]interface{}{"lat": latValue, "lon": lonValue})
+	}
+}
+
+// makeTemplateData sets the rule template fields, the template data has the column values
+// and the fields in the doc. NULL is an empty string, not "<no value>". The field is
+// skipped if the template fails.
+func (r *River) makeTemplateData(req *elastic.BulkRequest, rule *Rule, values []interface{}, doc map[string]interface{}) {
+	if len(rule.templates) == 0 {
+		return
+	}
+
+	data := make(map[string]interface{}, len(values)+len(doc))
+	for i, c := range rule.TableInfo.Columns {
+		data[c.Name] = rule.maskValue(c.Name, r.makeReqColumnData(&c, values[i]))
+	}
+	for k, v := range doc {
+		data[k] = v
+	}
+	for k, v := range data {
+		if v == nil {
+			data[k] = ""
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, t := range rule.templates {
+		buf.Reset()
+		if err := t.tmpl.Execute(&buf, data); err != nil {
+			log.Error(logMsg(logFields{"error": err, "table": rule.TableInfo.String(), "field": t.field},
+				"execute template for field %s of table %s err %v, skip it", t.field, rule.TableInfo, err))
+			continue
+		}
+		r.setReqData(req, rule, t.field, buf.String())
+	}
+}
+
+// makeFieldData returns the ES field value for the column value, the masked value is
+// used first, then the rule value_mapping, then the field type modifier.
+func (r *River) makeFieldData(rule *Rule, col *schema.TableColumn, fieldType string, value interface{}) interface{} {
+	if _, ok := rule.Mask[col.Name]; ok {
+		return rule.maskValue(col.Name, r.makeReqColumnData(col, value))
+	}
+
+	if v, ok := r.getMappedValue(rule, col, value); ok {
+		return v
+	}
+
+	if isBinaryColumn(col) {
+		var b []byte
+		switch v := value.(type) {
+		case []byte:
+			b = v
+		case string:
+			b = []byte(v)
+		}
+		// encode the bytes explicitly, the invalid UTF-8 bytes are replaced in JSON
+		if b != nil {
+			switch rule.BinaryMode {
+			case binaryModeBase64:
+				return base64.StdEncoding.EncodeToString(b)
+			case binaryModeHex:
+				return hex.EncodeToString(b)
+			}
+		}
+	}
+
+	if fieldType == fieldTypeList {
+		return r.makeListData(rule, col, value)
+	}
+	if len(fieldType) > 0 {
+		return r.getFieldValue(col, fieldType, value)
+	}
+
+	if rule.isBoolColumn(col) {
+		if v, ok := toInt64(value); ok {
+			return v != 0
+		}
+	}
+
+	v := r.makeReqColumnData(col, value)
+	if col.Type == schema.TYPE_SET {
+		// sync SET as an array for the keyword aggregations, the empty SET is an empty array
+		if str, ok := v.(string); ok {
+			if len(str) == 0 {
+				return []string{}
+			}
+			return strings.Split(str, ",")
+		}
+	}
+
+	return v
+}
+
+// makeListData splits the string value by the list_separator of the column, "," by default,
+// the elements are trimmed and the empty ones are dropped. NULL is an empty array for
+// null_value_mode "null", and handled by the other modes as usual.
+func (r *River) makeListData(rule *Rule, col *schema.TableColumn, value interface{}) interface{} {
+	if value == nil {
+		if rule.NullValueMode == nullValueModeNull {
+			return []string{}
+		}
+		return nil
+	}
+
+	v := r.makeReqColumnData(col, value)
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+	str, ok := v.(string)
+	if !ok {
+		return v
+	}
+
+	sep, ok := rule.ListSeparator[col.Name]
+	if !ok {
+		sep = defaultListSeparator
+	}
+
+	list := make([]string, 0)
+	for _, s := range strings.Split(str, sep) {
+		if s = strings.TrimSpace(s); len(s) > 0 {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// getMappedValue returns the rule value_mapping value for the column value if it is mapped.
+func (r *River) getMappedValue(rule *Rule, col *schema.TableColumn, value interface{}) (interface{}, bool) {
+	m, ok := rule.ValueMapping[col.Name]
+	if !ok || value == nil {
+		return nil, false
+	}
+
+	key := r.makeReqColumnData(col, value)
+	if b, ok := key.([]byte); ok {
+		key = string(b)
+	}
+
+	mappedValue, ok := m[fmt.Sprint(key)]
+	return mappedValue, ok
+}
+
+// setReqData sets the field value of the doc, the nil value is handled with the rule null_value_mode.
+func (r *River) setReqData(req *elastic.BulkRequest, rule *Rule, field string, value interface{}) {
+	if value == nil {
+		switch rule.NullValueMode {
+		case nullValueModeSkip:
+			return
+		case nullValueModeDefault:
+			value = rule.NullValue
+		}
+	}
+
+	setDocField(req.Data, field, value)
+}
+
+// setDocField sets the value to the field, the field like "author.name" is set in a nested object,
+// and the fields with the same prefix are in the same object.
+func setDocField(data map[string]interface{}, field string, value interface{}) {
+	names := strings.Split(field, ".")
+	for _, name := range names[:len(names)-1] {
+		child, ok := data[name].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			data[name] = child
+		}
+		data = child
+	}
+
+	data[names[len(names)-1]] = value
 }
 
 // If id in toml file is none, get primary keys in one row and format them into a string, and PK must not be nil
 // Else get the ID's column in one row and format them into a string
 func (r *River) getDocID(rule *Rule, row []interface{}) (string, error) {
+	// the empty id is omitted in the bulk, so ES generates one
+	if rule.AutoID {
+		return "", nil
+	}
+
 	var (
 		ids []interface{}
 		err error
@@ -441,72 +1349,521 @@ func (r *River) getDocID(rule *Rule, row []interface{}) (string, error) {
 		}
 	}
 
-	var buf bytes.Buffer
-
-	sep := ""
 	for i, value := range ids {
 		if value == nil {
 			return "", errors.Errorf("The %ds id or PK value is nil", i)
 		}
+		if len(rule.IDNormalize) > 0 {
+			ids[i] = rule.normalizeID(value)
+		}
+	}
 
-		buf.WriteString(fmt.Sprintf("%s%v", sep, value))
-		sep = ":"
+	if len(rule.IDFormat) > 0 {
+		return formatDocID(rule, ids), nil
+	}
+
+	var buf bytes.Buffer
+
+	switch rule.IDStrategy {
+	case idStrategyHash:
+		// the length prefix makes the values unambiguous, e.g, "12", "3" and "1", "23"
+		for _, value := range ids {
+			v := idString(value)
+			fmt.Fprintf(&buf, "%d:%s", len(v), v)
+		}
+		return fmt.Sprintf("%x", sha1.Sum(buf.Bytes())), nil
+	case idStrategyConcat:
+		for _, value := range ids {
+			buf.WriteString(idString(value))
+		}
+	default:
+		sep := ""
+		for _, value := range ids {
+			buf.WriteString(sep)
+			buf.WriteString(idString(value))
+			sep = rule.IDSeparator
+		}
 	}
 
 	return buf.String(), nil
 }
 
+// idString returns the string of the column value for the doc id, parent and routing,
+// the []byte value, like a TEXT column in the binlog, is the string, not "[49 50]".
+func idString(value interface{}) string {
+	if v, ok := value.([]byte); ok {
+		return string(v)
+	}
+	return fmt.Sprint(value)
+}
+
+// formatDocID replaces the {column} in the rule id_format with the column value.
+func formatDocID(rule *Rule, ids []interface{}) string {
+	columns := rule.idColumns()
+	oldnew := make([]string, 0, 2*len(columns))
+	for i, column := range columns {
+		oldnew = append(oldnew, "{"+column+"}", idString(ids[i]))
+	}
+
+	return strings.NewReplacer(oldnew...).Replace(rule.IDFormat)
+}
+
 func (r *River) getParentID(rule *Rule, row []interface{}, columnName string) (string, error) {
 	index := rule.TableInfo.FindColumn(columnName)
 	if index < 0 {
 		return "", errors.Errorf("parent id not found %s(%s)", rule.TableInfo.Name, columnName)
 	}
 
-	return fmt.Sprint(row[index]), nil
+	// the doc has no parent, don't send "<nil>" as the parent id
+	if row[index] == nil {
+		return "", nil
+	}
+
+	return idString(row[index]), nil
 }
 
-func (r *River) doBulk(reqs []*elastic.BulkRequest) error {
-	if len(reqs) == 0 {
-		return nil
+// getVersion returns the external version for the row, 0 if no version_column.
+func (r *River) getVersion(rule *Rule, row []interface{}) (int64, error) {
+	if len(rule.VersionColumn) == 0 {
+		return 0, nil
+	}
+
+	index := rule.TableInfo.FindColumn(rule.VersionColumn)
+	if index < 0 {
+		return 0, errors.Errorf("version column not found %s(%s)", rule.TableInfo.Name, rule.VersionColumn)
+	}
+
+	version, ok := toInt64(row[index])
+	if !ok || version <= 0 {
+		return 0, errors.Errorf("version value must be a positive integer %s(%s) %v", rule.TableInfo.Name, rule.VersionColumn, row[index])
+	}
+
+	return version, nil
+}
+
+// getIndex returns the index for the row, the rule Index is used if no index_pattern.
+func (r *River) getIndex(rule *Rule, row []interface{}) (string, error) {
+	if len(rule.IndexPattern) == 0 {
+		return rule.Index, nil
+	}
+
+	index := rule.TableInfo.FindColumn(rule.IndexDateColumn)
+	if index < 0 {
+		return "", errors.Errorf("index date column not found %s(%s)", rule.TableInfo.Name, rule.IndexDateColumn)
+	}
+
+	if row[index] == nil {
+		return "", errors.Errorf("index date value is nil %s(%s)", rule.TableInfo.Name, rule.IndexDateColumn)
+	}
+
+	var t time.Time
+	switch v := row[index].(type) {
+	case time.Time:
+		t = v
+	case string:
+		var err error
+		if t, err = time.ParseInLocation(mysql.TimeFormat, v, r.columnTimeLocation(&rule.TableInfo.Columns[index])); err != nil {
+			if t, err = time.ParseInLocation(mysqlDateFormat, v, r.c.timeLocation()); err != nil {
+				return "", errors.Errorf("invalid index date value %s(%s) %s", rule.TableInfo.Name, rule.IndexDateColumn, v)
+			}
+		}
+		t = t.In(r.c.timeLocation())
+	default:
+		// the unix timestamp
+		n, ok := toInt64(v)
+		if !ok {
+			return "", errors.Errorf("invalid index date value %s(%s) %v", rule.TableInfo.Name, rule.IndexDateColumn, v)
+		}
+		t = time.Unix(n, 0).In(r.c.timeLocation())
+	}
+
+	if t.IsZero() {
+		return "", errors.Errorf("index date value is zero %s(%s)", rule.TableInfo.Name, rule.IndexDateColumn)
+	}
+
+	return strings.ToLower(strings.NewReplacer(
+		"{YYYY}", t.Format("2006"),
+		"{MM}", t.Format("01"),
+		"{DD}", t.Format("02"),
+		"{HH}", t.Format("15"),
+	).Replace(rule.IndexPattern)), nil
+}
+
+// getRouting returns the routing for the row from the rule routing_column, empty if
+// no routing_column. A NULL value means no routing too, so the doc goes to the default
+// shard, but it is warned once for the rule and counted, because it mostly means the
+// column is not set by mistake.
+func (r *River) getRouting(rule *Rule, row []interface{}) (string, error) {
+	if len(rule.RoutingColumn) == 0 {
+		return "", nil
+	}
+
+	index := rule.TableInfo.FindColumn(rule.RoutingColumn)
+	if index < 0 {
+		return "", errors.Errorf("routing column not found %s(%s)", rule.TableInfo.Name, rule.RoutingColumn)
+	}
+
+	if row[index] == nil {
+		nullRoutingNum.WithLabelValues(rule.Index).Inc()
+		if atomic.CompareAndSwapInt32(&rule.nullRoutingWarned, 0, 1) {
+			log.Warnf("routing value is NULL %s.%s(%s), sync the rows without routing, only warned once",
+				rule.Schema, rule.TableInfo.Name, rule.RoutingColumn)
+		}
+		return "", nil
 	}
 
-	if resp, err := r.es.Bulk(reqs); err != nil {
-		log.Errorf("sync docs err %v after binlog %s", err, r.canal.SyncedPosition())
+	return idString(row[index]), nil
+}
+
+// getType returns the doc type for the row, the rule Type is used if no type_column,
+// or the column value is NULL or empty.
+func (r *River) getType(rule *Rule, row []interface{}) string {
+	if len(rule.TypeColumn) == 0 {
+		return rule.Type
+	}
+
+	index := rule.TableInfo.FindColumn(rule.TypeColumn)
+	if index < 0 || row[index] == nil {
+		return rule.Type
+	}
+
+	var v string
+	switch value := row[index].(type) {
+	case []byte:
+		v = string(value)
+	default:
+		v = fmt.Sprint(value)
+	}
+
+	// ES must use a lower-case Type
+	if v = strings.ToLower(v); len(v) == 0 {
+		return rule.Type
+	}
+	return v
+}
+
+// errBulkItemFailed is the error if any item in the bulk response failed.
+var errBulkItemFailed = errors.New("ES bulk item failed")
+
+// errBulkRejected is the error if ES rejected the bulk or some items for too many requests.
+var errBulkRejected = errors.New("ES bulk rejected")
+
+// doBulk sends the requests to ES, at most bulk_size requests and bulk_max_bytes for one bulk.
+func (r *River) doBulk(ctx context.Context, reqs []*elastic.BulkRequest) error {
+	// the delete by query can't be in a bulk, the requests before it are sent first, and
+	// it refreshes the index before, so it also deletes the docs indexed before the row is deleted.
+	// The conditional delete is verified after the earlier requests of the doc are sent too,
+	// otherwise the doc got doesn't have them, like the update before the delete of the row.
+	start := 0
+	docs := make(map[string]struct{})
+	for i, req := range reqs {
+		if req.Action == elastic.ActionDeleteByQuery {
+			if err := r.doVerifiedBulk(ctx, reqs[start:i]); err != nil {
+				return errors.Trace(err)
+			}
+			if err := r.deleteByQueryWithRetry(ctx, req); err != nil {
+				return errors.Trace(err)
+			}
+			start = i + 1
+			docs = make(map[string]struct{})
+			continue
+		}
+
+		key := docKey(req)
+		if _, ok := docs[key]; ok && isVerifiedDelete(req) {
+			if err := r.doVerifiedBulk(ctx, reqs[start:i]); err != nil {
+				return errors.Trace(err)
+			}
+			start = i
+			docs = make(map[string]struct{})
+		}
+		docs[key] = struct{}{}
+	}
+
+	return errors.Trace(r.doVerifiedBulk(ctx, reqs[start:]))
+}
+
+// doVerifiedBulk verifies the conditional deletes, then sends the requests by the bulk workers.
+func (r *River) doVerifiedBulk(ctx context.Context, reqs []*elastic.BulkRequest) error {
+	reqs, err := r.verifyDeletes(ctx, reqs)
+	if err != nil {
 		return errors.Trace(err)
-	} else if resp.Code/100 == 2 || resp.Errors {
-		for i := 0; i < len(resp.Items); i++ {
-			for action, item := range resp.Items[i] {
-				if len(item.Error) > 0 {
-					log.Errorf("%s index: %s, type: %s, id: %s, status: %d, error: %s",
-						action, item.Index, item.Type, item.ID, item.Status, item.Error)
-				}
+	}
+	return errors.Trace(r.doBulkWorkers(ctx, reqs))
+}
+
+// doBulkWorkers sends the requests by bulk_workers bulks in parallel.
+func (r *River) doBulkWorkers(ctx context.Context, reqs []*elastic.BulkRequest) error {
+	if r.c.BulkWorkers <= 1 || len(reqs) <= r.c.BulkSize {
+		return r.doBulkSerially(ctx, reqs)
+	}
+
+	// the requests of one document are in the same worker, so they are still in order
+	workerReqs := make([][]*elastic.BulkRequest, r.c.BulkWorkers)
+	for _, req := range reqs {
+		h := fnv.New32a()
+		h.Write([]byte(req.Index))
+		h.Write([]byte(req.ID))
+		n := h.Sum32() % uint32(r.c.BulkWorkers)
+		workerReqs[n] = append(workerReqs[n], req)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(workerReqs))
+	for i := range workerReqs {
+		if len(workerReqs[i]) == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = r.doBulkSerially(ctx, workerReqs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	// the caller saves the position only after all the requests are sent
+	for _, err := range errs {
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+func (r *River) doBulkSerially(ctx context.Context, reqs []*elastic.BulkRequest) error {
+	start := 0
+	size := 0
+	for i, req := range reqs {
+		n := 0
+		if r.c.BulkMaxBytes > 0 {
+			n = r.bulkReqSize(req)
+		}
+
+		if i > start && (i-start >= r.c.BulkSize || (r.c.BulkMaxBytes > 0 && size+n > r.c.BulkMaxBytes)) {
+			if err := r.bulkWithRetry(ctx, reqs[start:i]); err != nil {
+				return errors.Trace(err)
 			}
+			start = i
+			size = 0
 		}
+		size += n
+	}
+
+	if start < len(reqs) {
+		return errors.Trace(r.bulkWithRetry(ctx, reqs[start:]))
 	}
 
 	return nil
 }
 
+// bulkReqSize returns the encoded bytes of the request for bulk_max_bytes, cached by the
+// request so it is encoded once for the sync loop and the split of the bulks, 0 if it
+// can't be encoded, the error is returned when it's sent.
+func (r *River) bulkReqSize(req *elastic.BulkRequest) int {
+	n, err := req.EncodedSize(r.es.Version)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// bulkWithRetry retries the failed bulk at most max_bulk_retry times with exponential backoff.
+func (r *River) bulkWithRetry(ctx context.Context, reqs []*elastic.BulkRequest) error {
+	backoff := r.c.BulkRetryBackoff.Duration
+	retry := 0
+	for {
+		// the retries are limited too, so they won't overwhelm ES
+		if err := r.limiter.wait(ctx, len(reqs)); err != nil {
+			return errors.Trace(err)
+		}
+
+		rejected, err := r.bulk(ctx, reqs)
+		if err == nil {
+			return nil
+		}
+
+		switch errors.Cause(err) {
+		case errBulkItemFailed:
+			// the failed items are mostly the mapping errors or version conflicts,
+			// retrying the bulk can't fix them
+			return errors.Trace(err)
+		case errBulkRejected:
+			// ES is overloaded, wait and send the rejected requests again until they are accepted,
+			// the accepted ones are not sent again, e.g, the docs with the ids generated by ES
+			reqs = rejected
+			bulkRejectedNum.Inc()
+			log.Warn(logMsg(logFields{"error": err, "doc_count": len(reqs), "backoff": backoff.String()},
+				"ES bulk rejected, %v, retry after %s", err, backoff))
+		default:
+			bulkErrorNum.Inc()
+			if retry >= r.c.MaxBulkRetry {
+				return errors.Trace(err)
+			}
+			retry++
+			log.Error(logMsg(logFields{"error": err, "doc_count": len(reqs), "retry": retry, "backoff": backoff.String()},
+				"do ES bulk err %v, retry %d/%d after %s", err, retry, r.c.MaxBulkRetry, backoff))
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return errors.Trace(err)
+		}
+
+		backoff *= 2
+		if backoff > r.c.MaxBulkBackoff.Duration {
+			backoff = r.c.MaxBulkBackoff.Duration
+		}
+	}
+}
+
+// bulk sends the requests in one bulk. If ES rejects the bulk or some items with 429 Too
+// Many Requests, the error is errBulkRejected, and the rejected requests are returned to
+// send again, the other items are already handled like a bulk without rejection.
+func (r *River) bulk(ctx context.Context, reqs []*elastic.BulkRequest) ([]*elastic.BulkRequest, error) {
+	if r.c.DryRun {
+		r.dryRunBulk(reqs)
+		return nil, nil
+	}
+
+	resp, err := r.es.BulkContext(ctx, reqs)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if resp.Code == http.StatusTooManyRequests {
+		return reqs, errors.Annotatef(errBulkRejected, "code: %d", resp.Code)
+	}
+
+	if resp.Code/100 != 2 {
+		return nil, errors.Errorf("ES bulk error: %s, code: %d", http.StatusText(resp.Code), resp.Code)
+	}
+
+	if !resp.Errors {
+		return nil, nil
+	}
+
+	var rejected []*elastic.BulkRequest
+	var failedReqs []*elastic.BulkRequest
+	var failedErrors []json.RawMessage
+	failedNum := 0
+	for i := 0; i < len(resp.Items); i++ {
+		for action, item := range resp.Items[i] {
+			if item.Status == http.StatusTooManyRequests && i < len(reqs) {
+				rejected = append(rejected, reqs[i])
+				continue
+			}
+			if item.Status == http.StatusConflict && i < len(reqs) && reqs[i].IfPrimaryTerm > 0 {
+				// the doc is changed after it is verified, so it's newer than the deleted row
+				esDeleteVerifySkippedNum.WithLabelValues(item.Index).Inc()
+				log.Debugf("%s index: %s, type: %s, id: %s is ignored for the seq_no conflict",
+					action, item.Index, item.Type, item.ID)
+				continue
+			}
+			if item.Status == http.StatusConflict && i < len(reqs) && reqs[i].Version > 0 {
+				// the doc has a newer version, the event is replayed or out of order, or
+				// the doc is newer than the deleted row, which must be kept
+				log.Debugf("%s index: %s, type: %s, id: %s, version: %d is ignored for the version conflict",
+					action, item.Index, item.Type, item.ID, reqs[i].Version)
+				continue
+			}
+			if len(item.Error) > 0 {
+				failedNum++
+				bulkItemErrorNum.WithLabelValues(item.Index).Inc()
+				log.Error(logMsg(logFields{"action": action, "index": item.Index, "type": item.Type, "id": item.ID,
+					"status": item.Status, "error": item.Error},
+					"%s index: %s, type: %s, id: %s, status: %d, error: %s",
+					action, item.Index, item.Type, item.ID, item.Status, item.Error))
+				if i < len(reqs) {
+					failedReqs = append(failedReqs, reqs[i])
+					failedErrors = append(failedErrors, item.Error)
+				}
+			}
+		}
+	}
+
+	// the failed items would be lost, so the sync is closed like stop_on_bulk_item_error
+	if err = r.deadLetter.write(failedReqs, failedErrors); err != nil {
+		return nil, errors.Annotatef(errBulkItemFailed, "%d of %d items, write dead letter file err %v",
+			failedNum, len(resp.Items), err)
+	}
+
+	if failedNum > 0 && r.c.StopOnBulkItemError {
+		return nil, errors.Annotatef(errBulkItemFailed, "%d of %d items", failedNum, len(resp.Items))
+	}
+
+	if len(rejected) > 0 {
+		return rejected, errors.Annotatef(errBulkRejected, "%d of %d items", len(rejected), len(resp.Items))
+	}
+
+	return nil, nil
+}
+
+// dryRunBulk logs the bulk requests instead of sending them.
+func (r *River) dryRunBulk(reqs []*elastic.BulkRequest) {
+	for _, req := range reqs {
+		data, err := json.Marshal(req.Data)
+		if err != nil {
+			log.Errorf("[dry run] marshal %s index: %s, id: %s err %v", req.Action, req.Index, req.ID, err)
+			continue
+		}
+		log.Infof("[dry run] %s index: %s, type: %s, id: %s, parent: %s, routing: %s, data: %s",
+			req.Action, req.Index, req.Type, req.ID, req.Parent, req.Routing, data)
+	}
+}
+
 // get mysql field value and convert it to specific value to es
 func (r *River) getFieldValue(col *schema.TableColumn, fieldType string, value interface{}) interface{} {
 	var fieldValue interface{}
 	switch fieldType {
-	case fieldTypeList:
+	case fieldTypeInt:
+		if v, ok := toInt64(value); ok {
+			fieldValue = v
+		} else if v, ok := toUint64(value); ok {
+			fieldValue = v
+		} else if v, ok := toFloat64(value); ok {
+			fieldValue = int64(v)
+		}
+
+	case fieldTypeFloat:
+		if v, ok := toFloat64(value); ok {
+			fieldValue = v
+		}
+
+	case fieldTypeString:
+		switch v := r.makeReqColumnData(col, value).(type) {
+		case nil:
+		case string:
+			fieldValue = v
+		case []byte:
+			fieldValue = string(v)
+		default:
+			fieldValue = fmt.Sprint(v)
+		}
+
+	case fieldTypeJSON:
 		v := r.makeReqColumnData(col, value)
 		if str, ok := v.(string); ok {
-			fieldValue = strings.Split(str, ",")
-		} else {
-			fieldValue = v
+			var f interface{}
+			if err := json.Unmarshal([]byte(str), &f); err != nil {
+				log.Warnf("invalid JSON value for column %s, err %v, sync it as string", col.Name, err)
+			} else {
+				v = f
+			}
 		}
+		fieldValue = v
 
 	case fieldTypeDate:
-		if col.Type == schema.TYPE_NUMBER {
+		if col.Type == schema.TYPE_NUMBER || col.Type == schema.TYPE_MEDIUM_INT {
 			col.Type = schema.TYPE_DATETIME
 
 			v := reflect.ValueOf(value)
 			switch v.Kind() {
 			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				fieldValue = r.makeReqColumnData(col, time.Unix(v.Int(), 0).Format(mysql.TimeFormat))
+				fieldValue = r.formatTime(time.Unix(v.Int(), 0))
 			}
 		}
 	}
@@ -516,3 +1873,73 @@ func (r *River) getFieldValue(col *schema.TableColumn, fieldType string, value i
 	}
 	return fieldValue
 }
+
+func toInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case []byte:
+		n, err := strconv.ParseInt(string(v), 10, 64)
+		return n, err == nil
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, err == nil
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() <= math.MaxInt64 {
+			return int64(v.Uint()), true
+		}
+	}
+	return 0, false
+}
+
+func toUint64(value interface{}) (uint64, bool) {
+	switch v := value.(type) {
+	case []byte:
+		n, err := strconv.ParseUint(string(v), 10, 64)
+		return n, err == nil
+	case string:
+		n, err := strconv.ParseUint(v, 10, 64)
+		return n, err == nil
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint(), true
+	}
+	return 0, false
+}
+
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case []byte:
+		f, err := strconv.ParseFloat(string(v), 64)
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	case float32:
+		// keep the shortest decimal representation, float64(v) may be 1.100000023841858 for 1.1
+		f, err := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+		return f, err == nil
+	case fmt.Stringer:
+		// e.g, decimal.Decimal
+		f, err := strconv.ParseFloat(v.String(), 64)
+		return f, err == nil
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	}
+	return 0, false
+}
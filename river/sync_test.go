@@ -0,0 +1,2398 @@
+package river
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func newTestTable(pks []string, columns ...string) *schema.Table {
+	ta := &schema.Table{Schema: "test", Name: "test_sync"}
+	for i := 0; i < len(columns); i += 2 {
+		ta.AddColumn(columns[i], columns[i+1], "", "")
+	}
+
+	for _, pk := range pks {
+		ta.PKColumns = append(ta.PKColumns, ta.FindColumn(pk))
+	}
+
+	return ta
+}
+
+func newTestRule(ta *schema.Table) *Rule {
+	rule := newDefaultRule(ta.Schema, ta.Name)
+	rule.TableInfo = ta
+	return rule
+}
+
+func TestGetDocID(t *testing.T) {
+	ta := newTestTable([]string{"tenant_id", "order_id"},
+		"tenant_id", "int", "order_id", "int", "title", "varchar(256)")
+
+	r := new(River)
+	rule := newTestRule(ta)
+
+	id, err := r.getDocID(rule, []interface{}{1, 2, "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "1:2" {
+		t.Errorf("Expected: is \"1:2\", but: was \"%s\"", id)
+	}
+
+	rule.IDSeparator = "|"
+	id, err = r.getDocID(rule, []interface{}{1, 2, "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "1|2" {
+		t.Errorf("Expected: is \"1|2\", but: was \"%s\"", id)
+	}
+
+	// the []byte value is the string, not the bytes
+	id, err = r.getDocID(rule, []interface{}{1, []byte("2"), "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "1|2" {
+		t.Errorf("[]byte Expected: is \"1|2\", but: was \"%s\"", id)
+	}
+
+	if _, err = r.getDocID(rule, []interface{}{1, nil, "a"}); err == nil {
+		t.Error("Expected: an error for nil PK value, but: was nil")
+	}
+
+	rule.IDFormat = "{tenant_id}-{order_id}"
+	if err = rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+	id, err = r.getDocID(rule, []interface{}{1, 2, "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "1-2" {
+		t.Errorf("Expected: is \"1-2\", but: was \"%s\"", id)
+	}
+
+	rule.IDFormat = "{tenant_id}-{title}"
+	if err = rule.checkTable(); err == nil {
+		t.Error("Expected: an error for id_format with non PK column, but: was nil")
+	}
+}
+
+func TestGetDocIDStrategy(t *testing.T) {
+	ta := newTestTable([]string{"a", "b"}, "a", "varchar(256)", "b", "varchar(256)")
+
+	r := new(River)
+	rule := newTestRule(ta)
+
+	// the ambiguous values make the same id with concat or separator
+	ambiguous := [][][]interface{}{
+		{{"12", "3"}, {"1", "23"}},
+		{{"1:2", "3"}, {"1", "2:3"}},
+		{{"", "1"}, {"1", ""}},
+	}
+
+	expected := map[string][]bool{
+		idStrategyConcat:    {true, false, true},
+		idStrategySeparator: {false, true, false},
+		idStrategyHash:      {false, false, false},
+	}
+
+	for strategy, collisions := range expected {
+		rule.IDStrategy = strategy
+		if err := rule.prepare(); err != nil {
+			t.Fatal(err)
+		}
+
+		for i, rows := range ambiguous {
+			id1, err := r.getDocID(rule, rows[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			id2, err := r.getDocID(rule, rows[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (id1 == id2) != collisions[i] {
+				t.Errorf("%s %v Expected: collision is %v, but: was %s and %s", strategy, rows, collisions[i], id1, id2)
+			}
+		}
+	}
+
+	rule.IDStrategy = idStrategyHash
+	id, _ := r.getDocID(rule, []interface{}{"1", "2"})
+	if len(id) != 40 {
+		t.Errorf("Expected: is the SHA-1 hex, but: was %s", id)
+	}
+
+	rule.IDFormat = "{a}-{b}"
+	if err := rule.prepare(); err == nil {
+		t.Error("Expected: an error for id_strategy with id_format, but: was nil")
+	}
+
+	rule.IDFormat = ""
+	rule.IDStrategy = "md5"
+	if err := rule.prepare(); err == nil {
+		t.Error("Expected: an error for invalid id_strategy, but: was nil")
+	}
+}
+
+// newTestRiver creates a River without MySQL, which sends the bulk requests to h.
+func newTestRiver(t *testing.T, h http.HandlerFunc) (*River, func()) {
+	ts := httptest.NewServer(h)
+
+	cfg := new(Config)
+	cfg.BulkSize = 1
+	cfg.FlushBulkTime = TomlDuration{time.Millisecond}
+	cfg.BulkRetryBackoff = TomlDuration{time.Millisecond}
+	if err := cfg.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := new(River)
+	r.c = cfg
+	r.syncCh = make(chan interface{}, 16)
+	r.limiter = newRateLimiter(cfg.BulkDocsPerSecond)
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.master, _ = loadMasterInfo(nil)
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://")})
+
+	return r, func() {
+		r.cancel()
+		r.wg.Wait()
+		ts.Close()
+	}
+}
+
+func testBulkRequests() []*elastic.BulkRequest {
+	return []*elastic.BulkRequest{{Action: elastic.ActionIndex, Index: "river", Type: "river", ID: "1",
+		Data: map[string]interface{}{"title": "first"}}}
+}
+
+func TestSyncLoopSavesPosition(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	})
+	defer closeFn()
+
+	r.wg.Add(1)
+	go r.syncLoop()
+
+	pos := mysql.Position{Name: "mysql-bin.000001", Pos: 4}
+	r.syncCh <- testBulkRequests()
+	r.syncCh <- posSaver{pos, true, nil}
+
+	for i := 0; i < 100 && r.master.Position() != pos; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if r.master.Position() != pos {
+		t.Errorf("Position Expected: is %s, but: was %s", pos, r.master.Position())
+	}
+}
+
+// failingStore is a position store failing the first fails saves.
+type failingStore struct {
+	fails int32
+	saves int32
+}
+
+func (s *failingStore) load() (mysql.Position, string, error) { return mysql.Position{}, "", nil }
+
+func (s *failingStore) save(pos mysql.Position, gtid string) error {
+	if atomic.AddInt32(&s.saves, 1) <= s.fails {
+		return errors.New("disk full")
+	}
+	return nil
+}
+
+func (s *failingStore) String() string { return "failing store" }
+
+func TestSavePositionRetry(t *testing.T) {
+	r := new(River)
+	r.c = new(Config)
+	r.c.MaxSavePositionRetry = 2
+	r.c.SavePositionBackoff = TomlDuration{time.Millisecond}
+
+	pos := posSaver{mysql.Position{Name: "mysql-bin.000001", Pos: 4}, true, nil}
+	store := &failingStore{fails: 2}
+	r.master, _ = loadMasterInfo(store)
+	if err := r.savePosition(context.Background(), pos); err != nil {
+		t.Errorf("Save Expected: is nil after 2 retries, but: was %v", err)
+	}
+	if store.saves != 3 {
+		t.Errorf("Saves Expected: is 3, but: was %d", store.saves)
+	}
+
+	store = &failingStore{fails: 3}
+	r.master, _ = loadMasterInfo(store)
+	if err := r.savePosition(context.Background(), pos); err == nil {
+		t.Error("Save Expected: an error after 2 retries, but: was nil")
+	}
+	if store.saves != 3 {
+		t.Errorf("Saves Expected: is 3, but: was %d", store.saves)
+	}
+
+	// the backoff doesn't exceed max_save_position_backoff, or it waits for minutes
+	r.c.MaxSavePositionRetry = 20
+	r.c.MaxSavePositionBackoff = TomlDuration{time.Millisecond}
+	store = &failingStore{fails: 20}
+	r.master, _ = loadMasterInfo(store)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.savePosition(ctx, pos); err != nil {
+		t.Errorf("Save Expected: is nil after 20 retries, but: was %v", err)
+	}
+}
+
+func TestSyncLoopContinueOnSavePositionError(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	})
+	defer closeFn()
+
+	r.c.ContinueOnSavePositionError = true
+	store := &failingStore{fails: 1}
+	r.master, _ = loadMasterInfo(store)
+
+	r.wg.Add(1)
+	go r.syncLoop()
+
+	// the first save fails, the sync keeps going and the next save succeeds
+	r.syncCh <- testBulkRequests()
+	r.syncCh <- posSaver{mysql.Position{Name: "mysql-bin.000001", Pos: 4}, true, nil}
+	r.syncCh <- testBulkRequests()
+	r.syncCh <- posSaver{mysql.Position{Name: "mysql-bin.000001", Pos: 8}, true, nil}
+	time.Sleep(50 * time.Millisecond)
+
+	if r.ctx.Err() != nil {
+		t.Error("Sync Expected: is not closed, but: was closed")
+	}
+	if saves := atomic.LoadInt32(&store.saves); saves != 2 {
+		t.Errorf("Saves Expected: is 2, but: was %d", saves)
+	}
+}
+
+func TestSyncLoopSavePositionDocs(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	})
+	defer closeFn()
+
+	r.c.SavePositionInterval = TomlDuration{time.Hour}
+	r.c.SavePositionDocs = 2
+
+	r.wg.Add(1)
+	go r.syncLoop()
+
+	// not saved by the interval, but after 2 requests are sent
+	pos := mysql.Position{Name: "mysql-bin.000001", Pos: 4}
+	r.syncCh <- testBulkRequests()
+	r.syncCh <- posSaver{pos, false, nil}
+	time.Sleep(50 * time.Millisecond)
+	if p := r.master.Position(); p != (mysql.Position{}) {
+		t.Errorf("Position Expected: is not saved, but: was %s", p)
+	}
+
+	r.syncCh <- testBulkRequests()
+	for i := 0; i < 100 && r.master.Position() != pos; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if r.master.Position() != pos {
+		t.Errorf("Position Expected: is %s, but: was %s", pos, r.master.Position())
+	}
+}
+
+func TestSyncLoopNotSavePositionOnBulkError(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"internal error","status":500}`))
+	})
+	defer closeFn()
+
+	r.wg.Add(1)
+	go r.syncLoop()
+
+	r.syncCh <- testBulkRequests()
+	r.syncCh <- posSaver{mysql.Position{Name: "mysql-bin.000001", Pos: 4}, true, nil}
+
+	select {
+	case <-r.ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("sync is not closed after the bulk error")
+	}
+	r.wg.Wait()
+
+	if pos := r.master.Position(); pos != (mysql.Position{}) {
+		t.Errorf("Position Expected: is not saved, but: was %s", pos)
+	}
+}
+
+func TestMakeUpdateRequestMode(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(256)", "content", "varchar(256)")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	rows := [][]interface{}{{1, "a", "hello"}, {1, "b", "hello"}}
+
+	reqs, err := r.makeUpdateRequest(rule, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || reqs[0].Action != elastic.ActionUpdate || reqs[0].Upsert || len(reqs[0].Data) != 1 {
+		t.Errorf("Expected: is a partial update, but: was %+v", reqs[0])
+	}
+
+	rule.UpdateMode = updateModeUpsert
+	reqs, err = r.makeUpdateRequest(rule, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || reqs[0].Action != elastic.ActionUpdate || !reqs[0].Upsert || len(reqs[0].Data) != 3 {
+		t.Errorf("Expected: is an upsert with all columns, but: was %+v", reqs[0])
+	}
+
+	rule.UpdateMode = updateModeIndex
+	reqs, err = r.makeUpdateRequest(rule, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || reqs[0].Action != elastic.ActionIndex || len(reqs[0].Data) != 3 {
+		t.Errorf("Expected: is a full reindex, but: was %+v", reqs[0])
+	}
+}
+
+func TestMakeInsertReqDataNullValue(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "deleted", "tinyint(1)", "created", "datetime")
+
+	tests := []struct {
+		Mode   string
+		Value  interface{}
+		Exists bool
+		Expect interface{}
+	}{
+		{nullValueModeNull, nil, true, nil},
+		{nullValueModeSkip, nil, false, nil},
+		{nullValueModeDefault, false, true, false},
+	}
+
+	r := new(River)
+	for _, test := range tests {
+		rule := newTestRule(ta)
+		rule.NullValueMode = test.Mode
+		rule.NullValue = test.Value
+
+		req := new(elastic.BulkRequest)
+		r.makeInsertReqData(req, rule, []interface{}{1, nil, "0000-00-00 00:00:00"})
+
+		for _, field := range []string{"deleted", "created"} {
+			v, ok := req.Data[field]
+			if ok != test.Exists || v != test.Expect {
+				t.Errorf("Mode: %s, Field: %s, Expected: is %v(%t), but: was %v(%t)", test.Mode, field, test.Expect, test.Exists, v, ok)
+			}
+		}
+	}
+}
+
+func TestMakeReqColumnDataCoercion(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "big", "bigint(20) unsigned", "stock", "mediumint",
+		"price", "float", "amount", "decimal(10,2)", "created", "datetime", "day", "date")
+
+	dt := "2020-01-02 15:04:05"
+	vt, _ := time.ParseInLocation(mysql.TimeFormat, dt, time.Local)
+
+	tests := []struct {
+		Column string
+		Value  interface{}
+		Expect interface{}
+	}{
+		{"id", int8(1), int64(1)},
+		{"id", int32(1), int64(1)},
+		{"id", "12", int64(12)},
+		{"id", []byte("12"), int64(12)},
+		{"big", uint32(3748168280), int64(3748168280)},
+		{"big", uint64(math.MaxUint64), uint64(math.MaxUint64)},
+		{"stock", int32(5), int64(5)},
+		{"stock", "5", int64(5)},
+		{"price", float32(1.1), float64(1.1)},
+		{"price", "1.5", float64(1.5)},
+		{"amount", []byte("10.25"), float64(10.25)},
+		{"amount", float64(10.25), float64(10.25)},
+		{"created", dt, vt.Format(time.RFC3339)},
+		{"created", dt + ".123456", vt.Add(123456 * time.Microsecond).Format(time.RFC3339Nano)},
+		{"created", vt, vt.Format(time.RFC3339)},
+		{"created", "0000-00-00 00:00:00", nil},
+		{"day", "2020-01-02", "2020-01-02"},
+		{"day", "0000-00-00", nil},
+	}
+
+	r := new(River)
+	for _, test := range tests {
+		col := &ta.Columns[ta.FindColumn(test.Column)]
+		if v := r.makeReqColumnData(col, test.Value); v != test.Expect {
+			t.Errorf("Column: %s, Value: %#v, Expected: is %#v, but: was %#v", test.Column, test.Value, test.Expect, v)
+		}
+	}
+}
+
+func TestGetFieldValueType(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "code", "varchar(256)")
+
+	tests := []struct {
+		Column    string
+		FieldType string
+		Value     interface{}
+		Expect    interface{}
+	}{
+		{"code", fieldTypeInt, "12", int64(12)},
+		{"code", fieldTypeFloat, "1.5", float64(1.5)},
+		{"id", fieldTypeString, int64(12), "12"},
+		{"code", fieldTypeInt, "abc", "abc"},
+		{"code", fieldTypeJSON, "{invalid", "{invalid"},
+	}
+
+	r := new(River)
+	for _, test := range tests {
+		col := ta.Columns[ta.FindColumn(test.Column)]
+		if v := r.getFieldValue(&col, test.FieldType, test.Value); v != test.Expect {
+			t.Errorf("Type: %s, Value: %#v, Expected: is %#v, but: was %#v", test.FieldType, test.Value, test.Expect, v)
+		}
+	}
+}
+
+func TestMakeInsertReqDataNestedField(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "author_name", "varchar(256)", "author_email", "varchar(256)")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	rule.FieldMapping = map[string]FieldTargets{"author_name": {"author.name"}, "author_email": {"author.email"}}
+
+	req := new(elastic.BulkRequest)
+	r.makeInsertReqData(req, rule, []interface{}{1, "a", "a@b.com"})
+
+	expect := map[string]interface{}{
+		"id":     int64(1),
+		"author": map[string]interface{}{"name": "a", "email": "a@b.com"},
+	}
+	if !reflect.DeepEqual(req.Data, expect) {
+		t.Errorf("Expected: is %v, but: was %v", expect, req.Data)
+	}
+}
+
+func TestGetFieldValueJSON(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "info", "text")
+
+	r := new(River)
+	col := ta.Columns[1]
+	v := r.getFieldValue(&col, fieldTypeJSON, []byte(`{"first": "a", "second": [1, 2]}`))
+
+	expect := map[string]interface{}{"first": "a", "second": []interface{}{float64(1), float64(2)}}
+	if !reflect.DeepEqual(v, expect) {
+		t.Errorf("Expected: is %v, but: was %v", expect, v)
+	}
+}
+
+func TestMakeRequestRouting(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "tenant_id", "int", "title", "varchar(256)")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	rule.RoutingColumn = "tenant_id"
+
+	reqs, err := r.makeDeleteRequest(rule, [][]interface{}{{1, 10, "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs[0].Routing != "10" {
+		t.Errorf("Expected: is \"10\", but: was \"%s\"", reqs[0].Routing)
+	}
+
+	// move the doc to another routing
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{1, 10, "a"}, {1, 20, "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 2 || reqs[0].Action != elastic.ActionDelete || reqs[0].Routing != "10" ||
+		reqs[1].Action != elastic.ActionIndex || reqs[1].Routing != "20" {
+		t.Errorf("Expected: is delete with 10 and index with 20, but: was %+v, %+v", reqs[0], reqs[1])
+	}
+
+	// NULL means no routing
+	reqs, err = r.makeInsertRequest(rule, [][]interface{}{{2, nil, "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs[0].Routing != "" {
+		t.Errorf("Expected: is no routing for NULL, but: was \"%s\"", reqs[0].Routing)
+	}
+	if atomic.LoadInt32(&rule.nullRoutingWarned) != 1 {
+		t.Error("Expected: the NULL routing is warned, but: was not")
+	}
+
+	// the []byte value is the string, like the doc id
+	reqs, err = r.makeInsertRequest(rule, [][]interface{}{{3, []byte("12"), "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs[0].Routing != "12" {
+		t.Errorf("Expected: is \"12\", but: was \"%s\"", reqs[0].Routing)
+	}
+}
+
+func TestMakeRequestParent(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "pid", "int")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	rule.Parent = "pid"
+
+	reqs, err := r.makeDeleteRequest(rule, [][]interface{}{{1, 10}, {2, nil}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs[0].Parent != "10" || reqs[1].Parent != "" {
+		t.Errorf("Expected: is \"10\" and \"\", but: was \"%s\" and \"%s\"", reqs[0].Parent, reqs[1].Parent)
+	}
+}
+
+func TestSyncLoopFlushOnClose(t *testing.T) {
+	var bulkNum int32
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&bulkNum, 1)
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	})
+	defer closeFn()
+
+	// never flush before closing
+	r.c.BulkSize = 1024
+	r.c.FlushBulkTime = TomlDuration{time.Hour}
+
+	pos := mysql.Position{Name: "mysql-bin.000001", Pos: 4}
+	r.syncCh <- testBulkRequests()
+	r.syncCh <- posSaver{pos, false, nil}
+	r.syncCh <- testBulkRequests()
+
+	r.wg.Add(1)
+	r.cancel()
+	r.syncLoop()
+
+	if n := atomic.LoadInt32(&bulkNum); n != 1 {
+		t.Errorf("Bulk Expected: is 1, but: was %d", n)
+	}
+	if r.master.Position() != pos {
+		t.Errorf("Position Expected: is %s, but: was %s", pos, r.master.Position())
+	}
+	if err := r.sync(testBulkRequests()); err == nil {
+		t.Error("Expected: an error for syncing after closed, but: was nil")
+	}
+}
+
+func TestMakeInsertReqDataColumns(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(256)", "content", "text", "secret", "varchar(32)")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	rule.IncludeColumns = []string{"title", "secret"}
+	rule.ExcludeColumns = []string{"secret"}
+	if err := rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{1, "a", "b", "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// id is still used for the doc id, but not in the doc
+	expect := map[string]interface{}{"title": "a"}
+	if reqs[0].ID != "1" || !reflect.DeepEqual(reqs[0].Data, expect) {
+		t.Errorf("Expected: is 1 %v, but: was %s %v", expect, reqs[0].ID, reqs[0].Data)
+	}
+
+	rule.ExcludeColumns = []string{"name"}
+	if err := rule.checkTable(); err == nil {
+		t.Error("Expected: an error for unknown exclude column, but: was nil")
+	}
+}
+
+func TestOnRowMultipleRules(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {})
+	defer closeFn()
+
+	ta := newTestTable([]string{"id"}, "id", "int", "name", "varchar(256)", "email", "varchar(256)")
+
+	rule := newTestRule(ta)
+	rule.Index = "users"
+	publicRule := newTestRule(ta)
+	publicRule.Index = "users_public"
+	publicRule.ExcludeColumns = []string{"email"}
+	r.rules = map[string][]*Rule{ruleKey(ta.Schema, ta.Name): {rule, publicRule}}
+
+	if err := checkRuleIndices(r.rules[ruleKey(ta.Schema, ta.Name)]); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &eventHandler{r}
+	for _, action := range []string{canal.InsertAction, canal.DeleteAction} {
+		err := h.OnRow(&canal.RowsEvent{Table: ta, Action: action, Rows: [][]interface{}{{1, "a", "a@b.c"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reqs := (<-r.syncCh).([]*elastic.BulkRequest)
+		if len(reqs) != 2 || reqs[0].Index != "users" || reqs[1].Index != "users_public" {
+			t.Fatalf("Expected: is requests for users and users_public, but: was %+v", reqs)
+		}
+		if action == canal.InsertAction && (len(reqs[0].Data) != 3 || len(reqs[1].Data) != 2) {
+			t.Errorf("Expected: is independent docs, but: was %v and %v", reqs[0].Data, reqs[1].Data)
+		}
+		if action == canal.DeleteAction && (reqs[0].Action != elastic.ActionDelete || reqs[1].Action != elastic.ActionDelete) {
+			t.Errorf("Expected: is deletes, but: was %s and %s", reqs[0].Action, reqs[1].Action)
+		}
+	}
+
+	publicRule.Index = "users"
+	if err := checkRuleIndices(r.rules[ruleKey(ta.Schema, ta.Name)]); err == nil {
+		t.Error("Expected: an error for duplicate index, but: was nil")
+	}
+}
+
+func TestMakeRowsRequestColumnCount(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(256)")
+
+	r := new(River)
+	r.c = &Config{ColumnMismatch: columnMismatchError}
+	if _, err := r.makeRowsRequest(newTestRule(ta), canal.InsertAction, [][]interface{}{{1}}); err == nil {
+		t.Error("Expected: an error for the mismatched columns, but: was nil")
+	}
+
+	r.c.ColumnMismatch = columnMismatchSkip
+	reqs, err := r.makeRowsRequest(newTestRule(ta), canal.UpdateAction, [][]interface{}{{1, "a"}, {1}})
+	if err != nil || len(reqs) != 0 {
+		t.Errorf("Expected: is the skipped rows, but: was %v, %v", reqs, err)
+	}
+
+	r.c.ColumnMismatch = columnMismatchAdjust
+	rows := [][]interface{}{{1}, {2, "b", "extra"}}
+	reqs, err = r.makeRowsRequest(newTestRule(ta), canal.InsertAction, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("Expected: is 2 requests, but: was %d", len(reqs))
+	}
+	if title, ok := reqs[0].Data["title"]; !ok || title != nil {
+		t.Errorf("Expected: is the padded NULL title, but: was %v", reqs[0].Data)
+	}
+	if len(reqs[1].Data) != 2 || reqs[1].Data["title"] != "b" {
+		t.Errorf("Expected: is the truncated row, but: was %v", reqs[1].Data)
+	}
+	if len(rows[0]) != 1 {
+		t.Errorf("Expected: is the rows not modified, but: was %v", rows)
+	}
+}
+
+func TestMakeRowsRequestIgnoreEvents(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(256)")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	rule.IgnoreEvents = []string{canal.UpdateAction, canal.DeleteAction}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := r.makeRowsRequest(rule, canal.InsertAction, [][]interface{}{{1, "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 {
+		t.Errorf("Expected: is the insert, but: was %+v", reqs)
+	}
+
+	for _, action := range rule.IgnoreEvents {
+		if reqs, err = r.makeRowsRequest(rule, action, [][]interface{}{{1, "a"}, {1, "b"}}); err != nil || len(reqs) != 0 {
+			t.Errorf("%s Expected: is ignored, but: was %+v, %v", action, reqs, err)
+		}
+	}
+
+	rule.IgnoreEvents = []string{canal.InsertAction, canal.UpdateAction, canal.DeleteAction}
+	if err = rule.prepare(); err == nil {
+		t.Error("Expected: an error for ignoring all events, but: was nil")
+	}
+
+	rule.IgnoreEvents = []string{"truncate"}
+	if err = rule.prepare(); err == nil {
+		t.Error("Expected: an error for invalid event, but: was nil")
+	}
+}
+
+func TestMakeRequestTimeZone(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "created_at", "datetime", "updated_at", "timestamp")
+
+	r := new(River)
+	r.c = new(Config)
+	r.c.MyTimeZone = "America/New_York"
+	if err := r.c.prepare(); err != nil {
+		t.Skipf("no time zone data, %v", err)
+	}
+	rule := newTestRule(ta)
+
+	// across the DST start on 2021-03-14 and end on 2021-11-07 at 02:00
+	tests := []struct {
+		DateTime  string
+		Timestamp string
+		Expected  string
+	}{
+		{"2021-03-14 01:59:59", "2021-03-14 06:59:59", "2021-03-14T06:59:59Z"},
+		{"2021-03-14 03:00:00", "2021-03-14 07:00:00", "2021-03-14T07:00:00Z"},
+		{"2021-07-01 12:00:00.123456", "2021-07-01 16:00:00.123456", "2021-07-01T16:00:00.123456Z"},
+		{"2021-11-07 00:59:59", "2021-11-07 04:59:59", "2021-11-07T04:59:59Z"},
+		// 01:30 is repeated, the DATETIME is taken as the first one in EDT
+		{"2021-11-07 01:30:00", "2021-11-07 05:30:00", "2021-11-07T05:30:00Z"},
+		{"2021-11-07 02:00:00", "2021-11-07 07:00:00", "2021-11-07T07:00:00Z"},
+		{"2021-12-31 23:00:00", "2022-01-01 04:00:00", "2022-01-01T04:00:00Z"},
+	}
+	for _, test := range tests {
+		reqs, err := r.makeInsertRequest(rule, [][]interface{}{{1, test.DateTime, test.Timestamp}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := reqs[0].Data["created_at"]; v != test.Expected {
+			t.Errorf("DATETIME %s Expected: is %s, but: was %v", test.DateTime, test.Expected, v)
+		}
+		if v := reqs[0].Data["updated_at"]; v != test.Expected {
+			t.Errorf("TIMESTAMP %s Expected: is %s, but: was %v", test.Timestamp, test.Expected, v)
+		}
+	}
+
+	// the TIMESTAMP in the repeated hour is kept exactly, 06:30 UTC is the second 01:30 in EST
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{1, nil, "2021-11-07 06:30:00"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := reqs[0].Data["updated_at"]; v != "2021-11-07T06:30:00Z" {
+		t.Errorf("TIMESTAMP Expected: is 2021-11-07T06:30:00Z, but: was %v", v)
+	}
+
+	cfg := r.newCanalConfig()
+	if cfg.TimestampStringLocation != time.UTC {
+		t.Errorf("Expected: is the binlog TIMESTAMP in UTC, but: was %v", cfg.TimestampStringLocation)
+	}
+	if len(cfg.Dump.ExtraOptions) != 1 || cfg.Dump.ExtraOptions[0] != "--tz-utc" {
+		t.Errorf("Expected: is the dump TIMESTAMP in UTC, but: was %v", cfg.Dump.ExtraOptions)
+	}
+
+	// the index date is the day in my_time_zone, 2021-03-14T03:00:00Z is 22:00 the day before
+	rule.IndexPattern = "logs-{YYYY}.{MM}.{DD}"
+	rule.IndexDateColumn = "id"
+	if index, err := r.getIndex(rule, []interface{}{1615690800, nil, nil}); err != nil || index != "logs-2021.03.13" {
+		t.Errorf("Expected: is logs-2021.03.13, but: was %s, %v", index, err)
+	}
+	rule.IndexDateColumn = "updated_at"
+	if index, err := r.getIndex(rule, []interface{}{1, nil, "2021-03-14 03:00:00"}); err != nil || index != "logs-2021.03.13" {
+		t.Errorf("Expected: is logs-2021.03.13 for the TIMESTAMP, but: was %s, %v", index, err)
+	}
+
+	r.c.MyTimeZone = "Mars/Olympus"
+	if err := r.c.prepare(); err == nil {
+		t.Error("Expected: an error for the invalid time zone, but: was nil")
+	}
+}
+
+func TestMakeRequestIndexPattern(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "created_at", "datetime")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	rule.IndexPattern = "Logs-{YYYY}.{MM}.{DD}"
+	rule.IndexDateColumn = "created_at"
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := r.makeDeleteRequest(rule, [][]interface{}{{1, "2024-01-02 10:00:00"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs[0].Index != "logs-2024.01.02" {
+		t.Errorf("Expected: is logs-2024.01.02, but: was %s", reqs[0].Index)
+	}
+
+	// move the doc to another day index
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{1, "2024-01-02 10:00:00"}, {1, "2024-01-03 10:00:00"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 2 || reqs[0].Action != elastic.ActionDelete || reqs[0].Index != "logs-2024.01.02" ||
+		reqs[1].Action != elastic.ActionIndex || reqs[1].Index != "logs-2024.01.03" {
+		t.Errorf("Expected: is delete and index in the day indices, but: was %+v, %+v", reqs[0], reqs[1])
+	}
+
+	if _, err = r.makeInsertRequest(rule, [][]interface{}{{1, nil}}); err == nil {
+		t.Error("Expected: an error for NULL index date, but: was nil")
+	}
+
+	rule.IndexDateColumn = ""
+	if err = rule.prepare(); err == nil {
+		t.Error("Expected: an error for no index_date_column, but: was nil")
+	}
+}
+
+func TestBulkItemError(t *testing.T) {
+	var bulkNum int32
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&bulkNum, 1)
+		w.Write([]byte(`{"took":1,"errors":true,"items":[{"index":{"_index":"river","_type":"river","_id":"1","status":400,` +
+			`"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}]}`))
+	})
+	defer closeFn()
+
+	r.c.MaxBulkRetry = 2
+
+	// only logged by default
+	if err := r.doBulk(r.ctx, testBulkRequests()); err != nil {
+		t.Fatal(err)
+	}
+
+	r.c.StopOnBulkItemError = true
+	if err := r.doBulk(r.ctx, testBulkRequests()); err == nil {
+		t.Error("Expected: an error for the failed item, but: was nil")
+	}
+
+	// the failed items are never retried
+	if n := atomic.LoadInt32(&bulkNum); n != 2 {
+		t.Errorf("Bulk Expected: is 2, but: was %d", n)
+	}
+}
+
+func TestMakeRequestVersion(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(256)", "version", "bigint")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	rule.VersionColumn = "version"
+	if err := rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := r.makeDeleteRequest(rule, [][]interface{}{{1, "a", int64(3)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs[0].Version != 3 {
+		t.Errorf("Expected: is 3, but: was %d", reqs[0].Version)
+	}
+
+	// the update API doesn't support the external version
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{1, "a", int64(3)}, {1, "b", int64(4)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs[0].Action != elastic.ActionIndex || reqs[0].Version != 4 || len(reqs[0].Data) != 3 {
+		t.Errorf("Expected: is index with version 4, but: was %+v", reqs[0])
+	}
+
+	if _, err = r.makeInsertRequest(rule, [][]interface{}{{1, "a", nil}}); err == nil {
+		t.Error("Expected: an error for NULL version, but: was nil")
+	}
+
+	rule.VersionColumn = "title"
+	if err = rule.checkTable(); err == nil {
+		t.Error("Expected: an error for non-integer version column, but: was nil")
+	}
+}
+
+func TestBulkVersionConflict(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"took":1,"errors":true,"items":[{"index":{"_index":"river","_type":"river","_id":"1","status":409,` +
+			`"error":{"type":"version_conflict_engine_exception","reason":"version conflict"}}}]}`))
+	})
+	defer closeFn()
+
+	r.c.StopOnBulkItemError = true
+
+	reqs := testBulkRequests()
+	if err := r.doBulk(r.ctx, reqs); err == nil {
+		t.Error("Expected: an error for the conflict without version, but: was nil")
+	}
+
+	reqs[0].Version = 3
+	if err := r.doBulk(r.ctx, reqs); err != nil {
+		t.Errorf("Expected: the older version is ignored, but: was %v", err)
+	}
+}
+
+// versionedES is a fake ES bulk API keeping the external versions of the docs.
+type versionedES struct {
+	sync.Mutex
+	versions map[string]int64
+}
+
+func (es *versionedES) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	es.Lock()
+	defer es.Unlock()
+
+	var items []string
+	dec := json.NewDecoder(req.Body)
+	for {
+		var meta map[string]struct {
+			ID          string `json:"_id"`
+			Version     int64  `json:"version"`
+			VersionType string `json:"version_type"`
+		}
+		if err := dec.Decode(&meta); err != nil {
+			break
+		}
+		for action, m := range meta {
+			if action != elastic.ActionDelete {
+				// skip the doc line
+				var doc json.RawMessage
+				dec.Decode(&doc)
+			}
+
+			current, ok := es.versions[m.ID]
+			if ok && (m.VersionType == "external" && m.Version <= current ||
+				m.VersionType == "external_gte" && m.Version < current) {
+				items = append(items, fmt.Sprintf(`{"%s":{"_index":"river","_id":"%s","status":409,`+
+					`"error":{"type":"version_conflict_engine_exception"}}}`, action, m.ID))
+				continue
+			}
+
+			if action == elastic.ActionDelete {
+				delete(es.versions, m.ID)
+			} else {
+				es.versions[m.ID] = m.Version
+			}
+			items = append(items, fmt.Sprintf(`{"%s":{"_index":"river","_id":"%s","status":200}}`, action, m.ID))
+		}
+	}
+
+	data := strings.Join(items, ",")
+	fmt.Fprintf(w, `{"took":1,"errors":%t,"items":[%s]}`, strings.Contains(data, "error"), data)
+}
+
+func TestBulkVersionDelete(t *testing.T) {
+	es := &versionedES{versions: make(map[string]int64)}
+	r, closeFn := newTestRiver(t, es.ServeHTTP)
+	defer closeFn()
+
+	r.c.StopOnBulkItemError = true
+	r.es.Version = 7
+
+	reqs := testBulkRequests()
+	reqs[0].Version = 3
+	if err := r.doBulk(r.ctx, reqs); err != nil {
+		t.Fatal(err)
+	}
+
+	// the deleted row has the same version as the indexed one
+	del := []*elastic.BulkRequest{{Action: elastic.ActionDelete, Index: "river", Type: "river", ID: "1", Version: 3}}
+	if err := r.doBulk(r.ctx, del); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := es.versions["1"]; ok {
+		t.Error("Doc Expected: is deleted, but: was found")
+	}
+
+	// the doc is newer than the deleted row, so the conflict is ignored and the doc is kept
+	reqs[0].Version = 5
+	if err := r.doBulk(r.ctx, reqs); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.doBulk(r.ctx, del); err != nil {
+		t.Errorf("Expected: the delete conflict is ignored, but: was %v", err)
+	}
+	if v := es.versions["1"]; v != 5 {
+		t.Errorf("Version Expected: is 5, but: was %d", v)
+	}
+}
+
+func TestDoBulkWorkers(t *testing.T) {
+	var bulkNum int32
+	var mu sync.Mutex
+	docs := make(map[string][]string)
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&bulkNum, 1)
+		data, _ := ioutil.ReadAll(req.Body)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+		mu.Lock()
+		for _, line := range lines {
+			var meta map[string]map[string]interface{}
+			if json.Unmarshal([]byte(line), &meta) != nil {
+				continue
+			}
+			for action, m := range meta {
+				if id, ok := m["_id"].(string); ok {
+					docs[id] = append(docs[id], action)
+				}
+			}
+		}
+		mu.Unlock()
+
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	})
+	defer closeFn()
+
+	r.c.BulkSize = 2
+	r.c.BulkWorkers = 4
+
+	var reqs []*elastic.BulkRequest
+	for i := 0; i < 10; i++ {
+		id := strconv.Itoa(i)
+		reqs = append(reqs, &elastic.BulkRequest{Action: elastic.ActionIndex, Index: "river", ID: id, Data: map[string]interface{}{"id": i}})
+	}
+	for i := 0; i < 10; i++ {
+		reqs = append(reqs, &elastic.BulkRequest{Action: elastic.ActionDelete, Index: "river", ID: strconv.Itoa(i)})
+	}
+
+	if err := r.doBulk(r.ctx, reqs); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&bulkNum); n < 10 {
+		t.Errorf("Bulk Expected: is at least 10, but: was %d", n)
+	}
+	for id, actions := range docs {
+		if !reflect.DeepEqual(actions, []string{elastic.ActionIndex, elastic.ActionDelete}) {
+			t.Errorf("Doc %s Expected: is index then delete, but: was %v", id, actions)
+		}
+	}
+	if len(docs) != 10 {
+		t.Errorf("Expected: is 10 docs, but: was %d", len(docs))
+	}
+}
+
+func TestMakeReqDataTemplate(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "first_name", "varchar(32)", "last_name", "varchar(32)")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	rule.FieldMapping = map[string]FieldTargets{"last_name": {"surname"}}
+	rule.Templates = map[string]string{
+		"full_name": "{{.first_name}} {{.surname}}",
+		"bad":       "{{.first_name.unknown}}",
+	}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{1, "John", "Smith"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{"id": int64(1), "first_name": "John", "surname": "Smith", "full_name": "John Smith"}
+	if !reflect.DeepEqual(reqs[0].Data, expect) {
+		t.Errorf("Expected: is %v, but: was %v", expect, reqs[0].Data)
+	}
+
+	// the unchanged fields are used too
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{1, "John", "Smith"}, {1, "Jane", "Smith"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = map[string]interface{}{"first_name": "Jane", "full_name": "Jane Smith"}
+	if !reflect.DeepEqual(reqs[0].Data, expect) {
+		t.Errorf("Expected: is %v, but: was %v", expect, reqs[0].Data)
+	}
+
+	// NULL is an empty string
+	reqs, err = r.makeInsertRequest(rule, [][]interface{}{{2, "Jane", nil}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := reqs[0].Data["full_name"]; v != "Jane " {
+		t.Errorf("Expected: is \"Jane \", but: was %q", v)
+	}
+
+	rule.Templates = map[string]string{"full_name": "{{.first_name"}
+	if err = rule.prepare(); err == nil {
+		t.Error("Expected: an error for the invalid template, but: was nil")
+	}
+}
+
+func TestMakeReqDataValueMapping(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "status", "tinyint", "state", "varchar(32)")
+
+	var rule Rule
+	_, err := toml.Decode(`
+[value_mapping.status]
+0 = "draft"
+1 = "active"
+
+[value_mapping.state]
+"CA" = "California"
+`, &rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := new(River)
+	rule.TableInfo = ta
+	rule.FieldMapping = map[string]FieldTargets{"state": {"state_name"}}
+	if err = rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(elastic.BulkRequest)
+	r.makeInsertReqData(req, &rule, []interface{}{1, int8(1), []byte("CA")})
+	expect := map[string]interface{}{"id": int64(1), "status": "active", "state_name": "California"}
+	if !reflect.DeepEqual(req.Data, expect) {
+		t.Errorf("Expected: is %v, but: was %v", expect, req.Data)
+	}
+
+	// the unmapped values are not changed
+	r.makeInsertReqData(req, &rule, []interface{}{1, int8(2), "NY"})
+	expect = map[string]interface{}{"id": int64(1), "status": int64(2), "state_name": "NY"}
+	if !reflect.DeepEqual(req.Data, expect) {
+		t.Errorf("Expected: is %v, but: was %v", expect, req.Data)
+	}
+
+	rule.ValueMapping["name"] = map[string]interface{}{"a": "b"}
+	if err = rule.checkTable(); err == nil {
+		t.Error("Expected: an error for unknown value_mapping column, but: was nil")
+	}
+}
+
+func TestMakeInsertReqDataBool(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "deleted", "tinyint(1)", "level", "tinyint(4)")
+
+	tests := []struct {
+		AsNumber bool
+		Value    interface{}
+		Expect   interface{}
+	}{
+		{false, int8(0), false},
+		{false, int8(1), true},
+		{false, nil, nil},
+		{true, int8(0), int64(0)},
+		{true, int8(1), int64(1)},
+		{true, nil, nil},
+	}
+
+	r := new(River)
+	for _, test := range tests {
+		rule := newTestRule(ta)
+		rule.TinyInt1AsNumber = test.AsNumber
+
+		req := new(elastic.BulkRequest)
+		r.makeInsertReqData(req, rule, []interface{}{1, test.Value, int8(1)})
+
+		if v := req.Data["deleted"]; v != test.Expect {
+			t.Errorf("AsNumber: %t, Value: %v, Expected: is %v, but: was %v", test.AsNumber, test.Value, test.Expect, v)
+		}
+		// only tinyint(1) is a boolean
+		if v := req.Data["level"]; v != int64(1) {
+			t.Errorf("Expected: is 1, but: was %v", v)
+		}
+	}
+}
+
+func TestMakeInsertReqDataEnumSet(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "tenum", "enum('e1','e2')", "tset", "set('a','b','c')")
+
+	tests := []struct {
+		Enum       interface{}
+		Set        interface{}
+		ExpectEnum interface{}
+		ExpectSet  interface{}
+	}{
+		// binlog
+		{int64(2), int64(5), "e2", []string{"a", "c"}},
+		{int64(3), int64(0), "", []string{}},
+		// dump
+		{"e1", "a,b", "e1", []string{"a", "b"}},
+		{[]byte("e1"), []byte(""), "e1", []string{}},
+		{nil, nil, nil, nil},
+	}
+
+	r := new(River)
+	rule := newTestRule(ta)
+	for _, test := range tests {
+		req := new(elastic.BulkRequest)
+		r.makeInsertReqData(req, rule, []interface{}{1, test.Enum, test.Set})
+
+		if v := req.Data["tenum"]; v != test.ExpectEnum {
+			t.Errorf("Enum: %v, Expected: is %q, but: was %v", test.Enum, test.ExpectEnum, v)
+		}
+		if v := req.Data["tset"]; !reflect.DeepEqual(v, test.ExpectSet) {
+			t.Errorf("Set: %v, Expected: is %v, but: was %v", test.Set, test.ExpectSet, v)
+		}
+	}
+}
+
+func TestSyncLoopCancelInflightBulk(t *testing.T) {
+	done := make(chan struct{})
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-done:
+		case <-req.Context().Done():
+		}
+	})
+	defer closeFn()
+	defer close(done)
+
+	r.wg.Add(1)
+	go r.syncLoop()
+
+	r.syncCh <- testBulkRequests()
+	r.syncCh <- posSaver{mysql.Position{Name: "mysql-bin.000001", Pos: 4}, true, nil}
+
+	time.Sleep(50 * time.Millisecond)
+	r.cancel()
+
+	waitCh := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(waitCh)
+	}()
+
+	select {
+	case <-waitCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sync is not closed with the in-flight bulk")
+	}
+
+	if pos := r.master.Position(); pos != (mysql.Position{}) {
+		t.Errorf("Position Expected: is not saved, but: was %s", pos)
+	}
+}
+
+func TestMakeUpdateRequestNoop(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(256)", "updated_at", "datetime")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	rule.ExcludeColumns = []string{"updated_at"}
+
+	reqs, err := r.makeUpdateRequest(rule, [][]interface{}{
+		{1, "a", "2019-01-01 00:00:00"}, {1, "a", "2019-01-02 00:00:00"},
+		{2, "a", "2019-01-01 00:00:00"}, {2, "b", "2019-01-02 00:00:00"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || reqs[0].ID != "2" {
+		t.Errorf("Expected: is only the update for 2, but: was %+v", reqs)
+	}
+
+	// the templates may use any column
+	rule.Templates = map[string]string{"updated": "{{.updated_at}}"}
+	if err = rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{1, "a", "2019-01-01 00:00:00"}, {1, "a", "2019-01-02 00:00:00"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 {
+		t.Errorf("Expected: is the update with the template, but: was %+v", reqs)
+	}
+}
+
+func TestSyncLoopDryRun(t *testing.T) {
+	var bulkNum int32
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&bulkNum, 1)
+	})
+	defer closeFn()
+
+	r.c.DryRun = true
+
+	r.wg.Add(1)
+	go r.syncLoop()
+
+	pos := mysql.Position{Name: "mysql-bin.000001", Pos: 4}
+	r.syncCh <- testBulkRequests()
+	r.syncCh <- posSaver{pos, true, nil}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for r.master.Position() != pos && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if r.master.Position() != pos {
+		t.Errorf("Position Expected: is %s, but: was %s", pos, r.master.Position())
+	}
+	if n := atomic.LoadInt32(&bulkNum); n != 0 {
+		t.Errorf("Bulk Expected: is 0, but: was %d", n)
+	}
+}
+
+func TestBulkRejected(t *testing.T) {
+	var bulkNum int32
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		switch atomic.AddInt32(&bulkNum, 1) {
+		case 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":{"type":"es_rejected_execution_exception"},"status":429}`))
+		case 2, 3:
+			w.Write([]byte(`{"took":1,"errors":true,"items":[{"index":{"_index":"river","_type":"river","_id":"1","status":429,` +
+				`"error":{"type":"es_rejected_execution_exception","reason":"rejected execution"}}}]}`))
+		default:
+			w.Write([]byte(`{"took":1,"errors":false,"items":[{"index":{"_index":"river","_type":"river","_id":"1","status":201}}]}`))
+		}
+	})
+	defer closeFn()
+
+	// the rejected bulks are retried without counting in max_bulk_retry,
+	// and the backoff doesn't exceed max_bulk_backoff
+	r.c.MaxBulkBackoff = TomlDuration{2 * time.Millisecond}
+	start := time.Now()
+	if err := r.doBulk(r.ctx, testBulkRequests()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&bulkNum); n != 4 {
+		t.Errorf("Bulk Expected: is 4, but: was %d", n)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected: is less than 1s, but: was %s", d)
+	}
+
+	// the waiting is cancelled with the ctx
+	atomic.StoreInt32(&bulkNum, 0)
+	r.c.MaxBulkBackoff = TomlDuration{time.Hour}
+	r.c.BulkRetryBackoff = TomlDuration{time.Hour}
+	time.AfterFunc(10*time.Millisecond, r.cancel)
+	if err := r.doBulk(r.ctx, testBulkRequests()); err == nil {
+		t.Error("Expected: an error for the cancelled retry, but: was nil")
+	}
+}
+
+func TestBulkRejectedItems(t *testing.T) {
+	var bodies []string
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, string(data))
+		if len(bodies) == 1 {
+			w.Write([]byte(`{"took":1,"errors":true,"items":[{"index":{"_index":"river","_type":"river","_id":"1","status":201}},` +
+				`{"index":{"_index":"river","_type":"river","_id":"2","status":429,"error":{"type":"es_rejected_execution_exception"}}}]}`))
+			return
+		}
+		w.Write([]byte(`{"took":1,"errors":false,"items":[{"index":{"_index":"river","_type":"river","_id":"2","status":201}}]}`))
+	})
+	defer closeFn()
+	r.c.BulkSize = 10
+
+	reqs := []*elastic.BulkRequest{
+		{Action: elastic.ActionIndex, Index: "river", Type: "river", ID: "1", Data: map[string]interface{}{"title": "first"}},
+		{Action: elastic.ActionIndex, Index: "river", Type: "river", ID: "2", Data: map[string]interface{}{"title": "second"}},
+	}
+	if err := r.doBulk(r.ctx, reqs); err != nil {
+		t.Fatal(err)
+	}
+
+	// the accepted item is not sent again
+	expected := `{"index":{"_id":"2","_index":"river","_type":"river"}}` + "\n" + `{"title":"second"}` + "\n"
+	if len(bodies) != 2 || bodies[1] != expected {
+		t.Errorf("Retry Expected: is %q, but: was %q", expected, bodies)
+	}
+}
+
+func TestSyncLoopSubscribe(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	})
+	defer closeFn()
+
+	// no bulk until closing
+	r.c.BulkSize = 10
+	r.c.FlushBulkTime = TomlDuration{time.Hour}
+
+	sub := r.Subscribe(1)
+	// never read, so it doesn't stall the sync
+	r.Subscribe(0)
+
+	r.wg.Add(1)
+	go r.syncLoop()
+
+	reqs := testBulkRequests()
+	r.syncCh <- reqs
+	select {
+	case v := <-sub:
+		if len(v) != 1 || v[0] != reqs[0] {
+			t.Errorf("Expected: is %+v, but: was %+v", reqs, v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected: the requests for the subscriber, but: was not received")
+	}
+
+	r.syncCh <- testBulkRequests()
+	r.cancel()
+	r.wg.Wait()
+
+	// the subscriber channel is closed with the sync
+	n := 0
+	for range sub {
+		n++
+	}
+	if n != 1 {
+		t.Errorf("Expected: is 1 batch before closing, but: was %d", n)
+	}
+}
+
+func TestMakeInsertReqDataBinary(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(256)", "data", "blob", "hash", "binary(4)")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	if err := rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the non UTF-8 bytes
+	data := []byte{0xff, 0xfe, 0x00, 0x80}
+	values := []interface{}{1, "a", data, string(data)}
+
+	// skipped by default
+	req := new(elastic.BulkRequest)
+	r.makeInsertReqData(req, rule, values)
+	if _, ok := req.Data["data"]; ok {
+		t.Errorf("Expected: data is skipped, but: was %v", req.Data)
+	}
+	if _, ok := req.Data["hash"]; ok {
+		t.Errorf("Expected: hash is skipped, but: was %v", req.Data)
+	}
+	if req.Data["title"] != "a" {
+		t.Errorf("title Expected: is a, but: was %v", req.Data["title"])
+	}
+
+	// the skipped columns don't make an update
+	updated := []interface{}{1, "a", []byte{0x01}, string(data)}
+	if !r.isNoopUpdate(rule, values, updated) {
+		t.Error("Expected: is a noop update for the skipped column, but: was not")
+	}
+
+	tests := []struct {
+		mode     string
+		expected string
+	}{
+		{binaryModeBase64, "//4AgA=="},
+		{binaryModeHex, "fffe0080"},
+	}
+	for _, test := range tests {
+		rule.BinaryMode = test.mode
+		if err := rule.checkTable(); err != nil {
+			t.Fatal(err)
+		}
+
+		req = new(elastic.BulkRequest)
+		r.makeInsertReqData(req, rule, values)
+		if req.Data["data"] != test.expected || req.Data["hash"] != test.expected {
+			t.Errorf("%s Expected: is %s, but: was %v", test.mode, test.expected, req.Data)
+		}
+
+		// the encoded bytes are kept in the JSON
+		body, err := json.Marshal(req.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(body), test.expected) {
+			t.Errorf("%s Expected: JSON has %s, but: was %s", test.mode, test.expected, body)
+		}
+	}
+
+	rule.BinaryMode = "raw"
+	if err := rule.prepare(); err == nil {
+		t.Error("Expected: an error for invalid binary_mode, but: was nil")
+	}
+}
+
+func TestMakeRequestSoftDelete(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(256)", "deleted_at", "datetime")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	rule.ExcludeColumns = []string{"deleted_at"}
+	rule.SoftDeleteColumn = "deleted_at"
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{1, "a", nil}, {2, "b", "0000-00-00 00:00:00"}, {3, "c", "2019-01-01 00:00:00"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, deleted := range []bool{false, false, true} {
+		if reqs[i].Data[defaultSoftDeleteField] != deleted {
+			t.Errorf("%s Expected: deleted is %v, but: was %v", reqs[i].ID, deleted, reqs[i].Data)
+		}
+	}
+
+	// soft deleting the row updates the doc, even the column is excluded
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{
+		{1, "a", nil}, {1, "a", "2019-01-01 00:00:00"},
+		{2, "b", nil}, {2, "c", nil},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("Expected: is 2 updates, but: was %+v", reqs)
+	}
+	if reqs[0].Action != elastic.ActionUpdate || !reflect.DeepEqual(reqs[0].Data, map[string]interface{}{"deleted": true}) {
+		t.Errorf("Expected: is the update with deleted, but: was %+v", reqs[0])
+	}
+	if _, ok := reqs[1].Data[defaultSoftDeleteField]; ok {
+		t.Errorf("Expected: is the update without deleted, but: was %+v", reqs[1])
+	}
+
+	// deleting the row still deletes the doc
+	if reqs, err = r.makeDeleteRequest(rule, [][]interface{}{{1, "a", "2019-01-01 00:00:00"}}); err != nil {
+		t.Fatal(err)
+	}
+	if reqs[0].Action != elastic.ActionDelete {
+		t.Errorf("Expected: is delete, but: was %s", reqs[0].Action)
+	}
+
+	rule.SoftDeleteColumn = "removed"
+	if err = rule.checkTable(); err == nil {
+		t.Error("Expected: an error for unknown soft_delete_column, but: was nil")
+	}
+}
+
+func TestSyncLoopGTIDMode(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	})
+	defer closeFn()
+
+	r.c.GTIDMode = true
+	h := &eventHandler{r}
+
+	r.wg.Add(1)
+	go r.syncLoop()
+
+	// the position is only saved with the GTID set
+	pos := mysql.Position{Name: "mysql-bin.000001", Pos: 120}
+	if err := h.OnXID(pos); err != nil {
+		t.Fatal(err)
+	}
+	gset, _ := mysql.ParseMysqlGTIDSet("3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5")
+	if err := h.OnPosSynced(pos, gset, true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && r.master.GTIDSet() == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if p := r.master.Position(); p != pos {
+		t.Errorf("Position Expected: is %s, but: was %s", pos, p)
+	}
+	if g := r.master.GTIDSet(); g != gset.String() {
+		t.Errorf("GTID Expected: is %s, but: was %s", gset, g)
+	}
+
+	// sync from the saved GTID set after restart
+	if err := r.seedPosition(); err != nil {
+		t.Fatal(err)
+	}
+	if r.startGTID == nil || r.startGTID.String() != gset.String() {
+		t.Errorf("Start GTID Expected: is %s, but: was %v", gset, r.startGTID)
+	}
+}
+
+func TestWaitPending(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	})
+	defer closeFn()
+
+	if err := r.sync(testBulkRequests()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.waitPending(time.Now().Add(50*time.Millisecond), time.Millisecond); err == nil {
+		t.Error("Expected: a timeout error without the sync loop, but: was nil")
+	}
+
+	// received from the sync channel, but not added to the pending requests yet
+	v := <-r.syncCh
+	if err := r.waitPending(time.Now().Add(50*time.Millisecond), time.Millisecond); err == nil {
+		t.Error("Expected: a timeout error for the received requests, but: was nil")
+	}
+	r.syncCh <- v
+
+	r.wg.Add(1)
+	go r.syncLoop()
+
+	if err := r.waitPending(time.Now().Add(5*time.Second), time.Millisecond); err != nil {
+		t.Errorf("Expected: synced, but: was %v", err)
+	}
+}
+
+func TestFieldMappingList(t *testing.T) {
+	var rule Rule
+	if _, err := toml.Decode(`
+schema = "test"
+table = "river"
+[field]
+email = ["email", "email_search,string"]
+title = "es_title"
+`, &rule); err != nil {
+		t.Fatal(err)
+	}
+
+	ta := newTestTable([]string{"id"}, "id", "int", "email", "varchar(64)", "title", "varchar(64)")
+	rule.TableInfo = ta
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := new(River)
+	reqs, err := r.makeInsertRequest(&rule, [][]interface{}{{1, "a@b.com", "first"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{"id": int64(1), "email": "a@b.com", "email_search": "a@b.com", "es_title": "first"}
+	if !reflect.DeepEqual(reqs[0].Data, expect) {
+		t.Errorf("Expected: is %v, but: was %v", expect, reqs[0].Data)
+	}
+
+	rule.FieldMapping["email"] = FieldTargets{"email", ",string"}
+	if err = rule.prepare(); err == nil {
+		t.Error("Expected: an error for the empty field name in the list, but: was nil")
+	}
+}
+
+func TestMakeInsertReqDataList(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "tags", "varchar(256)", "codes", "varchar(256)")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	rule.FieldMapping = map[string]FieldTargets{"tags": {",list"}, "codes": {",list"}}
+	rule.ListSeparator = map[string]string{"codes": ";"}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		tags   interface{}
+		codes  interface{}
+		expect map[string]interface{}
+	}{
+		// single
+		{"go", "a", map[string]interface{}{"tags": []string{"go"}, "codes": []string{"a"}}},
+		// multiple, trimmed and the empty ones dropped
+		{" go, mysql,,es ", []byte("a; b;;c"), map[string]interface{}{"tags": []string{"go", "mysql", "es"}, "codes": []string{"a", "b", "c"}}},
+		// empty and NULL
+		{"", nil, map[string]interface{}{"tags": []string{}, "codes": []string{}}},
+	}
+
+	for _, test := range tests {
+		reqs, err := r.makeInsertRequest(rule, [][]interface{}{{1, test.tags, test.codes}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(reqs[0].Data, "id")
+		if !reflect.DeepEqual(reqs[0].Data, test.expect) {
+			t.Errorf("Tags: %#v, Codes: %#v, Expected: is %v, but: was %v", test.tags, test.codes, test.expect, reqs[0].Data)
+		}
+	}
+
+	rule.NullValueMode = nullValueModeSkip
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{1, "go", nil}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reqs[0].Data["codes"]; ok {
+		t.Errorf("Expected: NULL is skipped, but: was %v", reqs[0].Data["codes"])
+	}
+}
+
+func TestMakeReqDataGeoPoint(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "latitude", "decimal(10,7)", "longitude", "double", "title", "varchar(64)")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	rule.GeoPoints = map[string]GeoPoint{"location": {Lat: "latitude", Lon: "longitude"}}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{1, "52.5200000", 13.405, "a"}, {2, nil, 13.405, "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{"lat": 52.52, "lon": 13.405}
+	if !reflect.DeepEqual(reqs[0].Data["location"], expect) {
+		t.Errorf("Expected: is %v, but: was %v", expect, reqs[0].Data["location"])
+	}
+	if v, ok := reqs[1].Data["location"]; ok {
+		t.Errorf("Expected: no location for NULL latitude, but: was %v", v)
+	}
+
+	// only the changed point is set for update
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{
+		{1, "52.5200000", 13.405, "a"}, {1, "52.5200000", 13.405, "b"},
+		{1, "52.5200000", 13.405, "a"}, {1, "48.8566000", 2.3522, "a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := reqs[0].Data["location"]; ok {
+		t.Errorf("Expected: no location for the unchanged point, but: was %v", v)
+	}
+	expect = map[string]interface{}{"lat": 48.8566, "lon": 2.3522}
+	if !reflect.DeepEqual(reqs[1].Data["location"], expect) {
+		t.Errorf("Expected: is %v, but: was %v", expect, reqs[1].Data["location"])
+	}
+
+	rule.GeoPoints["bad"] = GeoPoint{Lat: "latitude", Lon: "lng"}
+	if err = rule.checkTable(); err == nil {
+		t.Error("Expected: an error for the unknown geo_point column, but: was nil")
+	}
+}
+
+func TestNoPKTable(t *testing.T) {
+	ta := newTestTable(nil, "code", "varchar(32)", "title", "varchar(64)")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	if err := rule.checkTable(); err == nil {
+		t.Error("Expected: an error for the table without PK and id, but: was nil")
+	}
+	if _, err := r.makeInsertRequest(rule, [][]interface{}{{"a", "first"}}); err == nil {
+		t.Error("Expected: an error for the doc id without PK, but: was nil")
+	}
+
+	rule.ID = []string{"code"}
+	if err := rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{"a", "first"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs[0].ID != "a" {
+		t.Errorf("ID Expected: is a, but: was %s", reqs[0].ID)
+	}
+
+	if rulesHaveID([]*Rule{rule, newTestRule(ta)}) {
+		t.Error("Expected: not all the rules have id, but: was true")
+	}
+}
+
+func TestOnRowDenyTables(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {})
+	defer closeFn()
+
+	allowed := newTestTable([]string{"id"}, "id", "int", "title", "varchar(64)")
+	denied := newTestTable([]string{"id"}, "id", "int", "title", "varchar(64)")
+	denied.Name = "internal"
+	r.rules = map[string][]*Rule{
+		ruleKey(allowed.Schema, allowed.Name): {newTestRule(allowed)},
+		ruleKey(denied.Schema, denied.Name):   {newTestRule(denied)},
+	}
+	r.denyTables = map[string]struct{}{ruleKey(denied.Schema, "INTERNAL"): {}}
+
+	h := &eventHandler{r}
+	for _, ta := range []*schema.Table{denied, allowed} {
+		e := &canal.RowsEvent{Table: ta, Action: canal.InsertAction, Rows: [][]interface{}{{1, "first"}}}
+		if err := h.OnRow(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reqs := (<-r.syncCh).([]*elastic.BulkRequest)
+	if len(reqs) != 1 || reqs[0].Index != newTestRule(allowed).Index {
+		t.Errorf("Expected: is only the request of the allowed table, but: was %v", reqs)
+	}
+	select {
+	case v := <-r.syncCh:
+		t.Errorf("Expected: is no request of the denied table, but: was %v", v)
+	default:
+	}
+}
+
+func TestDoBulkMaxBytes(t *testing.T) {
+	var bulkDocs []int
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		bulkDocs = append(bulkDocs, len(strings.Split(strings.TrimSpace(string(data)), "\n"))/2)
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	})
+	defer closeFn()
+
+	newReq := func(id string, size int) *elastic.BulkRequest {
+		return &elastic.BulkRequest{Action: elastic.ActionIndex, Index: "river", ID: id,
+			Data: map[string]interface{}{"content": strings.Repeat("a", size)}}
+	}
+
+	small, err := newReq("1", 10).EncodedSize(r.es.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.c.BulkSize = 10
+	r.c.BulkMaxBytes = small * 2
+
+	// the big request is sent alone
+	reqs := []*elastic.BulkRequest{newReq("1", 10), newReq("2", 10), newReq("3", 10), newReq("4", 1000), newReq("5", 10)}
+	if err := r.doBulk(r.ctx, reqs); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []int{2, 1, 1, 1}
+	if !reflect.DeepEqual(bulkDocs, expect) {
+		t.Errorf("Expected: is %v docs for every bulk, but: was %v", expect, bulkDocs)
+	}
+}
+
+func TestCoalesceRequests(t *testing.T) {
+	newReq := func(action string, id string, routing string) *elastic.BulkRequest {
+		return &elastic.BulkRequest{Action: action, Index: "river", Type: "river", ID: id, Routing: routing}
+	}
+
+	reqs := []*elastic.BulkRequest{
+		newReq(elastic.ActionIndex, "1", ""),
+		newReq(elastic.ActionUpdate, "1", ""),
+		newReq(elastic.ActionIndex, "1", ""),
+		newReq(elastic.ActionIndex, "2", ""),
+		newReq(elastic.ActionDelete, "2", ""),
+		newReq(elastic.ActionIndex, "3", ""),
+		newReq(elastic.ActionUpdate, "3", ""),
+		// the routing is changed, the old doc must be deleted
+		newReq(elastic.ActionDelete, "4", "a"),
+		newReq(elastic.ActionIndex, "4", "b"),
+		newReq(elastic.ActionIndex, "", ""),
+		newReq(elastic.ActionIndex, "", ""),
+		// the partial update is overwritten by the later index
+		newReq(elastic.ActionUpdate, "5", ""),
+		newReq(elastic.ActionIndex, "5", ""),
+	}
+
+	expect := []*elastic.BulkRequest{reqs[2], reqs[4], reqs[5], reqs[6], reqs[7], reqs[8], reqs[9], reqs[10], reqs[12]}
+	kept := coalesceRequests(append([]*elastic.BulkRequest(nil), reqs...))
+	if !reflect.DeepEqual(kept, expect) {
+		t.Errorf("Expected: is %v, but: was %v", expect, kept)
+	}
+}
+
+func TestMakeRequestIndexAffix(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "created_at", "datetime")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	rule.addIndexAffix("Staging_", "_v1")
+
+	reqs, err := r.makeDeleteRequest(rule, [][]interface{}{{1, "2024-01-02 10:00:00"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs[0].Index != "staging_test_sync_v1" || reqs[0].Type != "test_sync" {
+		t.Errorf("Expected: is staging_test_sync_v1 with type test_sync, but: was %s, %s", reqs[0].Index, reqs[0].Type)
+	}
+
+	rule.IndexPattern = "logs-{YYYY}"
+	rule.IndexDateColumn = "created_at"
+	rule.addIndexAffix("staging_", "")
+	for _, action := range []string{canal.InsertAction, canal.DeleteAction} {
+		reqs, err = r.makeRequest(rule, action, [][]interface{}{{1, "2024-01-02 10:00:00"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reqs[0].Index != "staging_logs-2024" {
+			t.Errorf("%s Expected: is staging_logs-2024, but: was %s", action, reqs[0].Index)
+		}
+	}
+}
+
+func TestGetDocIDNormalize(t *testing.T) {
+	ta := newTestTable([]string{"email", "tenant"}, "email", "varchar(256)", "tenant", "varchar(64)", "id", "int")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	row := []interface{}{" User@X.com ", "Acme", 1}
+	id, err := r.getDocID(rule, row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != " User@X.com :Acme" {
+		t.Errorf("Expected: is the unchanged id, but: was %q", id)
+	}
+
+	rule.IDNormalize = []string{idNormalizeLower, idNormalizeTrim}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range [][]interface{}{row, {"user@x.com", "acme", 2}, {"USER@X.COM\t", []byte(" ACME"), 3}} {
+		if id, err = r.getDocID(rule, row); err != nil {
+			t.Fatal(err)
+		}
+		if id != "user@x.com:acme" {
+			t.Errorf("Expected: is user@x.com:acme, but: was %q", id)
+		}
+	}
+
+	// the id columns are not a string
+	rule.ID = []string{"id"}
+	if id, err = r.getDocID(rule, []interface{}{"a", "b", 1}); err != nil || id != "1" {
+		t.Errorf("Expected: is 1, but: was %q, %v", id, err)
+	}
+
+	rule.IDNormalize = []string{"upper"}
+	if err := rule.prepare(); err == nil {
+		t.Error("Expected: an error for invalid id_normalize, but: was nil")
+	}
+}
+
+func TestMakeRequestTypeColumn(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "kind", "varchar(32)")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	rule.TypeColumn = "kind"
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := [][]interface{}{{1, "Car"}, {2, nil}, {3, ""}}
+	expect := []string{"car", rule.Type, rule.Type}
+	for _, action := range []string{canal.InsertAction, canal.DeleteAction} {
+		reqs, err := r.makeRequest(rule, action, rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, req := range reqs {
+			if req.Type != expect[i] {
+				t.Errorf("%s %d Expected: is %s, but: was %s", action, i, expect[i], req.Type)
+			}
+		}
+	}
+
+	// the old doc of the old type is deleted
+	reqs, err := r.makeUpdateRequest(rule, [][]interface{}{{1, "car"}, {1, "truck"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 2 || reqs[0].Action != elastic.ActionDelete || reqs[0].Type != "car" ||
+		reqs[1].Action != elastic.ActionIndex || reqs[1].Type != "truck" {
+		t.Errorf("Expected: is delete car and index truck, but: was %+v, %+v", reqs[0], reqs[1])
+	}
+}
+
+func TestMetaFields(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {})
+	defer closeFn()
+
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(64)")
+	rule := newTestRule(ta)
+	rule.MetaFields = map[string]string{metaFieldAction: "_op", metaFieldBinlogName: "_binlog",
+		metaFieldBinlogPos: "_pos", metaFieldTimestamp: "_ts"}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+	r.rules = map[string][]*Rule{ruleKey(rule.Schema, rule.Table): {rule}}
+
+	// the dump rows have no binlog position
+	h := &eventHandler{r}
+	e := &canal.RowsEvent{Table: ta, Action: canal.InsertAction, Rows: [][]interface{}{{1, "first"}}}
+	if err := h.OnRow(e); err != nil {
+		t.Fatal(err)
+	}
+	reqs := (<-r.syncCh).([]*elastic.BulkRequest)
+	expect := map[string]interface{}{"id": int64(1), "title": "first", "_op": canal.InsertAction}
+	if !reflect.DeepEqual(reqs[0].Data, expect) {
+		t.Errorf("Expected: is %v, but: was %v", expect, reqs[0].Data)
+	}
+
+	reqs, err := r.makeRowsRequest(rule, canal.UpdateAction, [][]interface{}{{1, "first"}, {1, "second"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletes, err := r.makeRowsRequest(rule, canal.DeleteAction, [][]interface{}{{1, "second"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs = append(reqs, deletes...)
+	addMetaFields(rule, reqs, rowsMeta{action: canal.UpdateAction, binlogName: "mysql-bin.000002", binlogPos: 1234, timestamp: 1571022193})
+	expect = map[string]interface{}{"title": "second", "_op": canal.UpdateAction, "_binlog": "mysql-bin.000002",
+		"_pos": uint32(1234), "_ts": uint32(1571022193)}
+	if !reflect.DeepEqual(reqs[0].Data, expect) {
+		t.Errorf("Expected: is %v, but: was %v", expect, reqs[0].Data)
+	}
+	if reqs[1].Data != nil {
+		t.Errorf("Expected: is no doc for the delete, but: was %v", reqs[1].Data)
+	}
+
+	rule.MetaFields = map[string]string{metaFieldAction: "title"}
+	if err := rule.checkTable(); err == nil {
+		t.Error("Expected: an error for the meta field colliding with the column, but: was nil")
+	}
+	rule.MetaFields = map[string]string{"gtid": "_gtid"}
+	if err := rule.prepare(); err == nil {
+		t.Error("Expected: an error for invalid meta_field, but: was nil")
+	}
+}
+
+func TestMakeRequestWriteMode(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(64)")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	rule.WriteMode = writeModeUpdate
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{1, "first"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{"id": int64(1), "title": "first"}
+	if len(reqs) != 1 || reqs[0].Action != elastic.ActionUpdate || !reqs[0].Upsert || !reflect.DeepEqual(reqs[0].Data, expect) {
+		t.Errorf("Expected: is an upsert with the whole row, but: was %+v", reqs[0])
+	}
+
+	// the moved doc is merged too, the old one is still deleted
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{1, "first"}, {2, "first"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 2 || reqs[0].Action != elastic.ActionDelete || reqs[1].Action != elastic.ActionUpdate || !reqs[1].Upsert {
+		t.Errorf("Expected: is delete and upsert, but: was %+v, %+v", reqs[0], reqs[1])
+	}
+
+	reqs, err = r.makeDeleteRequest(rule, [][]interface{}{{2, "first"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs[0].Action != elastic.ActionDelete {
+		t.Errorf("Expected: is delete, but: was %s", reqs[0].Action)
+	}
+
+	rule.UpdateMode = updateModeIndex
+	if err = rule.prepare(); err == nil {
+		t.Error("Expected: an error for write_mode update with update_mode index, but: was nil")
+	}
+	rule.UpdateMode = updateModeUpdate
+	rule.WriteMode = "replace"
+	if err = rule.prepare(); err == nil {
+		t.Error("Expected: an error for invalid write_mode, but: was nil")
+	}
+}
+
+func TestSyncChanFull(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {})
+	defer closeFn()
+	r.syncCh = make(chan interface{}, 1)
+
+	if err := r.sync(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// blocked until the sync loop consumes the channel
+	done := make(chan error, 1)
+	go func() { done <- r.sync(2) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Expected: is blocked, but: was done with %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	<-r.syncCh
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	warned := atomic.LoadInt64(&r.syncChanFullWarnTime)
+	if warned == 0 {
+		t.Error("Expected: is warned for the full channel, but: was not")
+	}
+
+	// warned at most once in the interval
+	<-r.syncCh
+	if err := r.sync(3); err != nil {
+		t.Fatal(err)
+	}
+	go func() { done <- r.sync(4) }()
+	time.Sleep(10 * time.Millisecond)
+	<-r.syncCh
+	<-done
+	if n := atomic.LoadInt64(&r.syncChanFullWarnTime); n != warned {
+		t.Errorf("Expected: is warned once, but: was warned again at %d", n)
+	}
+
+	// the blocked event is dropped after closing
+	go func() { done <- r.sync(5) }()
+	time.Sleep(10 * time.Millisecond)
+	r.cancel()
+	if err := <-done; err == nil {
+		t.Error("Expected: an error after closing, but: was nil")
+	}
+}
+
+func TestMakeRequestMultibyte(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(256)", "content", "text")
+
+	r := new(River)
+	r.c = &Config{ColumnMismatch: columnMismatchError}
+
+	title, content := "emoji 😀🍣", "日本語 한국어 𠮷"
+	reqs, err := r.makeRowsRequest(newTestRule(ta), canal.InsertAction, [][]interface{}{{1, title, []byte(content)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 {
+		t.Fatalf("Expected: is 1 request, but: was %d", len(reqs))
+	}
+	if v := reqs[0].Data["title"]; v != title {
+		t.Errorf("Title Expected: is %q, but: was %q", title, v)
+	}
+	if v := reqs[0].Data["content"]; v != content {
+		t.Errorf("Content Expected: is %q, but: was %q", content, v)
+	}
+}
+
+func TestExcludeColumnPatterns(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(256)",
+		"created_by", "varchar(256)", "lock_version", "int", "version_note", "varchar(256)")
+
+	cfg := &Config{ExcludeColumnPatterns: []string{"id", "created_by", ".*_version"}}
+	if err := cfg.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := new(River)
+	r.c = cfg
+	rule := newTestRule(ta)
+	rule.excludeColumnRegexps = cfg.excludeColumnRegexps
+	if err := rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := r.makeRowsRequest(rule, canal.InsertAction, [][]interface{}{{1, "a", "admin", 3, "note"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 {
+		t.Fatalf("Expected: is 1 request, but: was %d", len(reqs))
+	}
+	for _, column := range []string{"created_by", "lock_version"} {
+		if _, ok := reqs[0].Data[column]; ok {
+			t.Errorf("Expected: %s is excluded, but: was %v", column, reqs[0].Data)
+		}
+	}
+	for _, column := range []string{"id", "title", "version_note"} {
+		if _, ok := reqs[0].Data[column]; !ok {
+			t.Errorf("Expected: %s is synced, but: was %v", column, reqs[0].Data)
+		}
+	}
+	if reqs[0].ID != "1" {
+		t.Errorf("ID Expected: is 1, but: was %s", reqs[0].ID)
+	}
+}
+
+func TestAutoID(t *testing.T) {
+	ta := newTestTable(nil, "ts", "int", "message", "varchar(256)")
+
+	var bulkBody string
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		bulkBody = string(data)
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	})
+	defer closeFn()
+	r.c.BulkSize = 10
+
+	rule := newTestRule(ta)
+	rule.AutoID = true
+	rule.IgnoreEvents = []string{"delete"}
+	if err := rule.prepare(); err == nil {
+		t.Error("Expected: an error for auto_id with the updates, but: was nil")
+	}
+	rule.IgnoreEvents = []string{"update", "delete"}
+	rule.ID = []string{"ts"}
+	if err := rule.prepare(); err == nil {
+		t.Error("Expected: an error for auto_id with id, but: was nil")
+	}
+	rule.ID = nil
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	// the table has no PK
+	if err := rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := r.makeRowsRequest(rule, canal.InsertAction, [][]interface{}{{1, "a"}, {1, "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 2 || len(reqs[0].ID) > 0 {
+		t.Fatalf("Expected: is 2 requests without id, but: was %d", len(reqs))
+	}
+	// the same rows are not coalesced
+	if err = r.doBulk(r.ctx, coalesceRequests(reqs)); err != nil {
+		t.Fatal(err)
+	}
+	meta := `{"index":{"_index":"test_sync","_type":"test_sync"}}` + "\n" + `{"message":"a","ts":1}` + "\n"
+	if expected := meta + meta; bulkBody != expected {
+		t.Errorf("Expected: is %q, but: was %q", expected, bulkBody)
+	}
+
+	if reqs, err = r.makeRowsRequest(rule, canal.DeleteAction, [][]interface{}{{1, "a"}}); err != nil || len(reqs) > 0 {
+		t.Errorf("Expected: is the delete ignored, but: was %d requests, %v", len(reqs), err)
+	}
+}
+
+func TestMakeRequestMask(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "ssn", "varchar(256)", "card", "varchar(256)",
+		"pin", "varchar(256)", "note", "varchar(256)", "title", "varchar(256)")
+
+	r := new(River)
+	r.c = &Config{ColumnMismatch: columnMismatchError}
+	rule := newTestRule(ta)
+	rule.Mask = map[string]string{"ssn": maskSHA256, "card": maskLast4, "pin": maskLast4, "note": maskNull}
+	rule.MaskSalt = "salt"
+	rule.Templates = map[string]string{"summary": "{{.title}} {{.card}}"}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte("salt123-45-6789"))
+	ssn := hex.EncodeToString(sum[:])
+
+	reqs, err := r.makeRowsRequest(rule, canal.InsertAction,
+		[][]interface{}{{1, "123-45-6789", []byte("4111111111111111"), "123", "secret", "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"id": 1, "ssn": ssn, "card": "************1111", "pin": "***",
+		"note": nil, "title": "a", "summary": "a ************1111"}
+	for k, v := range expected {
+		if data := reqs[0].Data[k]; fmt.Sprint(data) != fmt.Sprint(v) {
+			t.Errorf("%s Expected: is %v, but: was %v", k, v, data)
+		}
+	}
+
+	// the partial update is masked too, and NULL is kept
+	reqs, err = r.makeRowsRequest(rule, canal.UpdateAction,
+		[][]interface{}{{1, "123-45-6789", "4111111111111111", "123", "secret", "a"}, {1, nil, "4111111111112222", "123", "secret", "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := reqs[0].Data["ssn"]; !ok || v != nil {
+		t.Errorf("Expected: is the NULL ssn, but: was %v", reqs[0].Data)
+	}
+	if v := reqs[0].Data["card"]; v != "************2222" {
+		t.Errorf("Expected: is the masked card, but: was %v", v)
+	}
+
+	rule.Mask = map[string]string{"id": maskNull}
+	if err := rule.checkTable(); err == nil {
+		t.Error("Expected: an error for masking the id column, but: was nil")
+	}
+	rule.Mask = map[string]string{"ssn": "md5"}
+	if err := rule.prepare(); err == nil {
+		t.Error("Expected: an error for the invalid mask, but: was nil")
+	}
+}
+
+func TestMakeRequestNestUnder(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(256)", "author", "varchar(256)")
+
+	r := new(River)
+	r.c = &Config{ColumnMismatch: columnMismatchError}
+	rule := newTestRule(ta)
+	rule.NestUnder = "data."
+	if err := rule.prepare(); err == nil {
+		t.Error("Expected: an error for the invalid nest_under, but: was nil")
+	}
+	rule.NestUnder = "data"
+	rule.FieldMapping = map[string]FieldTargets{"author": {"writer"}}
+	rule.MetaFields = map[string]string{metaFieldAction: "data"}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rule.checkTable(); err == nil {
+		t.Error("Expected: an error for the meta field colliding with nest_under, but: was nil")
+	}
+	// the meta field can be the name of a column in the object
+	rule.MetaFields = map[string]string{metaFieldAction: "title"}
+	if err := rule.checkTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	r.SetDocumentTransformer(DocumentTransformerFunc(func(rule *Rule, action string, values []interface{}, data map[string]interface{}) (map[string]interface{}, error) {
+		data["upper"] = strings.ToUpper(data["title"].(string))
+		return data, nil
+	}))
+
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{1, "a", "bob"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addMetaFields(rule, reqs, rowsMeta{action: canal.InsertAction})
+	expected := map[string]interface{}{
+		"data":  map[string]interface{}{"id": int64(1), "title": "a", "writer": "bob", "upper": "A"},
+		"title": canal.InsertAction,
+	}
+	if !reflect.DeepEqual(reqs[0].Data, expected) {
+		t.Errorf("Insert Expected: is %v, but: was %v", expected, reqs[0].Data)
+	}
+
+	// the partial update is merged into the object
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{1, "a", "bob"}, {1, "b", "bob"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]interface{}{"data": map[string]interface{}{"title": "b", "upper": "B"}}
+	if reqs[0].Action != elastic.ActionUpdate || !reflect.DeepEqual(reqs[0].Data, expected) {
+		t.Errorf("Update Expected: is %v, but: was %s %v", expected, reqs[0].Action, reqs[0].Data)
+	}
+
+	rule.DeleteVerifyFields = []string{"title"}
+	if reqs, err = r.makeDeleteRequest(rule, [][]interface{}{{1, "b", "bob"}}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]interface{}{"data.title": "b"}; !reflect.DeepEqual(reqs[0].Expected, expected) {
+		t.Errorf("Delete Expected: is %v, but: was %v", expected, reqs[0].Expected)
+	}
+}
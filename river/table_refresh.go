@@ -0,0 +1,74 @@
+package river
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// refreshTablePath is the path to refresh the table information by POST, like /refresh_table?table=db.table.
+const refreshTablePath = "/refresh_table"
+
+// RefreshTable reloads the table information of the rules of the table from MySQL before
+// syncing the next rows of the table, e.g, after altering the table by a tool whose DDL is
+// not recognized. It returns ErrRuleNotExist if the table has no rule.
+func (r *River) RefreshTable(db string, table string) error {
+	key := ruleKey(db, table)
+	if _, ok := r.rules[key]; !ok {
+		return errors.Annotatef(ErrRuleNotExist, "%s.%s", db, table)
+	}
+
+	// the rows are handled in the canal goroutine, so refresh there to avoid the race
+	r.staleTables.Store(key, struct{}{})
+	return nil
+}
+
+// refreshTable reloads the table information from MySQL for the rules of the table.
+func (r *River) refreshTable(db string, table string) error {
+	rules, ok := r.rules[ruleKey(db, table)]
+	if !ok {
+		return ErrRuleNotExist
+	}
+
+	log.Infof("refresh the table information of %s.%s", db, table)
+	reload := r.reloadTable
+	if reload == nil {
+		reload = r.reloadCanalTable
+	}
+	tableInfo, err := reload(db, table)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(setRulesTable(rules, tableInfo))
+}
+
+// reloadCanalTable clears the table cache of the canal, then gets the table from MySQL.
+func (r *River) reloadCanalTable(db string, table string) (*schema.Table, error) {
+	r.canal.ClearTableCache([]byte(db), []byte(table))
+	tableInfo, err := r.canal.GetTable(db, table)
+	return tableInfo, errors.Trace(err)
+}
+
+func (r *River) handleRefreshTable(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "refresh table needs POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	seps := strings.SplitN(req.URL.Query().Get("table"), ".", 2)
+	if len(seps) != 2 || len(seps[0]) == 0 || len(seps[1]) == 0 {
+		http.Error(w, "table must be db.table", http.StatusBadRequest)
+		return
+	}
+
+	if err := r.RefreshTable(seps[0], seps[1]); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
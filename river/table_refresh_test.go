@@ -0,0 +1,94 @@
+package river
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func TestOnRowRefreshTable(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {})
+	defer closeFn()
+
+	oldTable := newTestTable([]string{"id"}, "id", "int", "title", "varchar(64)")
+	rule := newTestRule(oldTable)
+	r.rules = map[string][]*Rule{ruleKey(rule.Schema, rule.Table): {rule}}
+
+	// a column is added mid-stream, but the DDL is missed
+	newTable := newTestTable([]string{"id"}, "id", "int", "title", "varchar(64)", "content", "varchar(64)")
+	reloaded := 0
+	r.reloadTable = func(db string, table string) (*schema.Table, error) {
+		reloaded++
+		return newTable, nil
+	}
+
+	h := &eventHandler{r}
+	e := &canal.RowsEvent{Table: newTable, Action: canal.InsertAction, Rows: [][]interface{}{{1, "first", "text"}}}
+	if err := h.OnRow(e); err != nil {
+		t.Fatal(err)
+	}
+	if rule.TableInfo != newTable || reloaded != 1 {
+		t.Fatalf("Expected: the table is reloaded once, but: was %d times", reloaded)
+	}
+
+	reqs := (<-r.syncCh).([]*elastic.BulkRequest)
+	expect := map[string]interface{}{"id": int64(1), "title": "first", "content": "text"}
+	if !reflect.DeepEqual(reqs[0].Data, expect) {
+		t.Errorf("Expected: is %v, but: was %v", expect, reqs[0].Data)
+	}
+
+	// the same columns, reloaded only if refreshed by RefreshTable
+	if err := h.OnRow(e); err != nil {
+		t.Fatal(err)
+	}
+	<-r.syncCh
+	if err := r.RefreshTable(rule.Schema, rule.Table); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.OnRow(e); err != nil {
+		t.Fatal(err)
+	}
+	<-r.syncCh
+	if reloaded != 2 {
+		t.Errorf("Expected: the table is reloaded twice, but: was %d times", reloaded)
+	}
+
+	if err := r.RefreshTable(rule.Schema, "not_exist"); errors.Cause(err) != ErrRuleNotExist {
+		t.Errorf("Expected: is %v, but: was %v", ErrRuleNotExist, err)
+	}
+}
+
+func TestOnRowRefreshTableError(t *testing.T) {
+	r, closeFn := newTestRiver(t, func(w http.ResponseWriter, req *http.Request) {})
+	defer closeFn()
+
+	oldTable := newTestTable([]string{"id"}, "id", "int", "title", "varchar(64)")
+	rule := newTestRule(oldTable)
+	r.rules = map[string][]*Rule{ruleKey(rule.Schema, rule.Table): {rule}}
+	r.reloadTable = func(db string, table string) (*schema.Table, error) {
+		return nil, errors.Trace(schema.ErrTableNotExist)
+	}
+
+	// the row has more columns, but the table can't be refreshed
+	h := &eventHandler{r}
+	e := &canal.RowsEvent{Table: oldTable, Action: canal.InsertAction, Rows: [][]interface{}{{1, "first", "text"}}}
+	if err := h.OnRow(e); err == nil {
+		t.Error("Expected: an error for the failed refresh, but: was nil")
+	}
+	if r.ctx.Err() == nil {
+		t.Error("Expected: the sync is closed, but: was not")
+	}
+	if rule.TableInfo != oldTable {
+		t.Error("Expected: the table is not changed, but: was changed")
+	}
+	select {
+	case v := <-r.syncCh:
+		t.Errorf("Expected: no request is synced, but: was %v", v)
+	default:
+	}
+}
@@ -0,0 +1,25 @@
+package river
+
+import "github.com/juju/errors"
+
+// ErrSkipDocument is returned by the DocumentTransformer to skip syncing the document.
+var ErrSkipDocument = errors.New("skip document")
+
+// DocumentTransformer transforms the documents with the custom logic before syncing them to ES,
+// so the package can be embedded without forking for the logic not expressed by the rules.
+type DocumentTransformer interface {
+	// Transform returns the document to sync for the row. The action is canal.InsertAction
+	// or canal.UpdateAction, values are the row values after the change, and data is the
+	// document made by the rule, which only has the changed fields for a partial update.
+	// The data can be modified and returned. Return ErrSkipDocument to skip the document,
+	// or any other error to close the sync. The deletes are not transformed.
+	Transform(rule *Rule, action string, values []interface{}, data map[string]interface{}) (map[string]interface{}, error)
+}
+
+// DocumentTransformerFunc is an adapter to use a function as the DocumentTransformer.
+type DocumentTransformerFunc func(rule *Rule, action string, values []interface{}, data map[string]interface{}) (map[string]interface{}, error)
+
+// Transform calls f(rule, action, values, data).
+func (f DocumentTransformerFunc) Transform(rule *Rule, action string, values []interface{}, data map[string]interface{}) (map[string]interface{}, error) {
+	return f(rule, action, values, data)
+}
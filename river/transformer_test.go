@@ -0,0 +1,52 @@
+package river
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+	"github.com/siddontang/go-mysql/canal"
+)
+
+func TestMakeRequestTransformer(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "title", "varchar(256)")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	r.SetDocumentTransformer(DocumentTransformerFunc(func(rule *Rule, action string, values []interface{}, data map[string]interface{}) (map[string]interface{}, error) {
+		if values[1] == "skip" {
+			return nil, ErrSkipDocument
+		}
+		if values[1] == "bad" {
+			return nil, errors.New("bad title")
+		}
+		data["action"] = action
+		return data, nil
+	}))
+
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{1, "a"}, {2, "skip"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || reqs[0].ID != "1" || reqs[0].Data["action"] != canal.InsertAction {
+		t.Errorf("Expected: is the transformed insert for 1, but: was %+v", reqs)
+	}
+
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{1, "a"}, {1, "b"}, {2, "a"}, {3, "skip"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the old doc 2 is still deleted, but the new doc 3 is skipped
+	if len(reqs) != 2 || reqs[0].Data["action"] != canal.UpdateAction || reqs[1].Action != elastic.ActionDelete {
+		t.Errorf("Expected: is the transformed update and the delete, but: was %+v", reqs)
+	}
+
+	if _, err = r.makeInsertRequest(rule, [][]interface{}{{1, "bad"}}); err == nil {
+		t.Error("Expected: an error for the transformer, but: was nil")
+	}
+
+	// the deletes are not transformed
+	if reqs, err = r.makeDeleteRequest(rule, [][]interface{}{{2, "skip"}}); err != nil || len(reqs) != 1 {
+		t.Errorf("Expected: is the delete, but: was %+v, %v", reqs, err)
+	}
+}
@@ -0,0 +1,213 @@
+package river
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// whereCond is a comparison like `status != 'draft'` or `deleted_at IS NULL`.
+type whereCond struct {
+	column string
+	op     string
+	// string, float64 or nil for IS NULL and IS NOT NULL
+	value interface{}
+}
+
+// whereExpr is the rule where condition, all the comparisons must be true.
+type whereExpr []whereCond
+
+const (
+	whereOpEQ      = "="
+	whereOpNE      = "!="
+	whereOpLT      = "<"
+	whereOpLE      = "<="
+	whereOpGT      = ">"
+	whereOpGE      = ">="
+	whereOpNull    = "IS NULL"
+	whereOpNotNull = "IS NOT NULL"
+)
+
+// parseWhere parses the where condition, only comparisons joined with AND are supported, like
+//
+//	status != 'draft' AND price >= 10 AND deleted_at IS NULL
+func parseWhere(where string) (whereExpr, error) {
+	tokens, err := tokenizeWhere(where)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var expr whereExpr
+	for len(tokens) > 0 {
+		if len(tokens) < 3 {
+			return nil, errors.Errorf("invalid where %s, must be column op value", where)
+		}
+
+		cond := whereCond{column: strings.Trim(tokens[0], "`")}
+
+		if strings.EqualFold(tokens[1], "IS") {
+			if strings.EqualFold(tokens[2], "NULL") {
+				cond.op = whereOpNull
+				tokens = tokens[3:]
+			} else if len(tokens) > 3 && strings.EqualFold(tokens[2], "NOT") && strings.EqualFold(tokens[3], "NULL") {
+				cond.op = whereOpNotNull
+				tokens = tokens[4:]
+			} else {
+				return nil, errors.Errorf("invalid where %s, IS must be followed with NULL or NOT NULL", where)
+			}
+		} else {
+			switch tokens[1] {
+			case whereOpEQ, whereOpNE, whereOpLT, whereOpLE, whereOpGT, whereOpGE:
+				cond.op = tokens[1]
+			case "<>":
+				cond.op = whereOpNE
+			default:
+				return nil, errors.Errorf("invalid where %s, unsupported operator %s", where, tokens[1])
+			}
+
+			value := tokens[2]
+			if value[0] == '\'' || value[0] == '"' {
+				cond.value = value[1 : len(value)-1]
+			} else if f, err := strconv.ParseFloat(value, 64); err == nil {
+				cond.value = f
+			} else {
+				return nil, errors.Errorf("invalid where %s, value %s must be a number or a quoted string", where, value)
+			}
+			tokens = tokens[3:]
+		}
+
+		expr = append(expr, cond)
+
+		if len(tokens) > 0 {
+			if !strings.EqualFold(tokens[0], "AND") {
+				return nil, errors.Errorf("invalid where %s, only AND is supported, but got %s", where, tokens[0])
+			}
+			tokens = tokens[1:]
+			if len(tokens) == 0 {
+				return nil, errors.Errorf("invalid where %s, AND must be followed with a comparison", where)
+			}
+		}
+	}
+
+	return expr, nil
+}
+
+func tokenizeWhere(where string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(where); {
+		c := where[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(where[i+1:], c)
+			if end < 0 {
+				return nil, errors.Errorf("invalid where %s, unclosed quote", where)
+			}
+			tokens = append(tokens, where[i:i+end+2])
+			i += end + 2
+		case strings.IndexByte("=!<>", c) >= 0:
+			j := i + 1
+			for j < len(where) && strings.IndexByte("=<>", where[j]) >= 0 {
+				j++
+			}
+			tokens = append(tokens, where[i:j])
+			i = j
+		default:
+			j := i + 1
+			for j < len(where) && strings.IndexByte(" \t\n'\"=!<>", where[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, where[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// checkTable checks all the columns exist in the table.
+func (expr whereExpr) checkTable(table *schema.Table) error {
+	for _, cond := range expr {
+		if table.FindColumn(cond.column) < 0 {
+			return errors.Errorf("where column %s is not in table %s", cond.column, table)
+		}
+	}
+	return nil
+}
+
+// match returns whether the row matches all the comparisons.
+func (expr whereExpr) match(table *schema.Table, row []interface{}) bool {
+	for _, cond := range expr {
+		index := table.FindColumn(cond.column)
+		if index < 0 || !cond.match(&table.Columns[index], row[index]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cond *whereCond) match(col *schema.TableColumn, value interface{}) bool {
+	switch cond.op {
+	case whereOpNull:
+		return value == nil
+	case whereOpNotNull:
+		return value != nil
+	}
+
+	// like SQL, a comparison with NULL is never true
+	if value == nil {
+		return false
+	}
+
+	var n int
+	switch v := cond.value.(type) {
+	case float64:
+		f, ok := toFloat64(value)
+		if !ok {
+			return false
+		}
+		n = compareFloat64(f, v)
+	case string:
+		n = strings.Compare(whereString(col, value), v)
+	}
+
+	switch cond.op {
+	case whereOpEQ:
+		return n == 0
+	case whereOpNE:
+		return n != 0
+	case whereOpLT:
+		return n < 0
+	case whereOpLE:
+		return n <= 0
+	case whereOpGT:
+		return n > 0
+	case whereOpGE:
+		return n >= 0
+	}
+	return false
+}
+
+// whereString returns the string value to compare, ENUM and SET may be int64 in binlog.
+func whereString(col *schema.TableColumn, value interface{}) string {
+	value = makeEnumSetData(col, value)
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(value)
+}
+
+func compareFloat64(a, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,95 @@
+package river
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+)
+
+func TestParseWhere(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "status", "varchar(32)", "price", "decimal(10,2)", "deleted_at", "datetime")
+
+	expr, err := parseWhere("status <> 'draft' AND `price` >= 10 and deleted_at IS NULL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expr) != 3 {
+		t.Fatalf("Expected: is 3 conditions, but: was %+v", expr)
+	}
+	if err = expr.checkTable(ta); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		row    []interface{}
+		expect bool
+	}{
+		{[]interface{}{1, "published", "10.00", nil}, true},
+		{[]interface{}{1, "published", 9.5, nil}, false},
+		{[]interface{}{1, "draft", 20, nil}, false},
+		{[]interface{}{1, nil, 20, nil}, false},
+		{[]interface{}{1, "published", 20, "2018-01-01 00:00:00"}, false},
+	}
+	for _, tt := range tests {
+		if match := expr.match(ta, tt.row); match != tt.expect {
+			t.Errorf("Row %v Expected: is %v, but: was %v", tt.row, tt.expect, match)
+		}
+	}
+
+	for _, where := range []string{"status", "status LIKE 'a%'", "status = 'a' OR id = 1", "status = 'a' AND", "id IS 1", "status = draft"} {
+		if _, err := parseWhere(where); err == nil {
+			t.Errorf("Expected: an error for where %s, but: was nil", where)
+		}
+	}
+
+	if expr, _ = parseWhere("name = 'a'"); expr.checkTable(ta) == nil {
+		t.Error("Expected: an error for unknown where column, but: was nil")
+	}
+}
+
+func TestMakeRequestWhere(t *testing.T) {
+	ta := newTestTable([]string{"id"}, "id", "int", "status", "varchar(32)")
+
+	r := new(River)
+	rule := newTestRule(ta)
+	rule.Where = "status = 'published'"
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{1, "draft"}, {2, "published"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || reqs[0].ID != "2" {
+		t.Errorf("Expected: is only the published row, but: was %+v", reqs)
+	}
+
+	// always delete, the doc may be synced before the where is added
+	reqs, err = r.makeDeleteRequest(rule, [][]interface{}{{1, "draft"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 {
+		t.Errorf("Expected: is 1 delete, but: was %+v", reqs)
+	}
+
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{1, "draft"}, {1, "draft"}, {2, "published"}, {2, "draft"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || reqs[0].ID != "2" || reqs[0].Action != elastic.ActionDelete {
+		t.Errorf("Expected: is a delete for the unpublished row, but: was %+v", reqs)
+	}
+
+	// the row entering the where condition is indexed with all the columns
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{3, "draft"}, {3, "published"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{"id": int64(3), "status": "published"}
+	if len(reqs) != 1 || reqs[0].ID != "3" || reqs[0].Action != elastic.ActionIndex || !reflect.DeepEqual(reqs[0].Data, expect) {
+		t.Errorf("Expected: is an index for the published row, but: was %+v", reqs)
+	}
+}